@@ -0,0 +1,132 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ProfilingJob runs colibri on a process of a pod.
+// Its name is the ID of the job, the same as in the colibri REST API.
+type ProfilingJob struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ProfilingJobSpec   `json:"spec"`
+	Status ProfilingJobStatus `json:"status,omitempty"`
+}
+
+// ProfilingJobSpec is the target and the parameters of a job
+type ProfilingJobSpec struct {
+	// Pod is the targeted pod, in the namespace of the job
+	Pod string `json:"pod"`
+	// Process is the ID of the targeted process, discovered by colibri if the process is targeted by its container
+	// +optional
+	Process string `json:"process,omitempty"`
+	// Container targets a process by its container, instead of its ID
+	// +optional
+	Container string `json:"container,omitempty"`
+	// Command is a regular expression matching the command line of the process in the container,
+	// the main process of the container if omitted
+	// +optional
+	Command string `json:"command,omitempty"`
+	// Frequency is the query interval in millisecond, 10 if omitted
+	// +optional
+	Frequency int `json:"freq,omitempty"`
+	// Iteration is the number of queries, 1000 if omitted
+	// +optional
+	Iteration int `json:"iter,omitempty"`
+	// Percentile of data analytics, 99 if omitted
+	// +optional
+	Percentile int `json:"pert,omitempty"`
+}
+
+// ProfilingJobStatus is the progress of a job
+type ProfilingJobStatus struct {
+	// State is Pending, Running, Succeeded, Failed, TimedOut or Cancelled
+	State string `json:"state,omitempty"`
+	// Reason is why the job is failed or still pending
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// JobName is the name of the K8s Job (or local process) running colibri
+	// +optional
+	JobName string `json:"jobName,omitempty"`
+	// JobNamespace is the namespace of the K8s Job running colibri
+	// +optional
+	JobNamespace string `json:"jobNamespace,omitempty"`
+	// StartTime is the time the job is running
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// CompletionTime is the time the job is finished
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ProfilingJobList is a list of ProfilingJobs
+type ProfilingJobList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []ProfilingJob `json:"items"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ProfileResult is the latest result of profiling a process of a pod.
+// Its name is "<pod>.<process>".
+type ProfileResult struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// Pod is the profiled pod, in the namespace of the result
+	Pod string `json:"pod"`
+	// Process is the ID of the profiled process
+	Process string `json:"process"`
+	// CPU utilization, 0m if omitted
+	// +optional
+	CPU string `json:"cpu,omitempty"`
+	// Memory utilization, 0Mi if omitted
+	// +optional
+	Memory string `json:"ram,omitempty"`
+	// Ingress traffic bandwidth, 0k if omitted
+	// +optional
+	Ingress string `json:"ingress,omitempty"`
+	// Egress traffic bandwidth, 0k if omitted
+	// +optional
+	Egress string `json:"egress,omitempty"`
+	// Timestamp is the time the result is stored
+	// +optional
+	Timestamp metav1.Time `json:"timestamp,omitempty"`
+	// Token is the result token given to the job putting the result.
+	// It is only read when a result is created, and never returned.
+	// +optional
+	Token string `json:"token,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ProfileResultList is a list of ProfileResults
+type ProfileResultList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []ProfileResult `json:"items"`
+}
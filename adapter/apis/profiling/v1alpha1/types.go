@@ -0,0 +1,135 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Condition types of ProfilingJob
+const (
+	// ConditionRunning is True while any job of the latest run is not finished
+	ConditionRunning = "Running"
+	// ConditionComplete is True when all jobs of the latest run succeeded
+	ConditionComplete = "Complete"
+	// ConditionFailed is True when any job of the latest run could not be started or did not succeed
+	ConditionFailed = "Failed"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ProfilingJob declares profiling a process of the targeted pods, by its ID or name, once or on a schedule
+type ProfilingJob struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ProfilingJobSpec   `json:"spec"`
+	Status ProfilingJobStatus `json:"status,omitempty"`
+}
+
+// ProfilingJobSpec is the targets, the parameters and the schedule of profiling
+type ProfilingJobSpec struct {
+	// Target selects the pods to profile, in the namespace of ProfilingJob
+	Target ProfilingTarget `json:"target"`
+	// Process is the ID of the targeted process. Only one of process, processName and container can be set.
+	// +optional
+	Process string `json:"process,omitempty"`
+	// ProcessName targets the process by the name of its executable, e.g. "nginx", which colibri finds
+	// in container, or in the only container of the pod if container is empty
+	// +optional
+	ProcessName string `json:"processName,omitempty"`
+	// Container targets a process by its container, the main process of the container unless command is set
+	// +optional
+	Container string `json:"container,omitempty"`
+	// Command is a regular expression matching the command line of the process in container
+	// +optional
+	Command string `json:"command,omitempty"`
+	// Frequency is the query interval in millisecond, 10 if omitted
+	// +optional
+	Frequency int `json:"freq,omitempty"`
+	// Iteration is the number of queries, 1000 if omitted
+	// +optional
+	Iteration int `json:"iter,omitempty"`
+	// Percentile of data analytics, 99 if omitted
+	// +optional
+	Percentile int `json:"pert,omitempty"`
+	// Schedule is the interval between runs, e.g. "1h". The targets are profiled once if it is empty.
+	// +optional
+	Schedule string `json:"schedule,omitempty"`
+}
+
+// ProfilingTarget is a pod, or the pods of a workload selected by labels
+type ProfilingTarget struct {
+	// +optional
+	Pod string `json:"pod,omitempty"`
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// ProfilingJobStatus is the progress and the results of the latest run
+type ProfilingJobStatus struct {
+	// ObservedGeneration is the generation of spec the latest run is started for
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// LastScheduleTime is the time the latest run is started
+	// +optional
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+	// Jobs are the colibri jobs of the latest run, one for each targeted pod
+	// +optional
+	Jobs []ProfilingJobRun `json:"jobs,omitempty"`
+	// Results are the results of the succeeded jobs of the latest run
+	// +optional
+	Results []ProfilingJobResult `json:"results,omitempty"`
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// ProfilingJobRun is a colibri job started for a targeted pod
+type ProfilingJobRun struct {
+	Pod string `json:"pod"`
+	// JobID is the ID of the job in the colibri REST API and the colibri.profiling.io API group
+	JobID string `json:"jobID"`
+	// Process is the ID of the profiled process, set once colibri finds a process targeted by its name or container
+	// +optional
+	Process string `json:"process,omitempty"`
+	// State is Pending, Running, Succeeded, Failed, TimedOut or Cancelled, empty until the job is started
+	// +optional
+	State string `json:"state,omitempty"`
+	// +optional
+	Reason string `json:"reason,omitempty"`
+}
+
+// ProfilingJobResult is the result of profiling a targeted pod
+type ProfilingJobResult struct {
+	Pod     string `json:"pod"`
+	CPU     string `json:"cpu"`
+	Memory  string `json:"ram"`
+	Ingress string `json:"ingress"`
+	Egress  string `json:"egress"`
+	// Timestamp is the time the result is stored
+	Timestamp metav1.Time `json:"timestamp"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ProfilingJobList is a list of ProfilingJobs
+type ProfilingJobList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []ProfilingJob `json:"items"`
+}
@@ -20,9 +20,17 @@ import (
 	"flag"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/emicklei/go-restful"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/component-base/logs"
 	"k8s.io/klog/v2"
 
@@ -32,8 +40,8 @@ import (
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/apiserver"
 	basecmd "sigs.k8s.io/custom-metrics-apiserver/pkg/cmd"
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
-	generatedopenapi "sigs.k8s.io/custom-metrics-apiserver/test-adapter/generated/openapi"
 
+	generatedopenapi "colibri-apiserver/adapter/generated/openapi"
 	// make this the path to the provider that you just wrote
 	coliprov "colibri-apiserver/adapter/provider"
 )
@@ -43,9 +51,157 @@ type ColibriAdapter struct {
 
 	// Message is printed on succesful startup
 	Message string
+
+	// StoreType is the backend persisting job parameters and results: memory, file, configmap or secret
+	StoreType string
+	// StorePath is the file used by the file backend
+	StorePath string
+	// StoreNamespace and StoreName locate the ConfigMap/Secret used by the configmap/secret backend
+	StoreNamespace string
+	StoreName      string
+	// Retention is how long the stored samples are kept, zero means forever
+	Retention time.Duration
+	// StoreSaveInterval is the least interval between saves of a persistent store, zero saves every change
+	StoreSaveInterval time.Duration
+
+	// JobTemplate is the file of the job template, JobTemplateConfigMap is the ConfigMap (namespace/name) of it.
+	// The default template is used when neither is set.
+	JobTemplate          string
+	JobTemplateConfigMap string
+	JobTemplateKey       string
+	// JobTemplateReload is the interval to reload the job template, zero disables reloading
+	JobTemplateReload time.Duration
+	// JobImage is the image of colibri the job template is rendered with, and JobImagePullPolicy its pull policy
+	JobImage           string
+	JobImagePullPolicy string
+
+	// JobRunner runs colibri as K8s Jobs (kubernetes) or as processes of the adapter host (local)
+	JobRunner string
+	// JobCleanup decides how the K8s Jobs are cleaned up, the owner is the pod of the adapter
+	// when POD_NAME, POD_NAMESPACE and POD_UID are set by the downward API
+	JobCleanup coliprov.JobCleanup
+	// LocalBinary is the colibri-compatible binary run by the local runner
+	LocalBinary string
+	// LocalAPIURL is where the local runner tells colibri to put results
+	LocalAPIURL string
+
+	// Validation bounds the parameters of jobs
+	Validation coliprov.Validation
+	// JobPolicy decides the retries and the default timeout of jobs
+	JobPolicy coliprov.JobPolicy
+	// MetricNaming decides the names results are served as in the custom metrics API
+	MetricNaming coliprov.MetricNaming
+	// Recommendation decides the resources recommended for the containers of workloads from results
+	Recommendation coliprov.RecommendationPolicy
+	// ResultAnnotations writes the latest results as annotations of their pods and workloads
+	ResultAnnotations bool
+
+	// RESTAuth enables authentication and authorization of the colibri REST API,
+	// delegated to K8s API server like the secure port
+	RESTAuth bool
+	// RESTPort is the plain HTTP port of the colibri REST API, zero disables it.
+	// The colibri API group is always served on the secure port.
+	RESTPort int
+
+	// ProfilingJobController enables reconciling the ProfilingJobs of profiling.colibri.io,
+	// whose CustomResourceDefinition is installed by colibri-apiserver.yml
+	ProfilingJobController bool
+
+	// AdmissionPort is the HTTPS port of the mutating admission webhook setting the resources of new pods,
+	// zero disables it. AdmissionCertFile and AdmissionKeyFile are its serving certificate.
+	AdmissionPort     int
+	AdmissionCertFile string
+	AdmissionKeyFile  string
+	// Admission decides which pods have their resources set by the admission webhook
+	Admission coliprov.AdmissionPolicy
+}
+
+func (a *ColibriAdapter) makeRequestAuthOrDie() *coliprov.RequestAuth {
+	if !a.RESTAuth {
+		klog.Warningf("colibri REST API is served without authentication")
+		return nil
+	}
+
+	config, err := a.Config()
+	if err != nil {
+		klog.Fatalf("unable to construct adapter config: %v", err)
+	}
+	return &coliprov.RequestAuth{
+		Authenticator: config.GenericConfig.Authentication.Authenticator,
+		Authorizer:    config.GenericConfig.Authorization.Authorizer,
+	}
+}
+
+func (a *ColibriAdapter) makeRunnerOrDie(client dynamic.Interface) coliprov.JobRunner {
+	switch a.JobRunner {
+	case "kubernetes":
+		cleanup := a.JobCleanup
+		if name, ns, uid := os.Getenv("POD_NAME"), os.Getenv("POD_NAMESPACE"), os.Getenv("POD_UID"); name != "" && ns != "" && uid != "" {
+			cleanup.Owner = &metav1.OwnerReference{APIVersion: "v1", Kind: "Pod", Name: name, UID: types.UID(uid)}
+			cleanup.OwnerNamespace = ns
+		}
+		runner := coliprov.NewKubernetesRunner(client, a.makeJobTemplateOrDie(client), cleanup)
+		if collector, ok := runner.(coliprov.OrphanCollector); ok {
+			if err := collector.CollectOrphans(); err != nil {
+				klog.Errorf("Failed to collect orphaned jobs: %v", err)
+			}
+		}
+		return runner
+	case "local":
+		return coliprov.NewLocalRunner(a.LocalBinary, a.LocalAPIURL)
+	}
+	klog.Fatalf("unknown job runner %q", a.JobRunner)
+	return nil
+}
+
+func (a *ColibriAdapter) makeJobTemplateOrDie(client dynamic.Interface) *coliprov.JobTemplate {
+	source := coliprov.DefaultTemplateSource()
+	switch {
+	case a.JobTemplate != "" && a.JobTemplateConfigMap != "":
+		klog.Fatalf("only one of --job-template and --job-template-configmap can be set")
+	case a.JobTemplate != "":
+		source = coliprov.FileTemplateSource(a.JobTemplate)
+	case a.JobTemplateConfigMap != "":
+		parts := strings.SplitN(a.JobTemplateConfigMap, "/", 2)
+		if len(parts) != 2 {
+			klog.Fatalf("--job-template-configmap should be namespace/name, got %q", a.JobTemplateConfigMap)
+		}
+		source = coliprov.ConfigMapTemplateSource(client, parts[0], parts[1], a.JobTemplateKey)
+	}
+
+	jobTemplate, err := coliprov.NewJobTemplate(source, a.JobImage, corev1.PullPolicy(a.JobImagePullPolicy))
+	if err != nil {
+		klog.Fatalf("unable to load job template: %v", err)
+	}
+	if a.JobTemplateReload > 0 && (a.JobTemplate != "" || a.JobTemplateConfigMap != "") {
+		go jobTemplate.Run(a.JobTemplateReload, wait.NeverStop)
+	}
+	return jobTemplate
+}
+
+func (a *ColibriAdapter) makeStoreOrDie(client dynamic.Interface) coliprov.MetricStore {
+	var backend coliprov.StoreBackend
+	switch a.StoreType {
+	case "memory":
+		return coliprov.NewMemoryStore(a.Retention)
+	case "file":
+		backend = coliprov.NewFileBackend(a.StorePath)
+	case "configmap":
+		backend = coliprov.NewConfigMapBackend(client, a.StoreNamespace, a.StoreName)
+	case "secret":
+		backend = coliprov.NewSecretBackend(client, a.StoreNamespace, a.StoreName)
+	default:
+		klog.Fatalf("unknown store type %q", a.StoreType)
+	}
+
+	store, err := coliprov.NewPersistentStore(backend, a.Retention, a.StoreSaveInterval)
+	if err != nil {
+		klog.Fatalf("unable to load stored metrics: %v", err)
+	}
+	return store
 }
 
-func (a *ColibriAdapter) makeProviderOrDie() (provider.CustomMetricsProvider, *restful.WebService) {
+func (a *ColibriAdapter) makeProviderOrDie() (provider.MetricsProvider, *restful.WebService, *genericapiserver.APIGroupInfo) {
 	client, err := a.DynamicClient()
 	if err != nil {
 		klog.Fatalf("unable to construct dynamic client: %v", err)
@@ -56,7 +212,45 @@ func (a *ColibriAdapter) makeProviderOrDie() (provider.CustomMetricsProvider, *r
 		klog.Fatalf("unable to construct discovery REST mapper: %v", err)
 	}
 
-	return coliprov.NewProvider(client, mapper)
+	// pods and their workloads are looked up for every result, admission review and scrape
+	informers := dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+	opts := coliprov.Options{
+		Informers:      informers,
+		Store:          a.makeStoreOrDie(client),
+		Runner:         a.makeRunnerOrDie(client),
+		Validation:     a.Validation,
+		JobPolicy:      a.JobPolicy,
+		MetricNaming:   a.MetricNaming,
+		Recommendation: a.Recommendation,
+		Auth:           a.makeRequestAuthOrDie(),
+	}
+	if a.ResultAnnotations {
+		opts.Sink = coliprov.NewAnnotationSink(client)
+	}
+	provider, ws, apiGroup := coliprov.NewProvider(client, mapper, opts)
+	informers.Start(wait.NeverStop)
+	for res, synced := range informers.WaitForCacheSync(wait.NeverStop) {
+		if !synced {
+			klog.Fatalf("unable to sync cache of %s", res)
+		}
+	}
+	return provider, ws, apiGroup
+}
+
+func (a *ColibriAdapter) runAdmissionWebhookOrDie(provider provider.CustomMetricsProvider) {
+	if a.AdmissionCertFile == "" || a.AdmissionKeyFile == "" {
+		klog.Fatalf("--admission-cert-file and --admission-key-file are required by the admission webhook")
+	}
+	webhook, err := coliprov.NewAdmissionWebhook(provider, a.Admission)
+	if err != nil {
+		klog.Fatalf("unable to construct admission webhook: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/mutate-pods", webhook)
+	go func() {
+		klog.Fatal(http.ListenAndServeTLS(":"+strconv.Itoa(a.AdmissionPort), a.AdmissionCertFile, a.AdmissionKeyFile, mux))
+	}()
 }
 
 func main() {
@@ -65,26 +259,101 @@ func main() {
 	defer logs.FlushLogs()
 	klog.InitFlags(nil)
 
-	cmd := &ColibriAdapter{}
+	cmd := &ColibriAdapter{
+		Validation:     coliprov.DefaultValidation,
+		MetricNaming:   coliprov.DefaultMetricNaming,
+		JobCleanup:     coliprov.DefaultJobCleanup,
+		JobPolicy:      coliprov.DefaultJobPolicy,
+		Recommendation: coliprov.DefaultRecommendationPolicy,
+		Admission:      coliprov.DefaultAdmissionPolicy,
+	}
 
 	cmd.OpenAPIConfig = genericapiserver.DefaultOpenAPIConfig(generatedopenapi.GetOpenAPIDefinitions, openapinamer.NewDefinitionNamer(apiserver.Scheme))
 	cmd.OpenAPIConfig.Info.Title = "colibri-apiserver"
 	cmd.OpenAPIConfig.Info.Version = "1.0.0"
 
 	cmd.Flags().StringVar(&cmd.Message, "msg", "starting adapter...", "startup message")
+	cmd.Flags().StringVar(&cmd.StoreType, "store", "memory", "backend persisting job parameters and results: memory, file, configmap or secret")
+	cmd.Flags().StringVar(&cmd.StorePath, "store-path", "/tmp/colibri/metrics.json", "file used by the file store")
+	cmd.Flags().StringVar(&cmd.StoreNamespace, "store-namespace", "colibri", "namespace of the ConfigMap/Secret used by the configmap/secret store")
+	cmd.Flags().StringVar(&cmd.StoreName, "store-name", "colibri-apiserver-store", "name of the ConfigMap/Secret used by the configmap/secret store")
+	cmd.Flags().DurationVar(&cmd.StoreSaveInterval, "store-save-interval", 5*time.Second, "least interval between saves of the file/configmap/secret store, the changes within it are saved together (0 saves every change)")
+	cmd.Flags().DurationVar(&cmd.Retention, "retention", 7*24*time.Hour, "how long the stored samples are kept, the latest sample of a metric is always kept (0 means forever)")
+	cmd.Flags().StringVar(&cmd.JobTemplate, "job-template", "", "file of the Go template rendering the K8s Job running colibri")
+	cmd.Flags().StringVar(&cmd.JobTemplateConfigMap, "job-template-configmap", "", "ConfigMap (namespace/name) of the Go template rendering the K8s Job running colibri")
+	cmd.Flags().StringVar(&cmd.JobTemplateKey, "job-template-key", "job.yaml", "key of the job template in the ConfigMap")
+	cmd.Flags().DurationVar(&cmd.JobTemplateReload, "job-template-reload", time.Minute, "interval to reload the job template (0 disables reloading)")
+	cmd.Flags().StringVar(&cmd.JobImage, "job-image", coliprov.DefaultJobImage, "image of colibri, given to the job template as .Image")
+	cmd.Flags().StringVar(&cmd.JobImagePullPolicy, "job-image-pull-policy", string(coliprov.DefaultJobImagePullPolicy), "pull policy of the image of colibri (Always, IfNotPresent or Never), given to the job template as .ImagePullPolicy")
+	cmd.Flags().StringVar(&cmd.JobRunner, "job-runner", "kubernetes", "how colibri is run: kubernetes (as K8s Jobs) or local (as processes of this host)")
+	cmd.Flags().IntVar(&cmd.JobCleanup.TTLSecondsAfterFinished, "job-ttl-after-finished", cmd.JobCleanup.TTLSecondsAfterFinished, "seconds finished K8s Jobs are kept before deleted with their pods, unless set by the job template (negative keeps them)")
+	cmd.Flags().StringVar(&cmd.LocalBinary, "local-binary", "colibri", "colibri-compatible binary run by the local job runner")
+	cmd.Flags().StringVar(&cmd.LocalAPIURL, "local-api-url", "http://localhost:8080/colibri", "URL the local job runner tells colibri to put results to")
+	cmd.Flags().IntVar(&cmd.Validation.MinFrequency, "min-freq", cmd.Validation.MinFrequency, "minimum query interval (millisecond) of a job")
+	cmd.Flags().IntVar(&cmd.Validation.MaxFrequency, "max-freq", cmd.Validation.MaxFrequency, "maximum query interval (millisecond) of a job")
+	cmd.Flags().IntVar(&cmd.Validation.MaxIteration, "max-iter", cmd.Validation.MaxIteration, "maximum query iterations of a job")
+	cmd.Flags().IntSliceVar(&cmd.Validation.Percentiles, "allowed-percentiles", cmd.Validation.Percentiles, "percentiles allowed for a job, any of 1-100 if empty")
+	cmd.Flags().IntVar(&cmd.Validation.MaxTimeout, "max-timeout", cmd.Validation.MaxTimeout, "maximum timeout (second) requested for a job")
+	cmd.Flags().IntVar(&cmd.JobPolicy.Retries, "job-retries", cmd.JobPolicy.Retries, "how many times colibri is run again after it failed, the backoffLimit of K8s Jobs")
+	cmd.Flags().Float64Var(&cmd.JobPolicy.TimeoutFactor, "job-timeout-factor", cmd.JobPolicy.TimeoutFactor, "scale of the expected duration of all tries (freq*iter milliseconds each) into the default timeout of a job")
+	cmd.Flags().DurationVar(&cmd.JobPolicy.TimeoutSlack, "job-timeout-slack", cmd.JobPolicy.TimeoutSlack, "added to the default timeout of a job, for scheduling and pulling images")
+	cmd.Flags().BoolVar(&cmd.MetricNaming.Aliases, "metric-aliases", cmd.MetricNaming.Aliases, "also serve results by the legacy metric names <processId>-cpu, <processId>-ram, <processId>-ig and <processId>-eg")
+	cmd.Flags().Float64Var(&cmd.Recommendation.RequestHeadroom, "recommend-request-headroom", cmd.Recommendation.RequestHeadroom, "fraction added to the highest result of a container for its recommended requests")
+	cmd.Flags().Float64Var(&cmd.Recommendation.LimitHeadroom, "recommend-limit-headroom", cmd.Recommendation.LimitHeadroom, "fraction added to the highest result of a container for its recommended limits")
+	cmd.Flags().Int64Var(&cmd.Recommendation.CPUStep, "recommend-cpu-step", cmd.Recommendation.CPUStep, "millicores recommended cpu is rounded up to multiples of")
+	cmd.Flags().Int64Var(&cmd.Recommendation.MemoryStep, "recommend-memory-step", cmd.Recommendation.MemoryStep, "bytes recommended memory is rounded up to multiples of")
+	cmd.Flags().DurationVar(&cmd.Recommendation.MaxAge, "recommend-max-age", cmd.Recommendation.MaxAge, "results older than it are not used for recommendations (0 uses all retained results)")
+	cmd.Flags().BoolVar(&cmd.ResultAnnotations, "result-annotations", false, "write the latest results as annotations of their pods (colibri.io/result-<processId>) and workloads (colibri.io/latest-result)")
+	cmd.Flags().BoolVar(&cmd.RESTAuth, "rest-auth", true, "authenticate (TokenReview) and authorize (SubjectAccessReview) requests to the colibri REST API")
+	cmd.Flags().IntVar(&cmd.RESTPort, "rest-port", 8080, "plain HTTP port of the colibri REST API (0 disables it, the colibri API group is always served on the secure port)")
+	cmd.Flags().BoolVar(&cmd.ProfilingJobController, "profilingjob-controller", false, "run colibri for the ProfilingJobs (profiling.colibri.io) by a controller, the CustomResourceDefinition must be installed")
+	cmd.Flags().IntVar(&cmd.AdmissionPort, "admission-port", 0, "HTTPS port of the mutating admission webhook setting the resources of new pods of profiled workloads (0 disables it)")
+	cmd.Flags().StringVar(&cmd.AdmissionCertFile, "admission-cert-file", "", "serving certificate of the admission webhook")
+	cmd.Flags().StringVar(&cmd.AdmissionKeyFile, "admission-key-file", "", "private key of the serving certificate of the admission webhook")
+	cmd.Flags().StringVar(&cmd.Admission.NamespacePolicy, "admission-namespace-policy", cmd.Admission.NamespacePolicy, "policy of the admission webhook for namespaces without the colibri.io/inject-resources-policy annotation: disabled, opt-in or enabled")
+	cmd.Flags().BoolVar(&cmd.Admission.Limits, "admission-set-limits", cmd.Admission.Limits, "also set the limits of containers by the admission webhook, otherwise the requests only")
 	cmd.Flags().AddGoFlagSet(flag.CommandLine) // make sure we get the klog flags
 	cmd.Flags().Parse(os.Args)
 
-	provider, ws := cmd.makeProviderOrDie()
+	provider, ws, apiGroup := cmd.makeProviderOrDie()
 	cmd.WithCustomMetrics(provider)
+	cmd.WithExternalMetrics(provider)
+
+	// serve jobs and results as the colibri API group on the secure port
+	server, err := cmd.Server()
+	if err != nil {
+		klog.Fatalf("unable to construct custom metrics adapter: %v", err)
+	}
+	if err := server.GenericAPIServer.InstallAPIGroup(apiGroup); err != nil {
+		klog.Fatalf("unable to install colibri API group: %v", err)
+	}
+	// export the results to Prometheus on the secure port, authorized like /metrics
+	metrics, err := coliprov.NewMetricsHandler(provider)
+	if err != nil {
+		klog.Fatalf("unable to construct metrics handler: %v", err)
+	}
+	server.GenericAPIServer.Handler.NonGoRestfulMux.Handle(coliprov.MetricsPath, metrics)
+
+	if cmd.ProfilingJobController {
+		controller, err := coliprov.NewProfilingJobController(provider, 10*time.Minute)
+		if err != nil {
+			klog.Fatalf("unable to construct ProfilingJob controller: %v", err)
+		}
+		go controller.Run(1, wait.NeverStop)
+	}
+	if cmd.AdmissionPort > 0 {
+		cmd.runAdmissionWebhookOrDie(provider)
+	}
 
 	klog.Infof(cmd.Message)
-	// Set up POST endpoint for writing fake metric values
-	restful.DefaultContainer.Add(ws)
-	go func() {
-		// Open port for POSTing fake metrics
-		klog.Fatal(http.ListenAndServe(":8080", nil))
-	}()
+	if cmd.RESTPort > 0 {
+		// Set up POST endpoint for writing fake metric values
+		restful.DefaultContainer.Add(ws)
+		go func() {
+			// Open port for POSTing fake metrics
+			klog.Fatal(http.ListenAndServe(":"+strconv.Itoa(cmd.RESTPort), nil))
+		}()
+	}
 	if err := cmd.Run(wait.NeverStop); err != nil {
 		klog.Fatalf("unable to run custom metrics adapter: %v", err)
 	}
@@ -0,0 +1,244 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// injectResourcesAnnotation opts a pod in ("true") or out ("false") of having its resources set by the admission webhook
+const injectResourcesAnnotation = "colibri.io/inject-resources"
+
+// injectResourcesPolicyAnnotation sets the policy of the admission webhook for the pods of a namespace
+const injectResourcesPolicyAnnotation = "colibri.io/inject-resources-policy"
+
+// policies of the admission webhook for the pods of a namespace
+const (
+	// InjectDisabled never sets the resources of pods, even if they opt in
+	InjectDisabled = "disabled"
+	// InjectOptIn sets the resources of the pods opting in only
+	InjectOptIn = "opt-in"
+	// InjectEnabled sets the resources of all pods, except those opting out
+	InjectEnabled = "enabled"
+)
+
+// the user recorded in appliedRecommendationAnnotation of the pods whose resources are set by the admission webhook
+const admissionWebhookUser = "colibri-admission-webhook"
+
+// AdmissionPolicy decides which pods have their resources set by the admission webhook
+type AdmissionPolicy struct {
+	// NamespacePolicy is the policy of the namespaces without injectResourcesPolicyAnnotation:
+	// InjectDisabled, InjectOptIn or InjectEnabled
+	NamespacePolicy string
+	// Limits also sets the limits of containers, otherwise the requests only, capped by the limits of containers
+	Limits bool
+}
+
+// DefaultAdmissionPolicy sets the requests and the limits of the pods opting in
+var DefaultAdmissionPolicy = AdmissionPolicy{
+	NamespacePolicy: InjectOptIn,
+	Limits:          true,
+}
+
+// AdmissionWebhook is the mutating admission webhook setting the resources of the containers of new pods
+// to the recommendation of their workloads. It fails open: pods are always admitted, unchanged if
+// their workloads have no results or the recommendation cannot be made.
+type AdmissionWebhook struct {
+	p      *colibriProvider
+	policy AdmissionPolicy
+}
+
+// NewAdmissionWebhook returns the admission webhook recommending by p, which is returned by NewProvider
+func NewAdmissionWebhook(p provider.CustomMetricsProvider, policy AdmissionPolicy) (*AdmissionWebhook, error) {
+	cp, ok := p.(*colibriProvider)
+	if !ok {
+		return nil, fmt.Errorf("resources can only be recommended by the colibri provider, got %T", p)
+	}
+	switch policy.NamespacePolicy {
+	case InjectDisabled, InjectOptIn, InjectEnabled:
+	default:
+		return nil, fmt.Errorf("unknown namespace policy %q, expected %s, %s or %s", policy.NamespacePolicy, InjectDisabled, InjectOptIn, InjectEnabled)
+	}
+	return &AdmissionWebhook{p: cp, policy: policy}, nil
+}
+
+// ServeHTTP reviews an AdmissionReview of admission.k8s.io/v1
+func (w *AdmissionWebhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	review := admissionv1.AdmissionReview{}
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(rw, fmt.Sprintf("malformed AdmissionReview: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	review.Response = w.review(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(review); err != nil {
+		klog.Errorf("Failed to write AdmissionReview: %v", err)
+	}
+}
+
+// review admits a pod, with the patch setting its resources if its workload is profiled and the policy allows
+func (w *AdmissionWebhook) review(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	allowed := &admissionv1.AdmissionResponse{Allowed: true}
+	if req.Kind.Kind != "Pod" || req.Operation != admissionv1.Create || req.SubResource != "" {
+		return allowed
+	}
+
+	pod := &unstructured.Unstructured{}
+	if err := pod.UnmarshalJSON(req.Object.Raw); err != nil {
+		klog.Errorf("Failed to decode pod in %s: %v", req.Namespace, err)
+		return allowed
+	}
+	// the namespace and the name are not set for pods created by controllers
+	pod.SetNamespace(req.Namespace)
+	if pod.GetName() == "" {
+		pod.SetName(pod.GetGenerateName())
+	}
+
+	inject, err := w.injects(pod)
+	if err != nil {
+		klog.Errorf("Failed to get the policy of namespace %s, pod %s is admitted unchanged: %v", req.Namespace, pod.GetName(), err)
+		allowed.Warnings = []string{"colibri: resources are not set, " + err.Error()}
+		return allowed
+	}
+	if !inject {
+		return allowed
+	}
+
+	patch, err := w.patch(pod)
+	if apierr.IsNotFound(err) {
+		klog.V(4).Infof("No profile for pod %s/%s, admitted unchanged", req.Namespace, pod.GetName())
+		return allowed
+	}
+	if err != nil {
+		klog.Errorf("Failed to recommend resources for pod %s/%s, admitted unchanged: %v", req.Namespace, pod.GetName(), err)
+		allowed.Warnings = []string{"colibri: resources are not set, " + err.Error()}
+		return allowed
+	}
+	if patch != nil {
+		patchType := admissionv1.PatchTypeJSONPatch
+		allowed.Patch = patch
+		allowed.PatchType = &patchType
+	}
+	return allowed
+}
+
+// injects tells whether the resources of a pod are set, by its annotation and the policy of its namespace
+func (w *AdmissionWebhook) injects(pod *unstructured.Unstructured) (bool, error) {
+	nsResource := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "namespaces"}
+	ns, err := w.p.objects.get(nsResource, "", pod.GetNamespace())
+	if err != nil {
+		return false, err
+	}
+	policy := w.policy.NamespacePolicy
+	if value, found := ns.GetAnnotations()[injectResourcesPolicyAnnotation]; found {
+		policy = value
+	}
+
+	switch optIn := pod.GetAnnotations()[injectResourcesAnnotation]; policy {
+	case InjectOptIn:
+		return optIn == "true", nil
+	case InjectEnabled:
+		return optIn != "false", nil
+	case InjectDisabled:
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown policy %q of namespace %s", policy, pod.GetNamespace())
+}
+
+// patch returns the JSON patch setting the resources of the containers of a pod to the recommendation of its workload,
+// nil if they are already set. It is recorded on the pod by appliedRecommendationAnnotation.
+// The workload is recommended from its kept results, only its parents are read, from the cache.
+func (w *AdmissionWebhook) patch(pod *unstructured.Unstructured) ([]byte, error) {
+	ref, err := w.p.workloadOf(pod)
+	if err != nil {
+		return nil, err
+	}
+	// a pod of no workload has no results before it is created
+	if ref.groupKind() == (schema.GroupKind{Kind: "Pod"}) {
+		return nil, nil
+	}
+	res, err := w.p.resourceOf(ref)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := w.p.recommendFor(pod.GetNamespace(), ref, res.GroupResource(), templateContainers(pod))
+	if err != nil {
+		return nil, err
+	}
+
+	path, containers := containersPath(pod)
+	if !w.policy.Limits {
+		capRequests(containers, rec)
+	}
+	patched, changes := containerPatches(containers, rec)
+	if len(patched) == 0 {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(appliedRecommendation{AppliedBy: admissionWebhookUser, AppliedAt: time.Now(), Changes: changes})
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("Set resources of pod %s/%s of %s %s: %s", pod.GetNamespace(), pod.GetName(), ref.Kind, ref.Name, data)
+	return jsonPatch(pod, path, containers, patched, string(data))
+}
+
+// capRequests drops the recommended limits, and caps the recommended requests by the limits of containers,
+// as requests above limits are rejected
+func capRequests(containers []interface{}, rec recommendation) {
+	limits := make(map[string]map[string]interface{}, len(containers))
+	for _, c := range containers {
+		container, _ := c.(map[string]interface{})
+		name, _ := container["name"].(string)
+		limits[name], _, _ = unstructured.NestedMap(container, "resources", "limits")
+	}
+
+	for i := range rec.Containers {
+		c := &rec.Containers[i]
+		c.Limits = nil
+		requests := corev1.ResourceList{}
+		for resourceName, request := range c.Requests {
+			if value, found := limits[c.Name][string(resourceName)]; found {
+				if limit, err := resource.ParseQuantity(fmt.Sprint(value)); err == nil && limit.Cmp(request) < 0 {
+					request = limit
+				}
+			}
+			requests[resourceName] = request
+		}
+		c.Requests = requests
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+)
+
+// newAdmissionTestProvider returns a provider reading from informers, with the namespaces default (no policy),
+// enabled and disabled (by their annotations), and the ReplicaSets web-1 of the Deployment web and db-1 of the Deployment db
+// in each of them. The container server of web is kept at 430m cpu and 64Mi memory, db has no results.
+func newAdmissionTestProvider(t *testing.T) *colibriProvider {
+	objects := []runtime.Object{}
+	for _, ns := range []string{"default", InjectEnabled, InjectDisabled} {
+		namespace := newTestObject("v1", "Namespace", "", ns, nil)
+		if ns != "default" {
+			namespace.SetAnnotations(map[string]string{injectResourcesPolicyAnnotation: ns})
+		}
+		objects = append(objects, namespace)
+		for _, workload := range []string{"web", "db"} {
+			rs := newTestObject("apps/v1", "ReplicaSet", ns, workload+"-1", nil)
+			rs.SetOwnerReferences([]metav1.OwnerReference{ownerOf("apps/v1", "Deployment", workload)})
+			objects = append(objects, rs)
+		}
+	}
+	client := newTestClient(objects...)
+	opts := DefaultOptions()
+	opts.Informers = dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+	p := newTestProvider(client, opts)
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	opts.Informers.Start(stopCh)
+	for res, synced := range opts.Informers.WaitForCacheSync(stopCh) {
+		if !synced {
+			t.Fatalf("cache of %s is not synced", res)
+		}
+	}
+
+	web := workloadRef{APIVersion: "apps/v1", Kind: "Deployment", Name: "web"}
+	for _, ns := range []string{"default", InjectEnabled, InjectDisabled} {
+		record := jobRecord{Namespace: ns, Pod: "web-1-a", Container: "server", Params: jobParam{Percentile: 99}}
+		p.putContainerResult(record, web, &jobResult{Cpu: "430m", Ram: "64Mi"}, time.Now())
+	}
+	return p
+}
+
+func ownerOf(apiVersion string, kind string, name string) metav1.OwnerReference {
+	controller := true
+	return metav1.OwnerReference{APIVersion: apiVersion, Kind: kind, Name: name, UID: types.UID(name), Controller: &controller}
+}
+
+// newAdmissionTestPod returns a pod of a ReplicaSet, with the container server limited to cpu
+func newAdmissionTestPod(rs string, inject string, cpuLimit string) *unstructured.Unstructured {
+	server := map[string]interface{}{"name": "server", "image": "server"}
+	if cpuLimit != "" {
+		server["resources"] = map[string]interface{}{"limits": map[string]interface{}{"cpu": cpuLimit}}
+	}
+	pod := newTestObject("v1", "Pod", "", "", map[string]interface{}{
+		"containers": []interface{}{server, map[string]interface{}{"name": "sidecar", "image": "sidecar"}},
+	})
+	pod.SetGenerateName(rs + "-")
+	if rs != "" {
+		pod.SetOwnerReferences([]metav1.OwnerReference{ownerOf("apps/v1", "ReplicaSet", rs)})
+	}
+	if inject != "" {
+		pod.SetAnnotations(map[string]string{injectResourcesAnnotation: inject})
+	}
+	return pod
+}
+
+func TestAdmissionWebhook(t *testing.T) {
+	recommended := map[string]interface{}{
+		"requests": map[string]interface{}{"cpu": "500m", "memory": "74Mi"},
+		"limits":   map[string]interface{}{"cpu": "650m", "memory": "96Mi"},
+	}
+	tests := []struct {
+		name      string
+		policy    AdmissionPolicy
+		namespace string
+		operation admissionv1.Operation
+		pod       *unstructured.Unstructured
+		// resources is what the container server is patched to, nil if the pod is not patched
+		resources map[string]interface{}
+	}{
+		{name: "opted in", policy: DefaultAdmissionPolicy, namespace: "default", operation: admissionv1.Create,
+			pod: newAdmissionTestPod("web-1", "true", ""), resources: recommended},
+		{name: "not opted in", policy: DefaultAdmissionPolicy, namespace: "default", operation: admissionv1.Create,
+			pod: newAdmissionTestPod("web-1", "", "")},
+		{name: "enabled by the policy flag", policy: AdmissionPolicy{NamespacePolicy: InjectEnabled, Limits: true}, namespace: "default", operation: admissionv1.Create,
+			pod: newAdmissionTestPod("web-1", "", ""), resources: recommended},
+		{name: "enabled namespace", policy: DefaultAdmissionPolicy, namespace: InjectEnabled, operation: admissionv1.Create,
+			pod: newAdmissionTestPod("web-1", "", ""), resources: recommended},
+		{name: "opted out of enabled namespace", policy: DefaultAdmissionPolicy, namespace: InjectEnabled, operation: admissionv1.Create,
+			pod: newAdmissionTestPod("web-1", "false", "")},
+		{name: "disabled namespace", policy: DefaultAdmissionPolicy, namespace: InjectDisabled, operation: admissionv1.Create,
+			pod: newAdmissionTestPod("web-1", "true", "")},
+		{name: "requests capped by limits", policy: AdmissionPolicy{NamespacePolicy: InjectOptIn}, namespace: "default", operation: admissionv1.Create,
+			pod: newAdmissionTestPod("web-1", "true", "400m"), resources: map[string]interface{}{
+				"requests": map[string]interface{}{"cpu": "400m", "memory": "74Mi"},
+				"limits":   map[string]interface{}{"cpu": "400m"},
+			}},
+		{name: "workload without results", policy: DefaultAdmissionPolicy, namespace: "default", operation: admissionv1.Create,
+			pod: newAdmissionTestPod("db-1", "true", "")},
+		{name: "pod of no workload", policy: DefaultAdmissionPolicy, namespace: "default", operation: admissionv1.Create,
+			pod: newAdmissionTestPod("", "true", "")},
+		{name: "update", policy: DefaultAdmissionPolicy, namespace: "default", operation: admissionv1.Update,
+			pod: newAdmissionTestPod("web-1", "true", "")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webhook, err := NewAdmissionWebhook(newAdmissionTestProvider(t), tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := tt.pod.MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := json.Marshal(admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+				Request: &admissionv1.AdmissionRequest{
+					UID:       "review",
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					Namespace: tt.namespace,
+					Operation: tt.operation,
+					Object:    runtime.RawExtension{Raw: raw},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			webhook.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/mutate-pods", bytes.NewReader(body)))
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+			}
+			review := admissionv1.AdmissionReview{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &review); err != nil {
+				t.Fatal(err)
+			}
+			response := review.Response
+			if response == nil || !response.Allowed || response.UID != "review" || len(response.Warnings) > 0 {
+				t.Fatalf("expected the pod admitted without warnings, got %+v", response)
+			}
+
+			if tt.resources == nil {
+				if response.Patch != nil {
+					t.Errorf("expected no patch, got %s", response.Patch)
+				}
+				return
+			}
+			if response.PatchType == nil || *response.PatchType != admissionv1.PatchTypeJSONPatch {
+				t.Fatalf("expected a JSON patch, got %v", response.PatchType)
+			}
+			patch, err := jsonpatch.DecodePatch(response.Patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			patched, err := patch.Apply(raw)
+			if err != nil {
+				t.Fatalf("failed to apply %s: %v", response.Patch, err)
+			}
+			pod := &unstructured.Unstructured{}
+			if err := pod.UnmarshalJSON(patched); err != nil {
+				t.Fatal(err)
+			}
+			_, containers := containersPath(pod)
+			server, _ := containers[0].(map[string]interface{})
+			if got := server["resources"]; !reflect.DeepEqual(got, tt.resources) {
+				t.Errorf("expected resources %v, got %v", tt.resources, got)
+			}
+			if sidecar, _ := containers[1].(map[string]interface{}); sidecar["resources"] != nil {
+				t.Errorf("expected the sidecar unchanged, got %v", sidecar)
+			}
+			if _, found := pod.GetAnnotations()[appliedRecommendationAnnotation]; !found {
+				t.Errorf("expected %s on the pod, got %v", appliedRecommendationAnnotation, pod.GetAnnotations())
+			}
+		})
+	}
+}
+
+func TestNewAdmissionWebhookPolicy(t *testing.T) {
+	p := newAdmissionTestProvider(t)
+	if _, err := NewAdmissionWebhook(p, AdmissionPolicy{NamespacePolicy: "always"}); err == nil {
+		t.Errorf("expected an unknown namespace policy to be rejected")
+	}
+	if _, err := NewAdmissionWebhook(p, AdmissionPolicy{NamespacePolicy: InjectEnabled}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,525 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/duration"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/registry/rest"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/apiserver/pkg/storage/names"
+	"k8s.io/apiserver/pkg/util/dryrun"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/apiserver"
+
+	colibriv1alpha1 "colibri-apiserver/adapter/apis/colibri/v1alpha1"
+)
+
+func init() {
+	// the colibri API group is served by the same server as custom metrics
+	utilruntime.Must(colibriv1alpha1.Install(apiserver.Scheme))
+}
+
+// apiGroupInfo serves jobs and results as the resources of ColibriGroup,
+// to be installed to the secure port of the adapter
+func (p *colibriProvider) apiGroupInfo() *genericapiserver.APIGroupInfo {
+	info := genericapiserver.NewDefaultAPIGroupInfo(ColibriGroup, apiserver.Scheme, metav1.ParameterCodec, apiserver.Codecs)
+	info.VersionedResourcesStorageMap[colibriv1alpha1.SchemeGroupVersion.Version] = map[string]rest.Storage{
+		profilingJobsResource:  &profilingJobStorage{p: p},
+		profileResultsResource: &profileResultStorage{p: p},
+	}
+	return &info
+}
+
+// profilingJobStorage serves the records of jobs as ProfilingJobs
+type profilingJobStorage struct {
+	p *colibriProvider
+}
+
+var _ rest.Getter = &profilingJobStorage{}
+var _ rest.Lister = &profilingJobStorage{}
+var _ rest.Creater = &profilingJobStorage{}
+var _ rest.GracefulDeleter = &profilingJobStorage{}
+var _ rest.Scoper = &profilingJobStorage{}
+
+func (s *profilingJobStorage) New() runtime.Object {
+	return &colibriv1alpha1.ProfilingJob{}
+}
+
+func (s *profilingJobStorage) NewList() runtime.Object {
+	return &colibriv1alpha1.ProfilingJobList{}
+}
+
+func (s *profilingJobStorage) NamespaceScoped() bool {
+	return true
+}
+
+func (s *profilingJobStorage) Get(ctx context.Context, name string, options *metav1.GetOptions) (runtime.Object, error) {
+	record, found := s.p.jobs.get(name)
+	if !found || record.Namespace != genericapirequest.NamespaceValue(ctx) {
+		return nil, apierr.NewNotFound(colibriv1alpha1.Resource(profilingJobsResource), name)
+	}
+	return profilingJobFor(record), nil
+}
+
+func (s *profilingJobStorage) List(ctx context.Context, options *metainternalversion.ListOptions) (runtime.Object, error) {
+	// empty namespace lists jobs of all namespaces
+	ns := genericapirequest.NamespaceValue(ctx)
+	records := s.p.jobs.list(func(r *jobRecord) bool {
+		return ns == "" || r.Namespace == ns
+	})
+
+	list := &colibriv1alpha1.ProfilingJobList{Items: make([]colibriv1alpha1.ProfilingJob, 0, len(records))}
+	for _, record := range records {
+		job := profilingJobFor(record)
+		if !matchesLabels(options, job.Labels) {
+			continue
+		}
+		list.Items = append(list.Items, *job)
+	}
+	return list, nil
+}
+
+// Create runs colibri for a ProfilingJob, the same as POST /colibri/{namespace}/{pod}/{process},
+// or POST /colibri/{namespace}/{pod}/container if the process is targeted by its container.
+// The name of job is given by metadata.name or metadata.generateName, or a UUID if both are empty.
+// In dry run, the job is checked and returned without being started.
+func (s *profilingJobStorage) Create(ctx context.Context, obj runtime.Object, createValidation rest.ValidateObjectFunc, options *metav1.CreateOptions) (runtime.Object, error) {
+	job, ok := obj.(*colibriv1alpha1.ProfilingJob)
+	if !ok {
+		return nil, apierr.NewBadRequest(fmt.Sprintf("not a ProfilingJob: %T", obj))
+	}
+	if createValidation != nil {
+		if err := createValidation(ctx, obj); err != nil {
+			return nil, err
+		}
+	}
+
+	ns := genericapirequest.NamespaceValue(ctx)
+	id := job.Name
+	switch {
+	case id == "" && job.GenerateName != "":
+		id = names.SimpleNameGenerator.GenerateName(job.GenerateName)
+	case id == "":
+		id = string(uuid.NewUUID())
+	}
+
+	params := paramsOrDefaults(job.Spec.Frequency, job.Spec.Iteration, job.Spec.Percentile)
+
+	// the name of job labels its K8s Job, so it is a DNS label
+	errs := field.ErrorList{}
+	for _, msg := range validation.IsDNS1123Label(id) {
+		errs = append(errs, field.Invalid(field.NewPath("metadata", "name"), id, msg))
+	}
+	specPath := field.NewPath("spec")
+	if job.Spec.Pod == "" {
+		errs = append(errs, field.Required(specPath.Child("pod"), ""))
+	}
+	switch {
+	case job.Spec.Process != "" && job.Spec.Container != "":
+		errs = append(errs, field.Forbidden(specPath.Child("container"), "a process is targeted by either its ID or its container"))
+	case job.Spec.Container != "":
+		errs = append(errs, validateContainerTarget(job.Spec.Container, job.Spec.Command, specPath)...)
+	case job.Spec.Process == "":
+		errs = append(errs, field.Required(specPath.Child("process"), "or spec.container"))
+	}
+	errs = append(errs, s.p.validation.validateParam(params, specPath)...)
+	if len(errs) > 0 {
+		return nil, apierr.NewInvalid(colibriv1alpha1.SchemeGroupVersion.WithKind("ProfilingJob").GroupKind(), id, errs)
+	}
+
+	pod, err := s.p.checkPod(ns, job.Spec.Pod)
+	if apierr.IsNotFound(err) {
+		return nil, apierr.NewInvalid(colibriv1alpha1.SchemeGroupVersion.WithKind("ProfilingJob").GroupKind(), id,
+			field.ErrorList{field.NotFound(specPath.Child("pod"), job.Spec.Pod)})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	target := jobTarget{Process: job.Spec.Process}
+	if job.Spec.Container != "" {
+		containerID, err := checkContainer(pod, job.Spec.Container)
+		if apierr.IsInvalid(err) {
+			return nil, apierr.NewInvalid(colibriv1alpha1.SchemeGroupVersion.WithKind("ProfilingJob").GroupKind(), id,
+				field.ErrorList{field.NotFound(specPath.Child("container"), job.Spec.Container)})
+		}
+		if err != nil {
+			return nil, err
+		}
+		target = jobTarget{Container: job.Spec.Container, ContainerID: containerID, Command: job.Spec.Command}
+	}
+
+	if dryrun.IsDryRun(options.DryRun) {
+		if _, found := s.p.jobs.get(id); found {
+			return nil, apierr.NewAlreadyExists(colibriv1alpha1.Resource(profilingJobsResource), id)
+		}
+		if _, err := s.p.checkPlacement(pod); err != nil {
+			return nil, err
+		}
+		container := target.Container
+		if container == "" {
+			container = onlyContainer(pod)
+		}
+		return profilingJobFor(jobRecord{
+			ID:        id,
+			Namespace: ns,
+			Pod:       job.Spec.Pod,
+			Process:   target.Process,
+			Container: container,
+			Command:   target.Command,
+			Params:    *params,
+			State:     JobPending,
+			CreatedAt: time.Now(),
+		}), nil
+	}
+
+	if target.Container != "" {
+		klog.Infof("Run Colibri for: " + ns + "." + job.Spec.Pod + " in container " + target.Container)
+	} else {
+		klog.Infof("Run Colibri for: " + ns + "." + job.Spec.Pod + "." + job.Spec.Process)
+	}
+	record, err := s.p.startJob(pod, ns, job.Spec.Pod, target, params, id)
+	if err != nil {
+		if apierr.IsAlreadyExists(err) {
+			return nil, apierr.NewAlreadyExists(colibriv1alpha1.Resource(profilingJobsResource), id)
+		}
+		return nil, err
+	}
+	return profilingJobFor(record), nil
+}
+
+// Delete cancels a job if it is not finished yet, and removes its record
+func (s *profilingJobStorage) Delete(ctx context.Context, name string, deleteValidation rest.ValidateObjectFunc, options *metav1.DeleteOptions) (runtime.Object, bool, error) {
+	obj, err := s.Get(ctx, name, &metav1.GetOptions{})
+	if err != nil {
+		return nil, false, err
+	}
+	if deleteValidation != nil {
+		if err := deleteValidation(ctx, obj); err != nil {
+			return nil, false, err
+		}
+	}
+
+	job := obj.(*colibriv1alpha1.ProfilingJob)
+	if !JobState(job.Status.State).finished() {
+		record, err := s.p.cancelJob(name)
+		if err != nil {
+			return nil, false, err
+		}
+		job = profilingJobFor(record)
+	}
+	s.p.jobs.remove(name)
+
+	return job, true, nil
+}
+
+func (s *profilingJobStorage) ConvertToTable(ctx context.Context, object runtime.Object, tableOptions runtime.Object) (*metav1.Table, error) {
+	table := &metav1.Table{
+		ColumnDefinitions: []metav1.TableColumnDefinition{
+			{Name: "Name", Type: "string", Format: "name", Description: "ID of the job"},
+			{Name: "Pod", Type: "string", Description: "targeted pod"},
+			{Name: "Process", Type: "string", Description: "targeted process ID"},
+			{Name: "State", Type: "string", Description: "state of the job"},
+			{Name: "Age", Type: "string", Description: "time since the job is requested"},
+		},
+	}
+
+	var jobs []colibriv1alpha1.ProfilingJob
+	switch t := object.(type) {
+	case *colibriv1alpha1.ProfilingJob:
+		jobs = []colibriv1alpha1.ProfilingJob{*t}
+	case *colibriv1alpha1.ProfilingJobList:
+		jobs = t.Items
+	default:
+		return nil, fmt.Errorf("unexpected object %T", object)
+	}
+
+	for i := range jobs {
+		job := &jobs[i]
+		table.Rows = append(table.Rows, metav1.TableRow{
+			Cells:  []interface{}{job.Name, job.Spec.Pod, job.Spec.Process, job.Status.State, age(job.CreationTimestamp)},
+			Object: runtime.RawExtension{Object: job},
+		})
+	}
+	return table, nil
+}
+
+func profilingJobFor(record jobRecord) *colibriv1alpha1.ProfilingJob {
+	job := &colibriv1alpha1.ProfilingJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              record.ID,
+			Namespace:         record.Namespace,
+			CreationTimestamp: metav1.NewTime(record.CreatedAt),
+		},
+		Spec: colibriv1alpha1.ProfilingJobSpec{
+			Pod:        record.Pod,
+			Process:    record.Process,
+			Container:  record.Container,
+			Command:    record.Command,
+			Frequency:  record.Params.Frequency,
+			Iteration:  record.Params.Iteration,
+			Percentile: record.Params.Percentile,
+		},
+		Status: colibriv1alpha1.ProfilingJobStatus{
+			State:        string(record.State),
+			Reason:       record.Reason,
+			JobName:      record.JobName,
+			JobNamespace: record.JobNamespace,
+		},
+	}
+	if record.StartedAt != nil {
+		t := metav1.NewTime(*record.StartedAt)
+		job.Status.StartTime = &t
+	}
+	if record.FinishedAt != nil {
+		t := metav1.NewTime(*record.FinishedAt)
+		job.Status.CompletionTime = &t
+	}
+	return job
+}
+
+// profileResultStorage serves the latest results of processes as ProfileResults
+type profileResultStorage struct {
+	p *colibriProvider
+}
+
+var _ rest.Getter = &profileResultStorage{}
+var _ rest.Lister = &profileResultStorage{}
+var _ rest.Creater = &profileResultStorage{}
+var _ rest.Scoper = &profileResultStorage{}
+
+func (s *profileResultStorage) New() runtime.Object {
+	return &colibriv1alpha1.ProfileResult{}
+}
+
+func (s *profileResultStorage) NewList() runtime.Object {
+	return &colibriv1alpha1.ProfileResultList{}
+}
+
+func (s *profileResultStorage) NamespaceScoped() bool {
+	return true
+}
+
+func (s *profileResultStorage) Get(ctx context.Context, name string, options *metav1.GetOptions) (runtime.Object, error) {
+	pname, pid := splitResultName(name)
+	namespacedName := types.NamespacedName{Namespace: genericapirequest.NamespaceValue(ctx), Name: pname}
+	if pname == "" || pid == "" {
+		return nil, apierr.NewNotFound(colibriv1alpha1.Resource(profileResultsResource), name)
+	}
+
+	result, err := s.p.latestResult(namespacedName, pid)
+	if err != nil {
+		return nil, apierr.NewNotFound(colibriv1alpha1.Resource(profileResultsResource), name)
+	}
+	return profileResultFor(namespacedName, pid, result), nil
+}
+
+func (s *profileResultStorage) List(ctx context.Context, options *metainternalversion.ListOptions) (runtime.Object, error) {
+	// empty namespace lists results of all namespaces
+	ns := genericapirequest.NamespaceValue(ctx)
+
+	list := &colibriv1alpha1.ProfileResultList{Items: make([]colibriv1alpha1.ProfileResult, 0)}
+	// results are indexed by the cpu series, as in the history of results
+	for _, info := range s.p.values.ListMetricInfos() {
+		if info.GroupResource.Resource != "pods" || !strings.HasSuffix(info.Metric, "-cpu") {
+			continue
+		}
+		pid := strings.TrimSuffix(info.Metric, "-cpu")
+		for _, namespacedName := range s.p.values.ListNames(info) {
+			if ns != "" && namespacedName.Namespace != ns {
+				continue
+			}
+			result, err := s.p.latestResult(namespacedName, pid)
+			if err != nil {
+				continue
+			}
+			item := profileResultFor(namespacedName, pid, result)
+			if !matchesLabels(options, item.Labels) {
+				continue
+			}
+			list.Items = append(list.Items, *item)
+		}
+	}
+	return list, nil
+}
+
+// Create stores a result put by a colibri job, the same as POST /colibri/{resultId}.
+// The job proves it is launched by the result token in the result.
+func (s *profileResultStorage) Create(ctx context.Context, obj runtime.Object, createValidation rest.ValidateObjectFunc, options *metav1.CreateOptions) (runtime.Object, error) {
+	in, ok := obj.(*colibriv1alpha1.ProfileResult)
+	if !ok {
+		return nil, apierr.NewBadRequest(fmt.Sprintf("not a ProfileResult: %T", obj))
+	}
+	// a result is only put by a running job, consuming its result token
+	if dryrun.IsDryRun(options.DryRun) {
+		return nil, apierr.NewBadRequest("dry run of putting a result is not supported")
+	}
+	if createValidation != nil {
+		if err := createValidation(ctx, obj); err != nil {
+			return nil, err
+		}
+	}
+
+	ns := genericapirequest.NamespaceValue(ctx)
+	pname, pid := in.Pod, in.Process
+	if pname == "" && pid == "" {
+		pname, pid = splitResultName(in.Name)
+	}
+
+	// omitted metrics keep their defaults
+	metrics := new(jobResult)
+	applyDefaults(metrics)
+	for _, f := range []struct {
+		in  string
+		out *string
+	}{
+		{in: in.CPU, out: &metrics.Cpu},
+		{in: in.Memory, out: &metrics.Ram},
+		{in: in.Ingress, out: &metrics.Ingress},
+		{in: in.Egress, out: &metrics.Egress},
+	} {
+		if f.in != "" {
+			*f.out = f.in
+		}
+	}
+
+	errs := field.ErrorList{}
+	if pname == "" {
+		errs = append(errs, field.Required(field.NewPath("pod"), ""))
+	}
+	if pid == "" {
+		errs = append(errs, field.Required(field.NewPath("process"), ""))
+	}
+	if in.Name != "" && in.Name != pname+"."+pid {
+		errs = append(errs, field.Invalid(field.NewPath("metadata", "name"), in.Name, "must be <pod>.<process>"))
+	}
+	errs = append(errs, validateResult(metrics, nil)...)
+	if len(errs) > 0 {
+		return nil, apierr.NewInvalid(colibriv1alpha1.SchemeGroupVersion.WithKind("ProfileResult").GroupKind(), pname+"."+pid, errs)
+	}
+
+	_, err := s.p.checkPod(ns, pname)
+	if apierr.IsNotFound(err) {
+		return nil, apierr.NewInvalid(colibriv1alpha1.SchemeGroupVersion.WithKind("ProfileResult").GroupKind(), pname+"."+pid,
+			field.ErrorList{field.NotFound(field.NewPath("pod"), pname)})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	jobID, err := s.p.storeResult(ns, pname, pid, in.Token, metrics)
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("Put result of job %s for: %s.%s.%s", jobID, ns, pname, pid)
+
+	namespacedName := types.NamespacedName{Namespace: ns, Name: pname}
+	result, err := s.p.latestResult(namespacedName, pid)
+	if err != nil {
+		return nil, err
+	}
+	return profileResultFor(namespacedName, pid, result), nil
+}
+
+func (s *profileResultStorage) ConvertToTable(ctx context.Context, object runtime.Object, tableOptions runtime.Object) (*metav1.Table, error) {
+	table := &metav1.Table{
+		ColumnDefinitions: []metav1.TableColumnDefinition{
+			{Name: "Name", Type: "string", Format: "name", Description: "<pod>.<process> of the result"},
+			{Name: "CPU", Type: "string", Description: "CPU utilization"},
+			{Name: "RAM", Type: "string", Description: "Memory utilization"},
+			{Name: "Ingress", Type: "string", Description: "Ingress traffic bandwidth"},
+			{Name: "Egress", Type: "string", Description: "Egress traffic bandwidth"},
+			{Name: "Age", Type: "string", Description: "time since the result is stored"},
+		},
+	}
+
+	var results []colibriv1alpha1.ProfileResult
+	switch t := object.(type) {
+	case *colibriv1alpha1.ProfileResult:
+		results = []colibriv1alpha1.ProfileResult{*t}
+	case *colibriv1alpha1.ProfileResultList:
+		results = t.Items
+	default:
+		return nil, fmt.Errorf("unexpected object %T", object)
+	}
+
+	for i := range results {
+		result := &results[i]
+		table.Rows = append(table.Rows, metav1.TableRow{
+			Cells:  []interface{}{result.Name, result.CPU, result.Memory, result.Ingress, result.Egress, age(result.Timestamp)},
+			Object: runtime.RawExtension{Object: result},
+		})
+	}
+	return table, nil
+}
+
+func profileResultFor(namespacedName types.NamespacedName, pid string, result jobResultSample) *colibriv1alpha1.ProfileResult {
+	return &colibriv1alpha1.ProfileResult{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              namespacedName.Name + "." + pid,
+			Namespace:         namespacedName.Namespace,
+			CreationTimestamp: metav1.NewTime(result.Timestamp),
+		},
+		Pod:       namespacedName.Name,
+		Process:   pid,
+		CPU:       result.Cpu,
+		Memory:    result.Ram,
+		Ingress:   result.Ingress,
+		Egress:    result.Egress,
+		Timestamp: metav1.NewTime(result.Timestamp),
+	}
+}
+
+// splitResultName splits "<pod>.<process>", pod names may have dots but process IDs don't
+func splitResultName(name string) (string, string) {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return "", ""
+	}
+	return name[:i], name[i+1:]
+}
+
+func matchesLabels(options *metainternalversion.ListOptions, objLabels map[string]string) bool {
+	if options == nil || options.LabelSelector == nil {
+		return true
+	}
+	return options.LabelSelector.Matches(labels.Set(objLabels))
+}
+
+func age(t metav1.Time) string {
+	if t.IsZero() {
+		return "<unknown>"
+	}
+	return duration.HumanDuration(time.Since(t.Time))
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"testing"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+
+	colibriv1alpha1 "colibri-apiserver/adapter/apis/colibri/v1alpha1"
+)
+
+func TestProfilingJobStorageCreate(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    colibriv1alpha1.ProfilingJobSpec
+		dryRun  []string
+		invalid bool
+		exists  bool
+		started bool
+	}{
+		{name: "process", spec: colibriv1alpha1.ProfilingJobSpec{Pod: "web-0", Process: "1"}, started: true},
+		{name: "container", spec: colibriv1alpha1.ProfilingJobSpec{Pod: "web-0", Container: "server", Command: "^nginx"}, started: true},
+		{name: "dry run", spec: colibriv1alpha1.ProfilingJobSpec{Pod: "web-0", Container: "server"}, dryRun: []string{metav1.DryRunAll}},
+		{name: "no target", spec: colibriv1alpha1.ProfilingJobSpec{Pod: "web-0"}, invalid: true},
+		{name: "both targets", spec: colibriv1alpha1.ProfilingJobSpec{Pod: "web-0", Process: "1", Container: "server"}, invalid: true},
+		{name: "unknown container", spec: colibriv1alpha1.ProfilingJobSpec{Pod: "web-0", Container: "sidecar"}, invalid: true},
+		{name: "invalid command", spec: colibriv1alpha1.ProfilingJobSpec{Pod: "web-0", Container: "server", Command: "("}, invalid: true},
+		{name: "unknown pod", spec: colibriv1alpha1.ProfilingJobSpec{Pod: "web-1", Process: "1"}, invalid: true},
+		{name: "invalid parameters", spec: colibriv1alpha1.ProfilingJobSpec{Pod: "web-0", Process: "1", Frequency: -1}, invalid: true},
+		{name: "dry run of an existing job", spec: colibriv1alpha1.ProfilingJobSpec{Pod: "web-0", Process: "1"}, dryRun: []string{metav1.DryRunAll}, exists: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &countingRunner{runs: map[string]int{}}
+			p := newJobTestProvider(t, runner)
+			storage := &profilingJobStorage{p: p}
+			ctx := genericapirequest.WithNamespace(context.TODO(), "default")
+
+			name := "created"
+			if tt.exists {
+				name = "job"
+			}
+			in := &colibriv1alpha1.ProfilingJob{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: tt.spec}
+			obj, err := storage.Create(ctx, in, nil, &metav1.CreateOptions{DryRun: tt.dryRun})
+			switch {
+			case tt.invalid:
+				if !apierr.IsInvalid(err) {
+					t.Fatalf("expected Invalid, got %v", err)
+				}
+			case tt.exists:
+				if !apierr.IsAlreadyExists(err) {
+					t.Fatalf("expected AlreadyExists, got %v", err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			default:
+				job := obj.(*colibriv1alpha1.ProfilingJob)
+				if job.Name != "created" || job.Spec.Pod != "web-0" || job.Spec.Process != tt.spec.Process ||
+					job.Spec.Container != "server" || job.Spec.Command != tt.spec.Command || job.Status.State != string(JobPending) {
+					t.Errorf("expected the job of %+v, got %+v %+v", tt.spec, job.Spec, job.Status)
+				}
+			}
+
+			if got := runner.counts()["created"] == 1; got != tt.started {
+				t.Errorf("expected started %v, got runs %v", tt.started, runner.counts())
+			}
+			if _, found := p.jobs.get("created"); found != tt.started {
+				t.Errorf("expected the job recorded %v, got %v", tt.started, found)
+			}
+		})
+	}
+}
+
+func TestProfilingJobStorageGetListDelete(t *testing.T) {
+	runner := &countingRunner{runs: map[string]int{}}
+	p := newJobTestProvider(t, runner)
+	storage := &profilingJobStorage{p: p}
+	ctx := genericapirequest.WithNamespace(context.TODO(), "default")
+
+	obj, err := storage.Get(ctx, "job", &metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if job := obj.(*colibriv1alpha1.ProfilingJob); job.Spec.Process != "1" || job.Status.State != string(JobPending) {
+		t.Errorf("expected the pending job of process 1, got %+v %+v", job.Spec, job.Status)
+	}
+	if _, err := storage.Get(genericapirequest.WithNamespace(context.TODO(), "other"), "job", &metav1.GetOptions{}); !apierr.IsNotFound(err) {
+		t.Errorf("expected NotFound in another namespace, got %v", err)
+	}
+
+	for ns, want := range map[string]int{"default": 1, "other": 0, "": 1} {
+		obj, err := storage.List(genericapirequest.WithNamespace(context.TODO(), ns), &metainternalversion.ListOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := len(obj.(*colibriv1alpha1.ProfilingJobList).Items); got != want {
+			t.Errorf("expected %d jobs listed in %q, got %d", want, ns, got)
+		}
+	}
+
+	// deleting a running job cancels it
+	obj, deleted, err := storage.Delete(ctx, "job", nil, &metav1.DeleteOptions{})
+	if err != nil || !deleted {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if job := obj.(*colibriv1alpha1.ProfilingJob); job.Status.State != string(JobCancelled) || len(runner.stopped) != 1 {
+		t.Errorf("expected the job cancelled, got %s stopped %v", job.Status.State, runner.stopped)
+	}
+	if _, err := storage.Get(ctx, "job", &metav1.GetOptions{}); !apierr.IsNotFound(err) {
+		t.Errorf("expected NotFound after deleted, got %v", err)
+	}
+}
+
+func TestProfileResultStorageDryRun(t *testing.T) {
+	p := newJobTestProvider(t, &countingRunner{runs: map[string]int{}})
+	storage := &profileResultStorage{p: p}
+	ctx := genericapirequest.WithNamespace(context.TODO(), "default")
+
+	in := &colibriv1alpha1.ProfileResult{Pod: "web-0", Process: "1", CPU: "100m"}
+	if _, err := storage.Create(ctx, in, nil, &metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}}); !apierr.IsBadRequest(err) {
+		t.Errorf("expected BadRequest, got %v", err)
+	}
+}
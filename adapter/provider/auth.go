@@ -0,0 +1,160 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"errors"
+
+	"github.com/emicklei/go-restful"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/klog/v2"
+
+	colibriv1alpha1 "colibri-apiserver/adapter/apis/colibri/v1alpha1"
+)
+
+// ColibriGroup is the API group of colibri resources in authorization checks
+const ColibriGroup = colibriv1alpha1.GroupName
+
+// the resources of ColibriGroup guarding the web service
+const (
+	profilingJobsResource  = "profilingjobs"
+	profileResultsResource = "profileresults"
+	// recommendationsResource guards patching workloads with their recommendations
+	recommendationsResource = "recommendations"
+)
+
+// the attribute keeping the authenticated user.Info of a request
+const requestUserAttributeKey = "user"
+
+// RequestAuth authenticates and authorizes the requests to the colibri web service,
+// the same way as the secure port of the adapter: by TokenReview and SubjectAccessReview
+type RequestAuth struct {
+	Authenticator authenticator.Request
+	Authorizer    authorizer.Authorizer
+}
+
+// authorize returns a filter letting a request through only if its user is allowed to
+// verb the resource of ColibriGroup in the namespace given by namespaceOf.
+// All requests are let through if the provider has no RequestAuth.
+func (p *colibriProvider) authorize(verb string, resource string, namespaceOf func(*restful.Request) string) restful.FilterFunction {
+	return func(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+		if p.auth == nil {
+			chain.ProcessFilter(request, response)
+			return
+		}
+
+		res, ok, err := p.auth.Authenticator.AuthenticateRequest(request.Request)
+		if err != nil {
+			klog.Errorf("Failed to authenticate request: %s", err)
+		}
+		if err != nil || !ok {
+			writeStatusError(response, apierr.NewUnauthorized("Unauthorized"))
+			return
+		}
+
+		attrs := authorizer.AttributesRecord{
+			User:            res.User,
+			Verb:            verb,
+			Namespace:       namespaceOf(request),
+			APIGroup:        ColibriGroup,
+			APIVersion:      "*",
+			Resource:        resource,
+			ResourceRequest: true,
+			Path:            request.Request.URL.Path,
+		}
+		decision, reason, err := p.auth.Authorizer.Authorize(request.Request.Context(), attrs)
+		if err != nil {
+			klog.Errorf("Failed to authorize request: %s", err)
+		}
+		if decision != authorizer.DecisionAllow {
+			if reason == "" {
+				reason = "user " + res.User.GetName() + " cannot " + verb + " " + resource + " in namespace \"" + attrs.Namespace + "\""
+			}
+			writeStatusError(response, apierr.NewForbidden(schema.GroupResource{Group: ColibriGroup, Resource: resource}, "", errors.New(reason)))
+			return
+		}
+
+		request.SetAttribute(requestUserAttributeKey, res.User)
+		chain.ProcessFilter(request, response)
+	}
+}
+
+// requestUser returns the name of the authenticated user of a request, anonymous if the provider has no RequestAuth
+func requestUser(request *restful.Request) string {
+	if u, ok := request.Attribute(requestUserAttributeKey).(user.Info); ok {
+		return u.GetName()
+	}
+	return user.Anonymous
+}
+
+// authorizeOn checks the user of a request is allowed to verb an object of a K8s resource,
+// for what the adapter does on behalf of the user. It is always allowed if the provider has no RequestAuth,
+// and never if the request has no user authenticated by the authorize filter.
+func (p *colibriProvider) authorizeOn(request *restful.Request, verb string, res schema.GroupResource, namespace string, name string) error {
+	if p.auth == nil {
+		return nil
+	}
+	u, ok := request.Attribute(requestUserAttributeKey).(user.Info)
+	if !ok {
+		return apierr.NewUnauthorized("Unauthorized")
+	}
+	attrs := authorizer.AttributesRecord{
+		User:            u,
+		Verb:            verb,
+		Namespace:       namespace,
+		APIGroup:        res.Group,
+		APIVersion:      "*",
+		Resource:        res.Resource,
+		Name:            name,
+		ResourceRequest: true,
+	}
+	decision, reason, err := p.auth.Authorizer.Authorize(request.Request.Context(), attrs)
+	if err != nil {
+		klog.Errorf("Failed to authorize request: %s", err)
+	}
+	if decision != authorizer.DecisionAllow {
+		if reason == "" {
+			reason = "user " + u.GetName() + " cannot " + verb + " " + res.String() + " in namespace \"" + namespace + "\""
+		}
+		return apierr.NewForbidden(res, name, errors.New(reason))
+	}
+	return nil
+}
+
+// the namespaces of requests, for authorization checks
+
+func pathNamespace(request *restful.Request) string {
+	return request.PathParameter("namespace")
+}
+
+func queryNamespace(request *restful.Request) string {
+	return request.QueryParameter("namespace")
+}
+
+func (p *colibriProvider) jobNamespace(request *restful.Request) string {
+	record, _ := p.jobs.get(request.PathParameter("jobId"))
+	return record.Namespace
+}
+
+func (p *colibriProvider) workloadNamespace(request *restful.Request) string {
+	record, _ := p.workloads.get(request.PathParameter("workloadId"))
+	return record.Namespace
+}
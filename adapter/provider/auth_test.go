@@ -0,0 +1,135 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+// newTestAuth authenticates the bearer tokens "alice" and "bob" as their users, and allows alice to do anything
+// in the namespace default. The attributes of the last authorization are kept in last.
+func newTestAuth(last *authorizer.Attributes) *RequestAuth {
+	return &RequestAuth{
+		Authenticator: authenticator.RequestFunc(func(req *http.Request) (*authenticator.Response, bool, error) {
+			switch token := req.Header.Get("Authorization"); token {
+			case "Bearer alice", "Bearer bob":
+				return &authenticator.Response{User: &user.DefaultInfo{Name: token[len("Bearer "):]}}, true, nil
+			}
+			return nil, false, nil
+		}),
+		Authorizer: authorizer.AuthorizerFunc(func(ctx context.Context, attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+			*last = attrs
+			if attrs.GetUser().GetName() == "alice" && attrs.GetNamespace() == "default" {
+				return authorizer.DecisionAllow, "", nil
+			}
+			return authorizer.DecisionNoOpinion, "", nil
+		}),
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		user      string
+		code      int
+		verb      string
+		namespace string
+	}{
+		{name: "unauthenticated", method: http.MethodGet, path: "/colibri/jobs/job", code: http.StatusUnauthorized},
+		{name: "unknown token", method: http.MethodGet, path: "/colibri/jobs/job", user: "eve", code: http.StatusUnauthorized},
+		{name: "forbidden", method: http.MethodGet, path: "/colibri/jobs/job", user: "bob", code: http.StatusForbidden,
+			verb: "get", namespace: "default"},
+		{name: "forbidden in another namespace", method: http.MethodGet, path: "/colibri/jobs?namespace=other", user: "alice",
+			code: http.StatusForbidden, verb: "list", namespace: "other"},
+		{name: "job of the namespace", method: http.MethodGet, path: "/colibri/jobs/job", user: "alice", code: http.StatusOK,
+			verb: "get", namespace: "default"},
+		{name: "cancel", method: http.MethodDelete, path: "/colibri/jobs/job", user: "alice", code: http.StatusOK,
+			verb: "delete", namespace: "default"},
+		{name: "create", method: http.MethodPost, path: "/colibri/default/web-0/2", user: "alice", code: http.StatusOK,
+			verb: "create", namespace: "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newJobTestProvider(t, &countingRunner{runs: map[string]int{}})
+			var last authorizer.Attributes
+			p.auth = newTestAuth(&last)
+
+			var headers []string
+			if tt.user != "" {
+				headers = []string{"Authorization", "Bearer " + tt.user}
+			}
+			recorder := serveRequest(p, tt.method, tt.path, "{}", headers...)
+			if recorder.Code != tt.code {
+				t.Fatalf("expected %d, got %d: %s", tt.code, recorder.Code, recorder.Body.String())
+			}
+			if tt.verb == "" {
+				if last != nil {
+					t.Errorf("expected no authorization of an unauthenticated request, got %v", last)
+				}
+				return
+			}
+			if last.GetVerb() != tt.verb || last.GetNamespace() != tt.namespace ||
+				last.GetAPIGroup() != ColibriGroup || last.GetResource() != profilingJobsResource {
+				t.Errorf("expected %s %s in %s authorized, got %+v", tt.verb, profilingJobsResource, tt.namespace, last)
+			}
+		})
+	}
+}
+
+func TestAuthorizeOn(t *testing.T) {
+	p := newJobTestProvider(t, &countingRunner{runs: map[string]int{}})
+	deployments := schema.GroupResource{Group: "apps", Resource: "deployments"}
+	newRequest := func(name string) *restful.Request {
+		request := restful.NewRequest(httptest.NewRequest(http.MethodPost, "/colibri/default/workloads/Deployment/web/recommendation", nil))
+		if name != "" {
+			request.SetAttribute(requestUserAttributeKey, &user.DefaultInfo{Name: name})
+		}
+		return request
+	}
+
+	// all is allowed without RequestAuth
+	if err := p.authorizeOn(newRequest(""), "patch", deployments, "default", "web"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	var last authorizer.Attributes
+	p.auth = newTestAuth(&last)
+	if err := p.authorizeOn(newRequest(""), "patch", deployments, "default", "web"); !apierr.IsUnauthorized(err) {
+		t.Errorf("expected Unauthorized without an authenticated user, got %v", err)
+	}
+	if err := p.authorizeOn(newRequest("bob"), "patch", deployments, "default", "web"); !apierr.IsForbidden(err) {
+		t.Errorf("expected Forbidden, got %v", err)
+	}
+	if err := p.authorizeOn(newRequest("alice"), "patch", deployments, "default", "web"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if last.GetVerb() != "patch" || last.GetAPIGroup() != "apps" || last.GetResource() != "deployments" || last.GetName() != "web" {
+		t.Errorf("expected patching the deployment web authorized, got %+v", last)
+	}
+}
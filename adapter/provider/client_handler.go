@@ -18,12 +18,17 @@ package provider
 
 import (
 	"context"
-	"strconv"
+	"errors"
+	"fmt"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/klog/v2"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 )
 
 func (p *colibriProvider) checkPod(namespaceName string, podName string) (*unstructured.Unstructured, error) {
@@ -39,99 +44,165 @@ func (p *colibriProvider) checkPod(namespaceName string, podName string) (*unstr
 	if err != nil {
 		return nil, err
 	}
-	//no need to check container for now
-	//check container
-	/*
-	   containers := pod.Object["spec"].(map[string]interface{})["containers"].([]interface{})
-	   for _, c := range containers {
-	       if containerName == c.(map[string]interface{})["name"].(string) {
-	           return nil
-	       }
-	   }
-
-	   return errors.New("container \"" + containerName + "\" not found")
-	*/
 
 	return pod, nil
 }
 
-func (p *colibriProvider) runColibriJob(pod *unstructured.Unstructured, params *jobParam, namespaceName string, podName string, pid string) {
-
-	//get node
-	node := pod.Object["spec"].(map[string]interface{})["nodeName"].(string)
-
-	//create service account
-	klog.Infof("Creating Job...")
-
-	//job runned by api server doesn't keep output files (currently), and running all metrics types
-
-	jobResource := schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
-	job := &unstructured.Unstructured{
-		Object: map[string]interface{}{
-			"apiVersion": "batch/v1",
-			"kind":       "Job",
-			"metadata": map[string]interface{}{
-				"name":      podName + "-" + pid + "-colibri-job",
-				"namespace": "colibri",
-			},
-			"spec": map[string]interface{}{
-				"template": map[string]interface{}{
-					"spec": map[string]interface{}{
-						"nodeName":           node,
-						"serviceAccountName": "colibri-job",
-						"restartPolicy":      "Never",
-						"volumes": []map[string]interface{}{
-							{
-								"name": "proc-dir",
-								"hostPath": map[string]interface{}{
-									"type": "Directory",
-									"path": "/proc",
-								},
-							},
-							{
-								"name": "cgroup-dir",
-								"hostPath": map[string]interface{}{
-									"type": "Directory",
-									"path": "/sys/fs/cgroup",
-								},
-							},
-						},
-						"containers": []map[string]interface{}{
-							{
-								"name":            "cjob",
-								"image":           "gabbro:30500/colibri-job:raw",
-								"imagePullPolicy": "Never",
-								"command": []string{
-									"colibri", "--pid", pid,
-									"--freq", strconv.Itoa(params.Frequency),
-									"--iter", strconv.Itoa(params.Iteration),
-									"--pert", strconv.Itoa(params.Percentile),
-									"--out", "api:" + namespaceName + "." + podName + "." + pid,
-									"--mtype", "all",
-								},
-								"volumeMounts": []map[string]interface{}{
-									{
-										"mountPath": "/tmp/proc",
-										"name":      "proc-dir",
-									},
-									{
-										"mountPath": "/tmp/cgroup",
-										"name":      "cgroup-dir",
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-		},
-	}
-
-	result, err := p.client.Resource(jobResource).Namespace("colibri").Create(context.TODO(), job, metav1.CreateOptions{})
+// checkContainer finds a container in the spec of pod, and returns its runtime ID, e.g. containerd://<id>.
+// A container not in the spec is Invalid, and a container not started yet is a Conflict, like a pod not running.
+func checkContainer(pod *unstructured.Unstructured, containerName string) (string, error) {
+	podResource := schema.GroupResource{Resource: "pods"}
+
+	containers, _, _ := unstructured.NestedSlice(pod.Object, "spec", "containers")
+	found := false
+	for _, c := range containers {
+		if container, ok := c.(map[string]interface{}); ok && container["name"] == containerName {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return "", apierr.NewInvalid(schema.GroupKind{Kind: "Pod"}, pod.GetName(), field.ErrorList{
+			field.NotFound(field.NewPath("spec", "containers"), containerName),
+		})
+	}
+
+	statuses, _, _ := unstructured.NestedSlice(pod.Object, "status", "containerStatuses")
+	for _, s := range statuses {
+		status, ok := s.(map[string]interface{})
+		if !ok || status["name"] != containerName {
+			continue
+		}
+		if id, _ := status["containerID"].(string); id != "" {
+			return id, nil
+		}
+	}
+	return "", apierr.NewConflict(podResource, pod.GetName(), fmt.Errorf("container %s of pod is not started", containerName))
+}
+
+// checkPlacement checks a job can be placed with pod, and returns the node of pod.
+// The pod must be Running on a node, and when colibri runs on the node of the pod,
+// the node must be Ready, not cordoned, and its taints tolerated by colibri.
+func (p *colibriProvider) checkPlacement(pod *unstructured.Unstructured) (string, error) {
+	podResource := schema.GroupResource{Resource: "pods"}
+
+	//check pod
+	phase, _, _ := unstructured.NestedString(pod.Object, "status", "phase")
+	if phase != "Running" {
+		return "", apierr.NewConflict(podResource, pod.GetName(), fmt.Errorf("pod is %s, not Running", phaseOrUnknown(phase)))
+	}
+	nodeName, _, _ := unstructured.NestedString(pod.Object, "spec", "nodeName")
+	if nodeName == "" {
+		return "", apierr.NewConflict(podResource, pod.GetName(), errors.New("pod is not scheduled to a node"))
+	}
+
+	runner, ok := p.runner.(NodeRunner)
+	if !ok {
+		return nodeName, nil
+	}
+
+	//check node
+	res := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "nodes"}
+	node, err := p.client.Resource(res).Get(context.TODO(), nodeName, metav1.GetOptions{})
 	if err != nil {
-		klog.Errorf("Failed to create job: %s", err)
-		return
+		return "", err
+	}
+	if !nodeReady(node) {
+		return "", apierr.NewConflict(podResource, pod.GetName(), fmt.Errorf("node %s of pod is not Ready", nodeName))
+	}
+	if unschedulable, _, _ := unstructured.NestedBool(node.Object, "spec", "unschedulable"); unschedulable {
+		return "", apierr.NewConflict(podResource, pod.GetName(), fmt.Errorf("node %s of pod is cordoned", nodeName))
+	}
+
+	//check taints
+	tolerations, err := runner.Tolerations()
+	if err != nil {
+		return "", err
+	}
+	taints, _, _ := unstructured.NestedSlice(node.Object, "spec", "taints")
+	for _, t := range taints {
+		obj, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var taint corev1.Taint
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj, &taint); err != nil {
+			return "", err
+		}
+		if taint.Effect == corev1.TaintEffectPreferNoSchedule || tolerated(tolerations, &taint) {
+			continue
+		}
+		return "", apierr.NewInvalid(schema.GroupKind{Kind: "Pod"}, pod.GetName(), field.ErrorList{
+			field.Forbidden(field.NewPath("spec", "nodeName"),
+				fmt.Sprintf("taint %s of node %s is not tolerated by colibri jobs", taint.ToString(), nodeName)),
+		})
+	}
+	return nodeName, nil
+}
+
+// nodeReady tells if the Ready condition of node is True
+func nodeReady(node *unstructured.Unstructured) bool {
+	conditions, _, _ := unstructured.NestedSlice(node.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if ok && condition["type"] == "Ready" {
+			return condition["status"] == "True"
+		}
+	}
+	return false
+}
+
+func tolerated(tolerations []corev1.Toleration, taint *corev1.Taint) bool {
+	for i := range tolerations {
+		if tolerations[i].ToleratesTaint(taint) {
+			return true
+		}
+	}
+	return false
+}
+
+func phaseOrUnknown(phase string) string {
+	if phase == "" {
+		return "Unknown"
+	}
+	return phase
+}
+
+// run colibri for a job by the job runner of provider, on node of the pod, retried by the policy of provider until timeout
+func (p *colibriProvider) runColibriJob(node string, params *jobParam, timeout time.Duration, namespaceName string, podName string, target jobTarget, jobID string) (JobRef, error) {
+
+	//only the job holding the token can put its result
+	token, hash, err := newResultToken()
+	if err != nil {
+		return JobRef{}, err
+	}
+	p.jobs.update(jobID, func(r *jobRecord) {
+		r.tokenHash = hash
+	})
+
+	//colibri appends the process ID it discovers for a process targeted by its container
+	resultID := namespaceName + "." + podName
+	if target.Process != "" {
+		resultID += "." + target.Process
 	}
-	klog.Infof("Created job %q", result.GetName())
 
+	return p.runner.Run(JobSpec{
+		ID:          jobID,
+		Namespace:   namespaceName,
+		Pod:         podName,
+		Process:     target.Process,
+		Container:   target.Container,
+		ContainerID: target.ContainerID,
+		Command:     target.Command,
+		NodeName:    node,
+		Frequency:   params.Frequency,
+		Iteration:   params.Iteration,
+		Percentile:  params.Percentile,
+		ResultID:    resultID,
+		Token:       token,
+		Retries:     p.policy.Retries,
+		Timeout:     timeout,
+	}, func(state JobState, reason string) {
+		p.setJobState(jobID, state, reason)
+	})
 }
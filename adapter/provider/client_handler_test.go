@@ -0,0 +1,202 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestCheckContainer(t *testing.T) {
+	pod := newTestObject("v1", "Pod", "default", "web-0", map[string]interface{}{
+		"containers": []interface{}{
+			map[string]interface{}{"name": "server"},
+			map[string]interface{}{"name": "sidecar"},
+		},
+	})
+	statuses := []interface{}{
+		map[string]interface{}{"name": "server", "containerID": "containerd://server"},
+		map[string]interface{}{"name": "sidecar"},
+	}
+	if err := unstructured.SetNestedSlice(pod.Object, statuses, "status", "containerStatuses"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		container string
+		want      string
+		// the container is not started
+		conflict bool
+		// the container is not in the pod
+		invalid bool
+	}{
+		{container: "server", want: "containerd://server"},
+		{container: "sidecar", conflict: true},
+		{container: "unknown", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.container, func(t *testing.T) {
+			got, err := checkContainer(pod, tt.container)
+			switch {
+			case tt.conflict:
+				if !apierr.IsConflict(err) {
+					t.Errorf("expected Conflict, got %v", err)
+				}
+			case tt.invalid:
+				if !apierr.IsInvalid(err) {
+					t.Errorf("expected Invalid, got %v", err)
+				}
+			case err != nil || got != tt.want:
+				t.Errorf("expected %s, got %s: %v", tt.want, got, err)
+			}
+		})
+	}
+
+	if got := onlyContainer(pod); got != "" {
+		t.Errorf("expected no only container of 2 containers, got %s", got)
+	}
+}
+
+func TestRunContainerJob(t *testing.T) {
+	runner := &countingRunner{runs: map[string]int{}, specs: map[string]JobSpec{}}
+	p := newJobTestProvider(t, runner)
+
+	recorder := serveRequest(p, http.MethodPost, "/colibri/default/web-0", `{"container": "server", "command": "^nginx"}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	var record jobRecord
+	if err := json.Unmarshal(recorder.Body.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Process != "" || record.Container != "server" || record.Command != "^nginx" {
+		t.Errorf("expected the job of container server with process unresolved, got %+v", record)
+	}
+
+	// colibri is given the container, and appends the process it discovers to the result ID
+	spec := runner.specs[record.ID]
+	if spec.Process != "" || spec.Container != "server" || spec.ContainerID != "containerd://server" ||
+		spec.Command != "^nginx" || spec.ResultID != "default.web-0" {
+		t.Errorf("expected colibri run for the container server, got %+v", spec)
+	}
+	// the job of a process targeted by its ID names its only container
+	if record, _ := p.jobs.get("job"); record.Container != "server" {
+		t.Errorf("expected the only container server recorded, got %q", record.Container)
+	}
+
+	if recorder := serveRequest(p, http.MethodPost, "/colibri/default/web-0", `{"container": "sidecar"}`); recorder.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected %d for an unknown container, got %d", http.StatusUnprocessableEntity, recorder.Code)
+	}
+	for _, path := range []string{"/colibri/default/web-1", "/colibri/other/web-0", "/colibri/default/web-1/1"} {
+		if recorder := serveRequest(p, http.MethodPost, path, `{"container": "server"}`); recorder.Code != http.StatusNotFound {
+			t.Errorf("expected %d for %s, got %d", http.StatusNotFound, path, recorder.Code)
+		}
+	}
+}
+
+// tolerantRunner is a countingRunner running colibri on the node of pods with tolerations
+type tolerantRunner struct {
+	*countingRunner
+	tolerations []corev1.Toleration
+}
+
+func (r *tolerantRunner) Tolerations() ([]corev1.Toleration, error) {
+	return r.tolerations, nil
+}
+
+func TestCheckPlacement(t *testing.T) {
+	newNode := func(name string, ready string, unschedulable bool, taints ...interface{}) *unstructured.Unstructured {
+		node := newTestObject("v1", "Node", "", name, map[string]interface{}{"unschedulable": unschedulable, "taints": taints})
+		conditions := []interface{}{map[string]interface{}{"type": "Ready", "status": ready}}
+		if err := unstructured.SetNestedSlice(node.Object, conditions, "status", "conditions"); err != nil {
+			t.Fatal(err)
+		}
+		return node
+	}
+	objects := []runtime.Object{
+		newNode("ready", "True", false),
+		newNode("not-ready", "False", false),
+		newNode("cordoned", "True", true),
+		newNode("tainted", "True", false, map[string]interface{}{"key": "dedicated", "value": "gpu", "effect": "NoSchedule"}),
+		newNode("preferred", "True", false, map[string]interface{}{"key": "dedicated", "value": "gpu", "effect": "PreferNoSchedule"}),
+	}
+	gpu := []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "gpu", Effect: corev1.TaintEffectNoSchedule}}
+
+	tests := []struct {
+		name        string
+		phase       string
+		node        string
+		tolerations []corev1.Toleration
+		// the runner does not run colibri on the node of pods
+		anyNode  bool
+		conflict bool
+		invalid  bool
+	}{
+		{name: "ready node", phase: "Running", node: "ready"},
+		{name: "pending pod", phase: "Pending", node: "ready", conflict: true},
+		{name: "unscheduled pod", phase: "Running", conflict: true},
+		{name: "node not ready", phase: "Running", node: "not-ready", conflict: true},
+		{name: "cordoned node", phase: "Running", node: "cordoned", conflict: true},
+		{name: "taint not tolerated", phase: "Running", node: "tainted", invalid: true},
+		{name: "taint tolerated", phase: "Running", node: "tainted", tolerations: gpu},
+		{name: "taint preferred", phase: "Running", node: "preferred"},
+		{name: "runner not on the node", phase: "Running", node: "not-ready", anyNode: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var runner JobRunner = &tolerantRunner{countingRunner: &countingRunner{runs: map[string]int{}}, tolerations: tt.tolerations}
+			if tt.anyNode {
+				runner = &countingRunner{runs: map[string]int{}}
+			}
+			opts := DefaultOptions()
+			opts.Runner = runner
+			p := newTestProvider(newTestClient(objects...), opts)
+
+			pod := newTestObject("v1", "Pod", "default", "web-0", map[string]interface{}{"nodeName": tt.node})
+			if err := unstructured.SetNestedField(pod.Object, tt.phase, "status", "phase"); err != nil {
+				t.Fatal(err)
+			}
+			node, err := p.checkPlacement(pod)
+			switch {
+			case tt.conflict:
+				if !apierr.IsConflict(err) {
+					t.Errorf("expected Conflict, got %v", err)
+				}
+			case tt.invalid:
+				if !apierr.IsInvalid(err) {
+					t.Errorf("expected Invalid, got %v", err)
+				}
+			case err != nil || node != tt.node:
+				t.Errorf("expected the job placed on node %s, got %s: %v", tt.node, node, err)
+			}
+
+			// no job is recorded for a pod it cannot be placed with
+			placed := !tt.conflict && !tt.invalid
+			params := &jobParam{Frequency: 10, Iteration: 1000, Percentile: 99}
+			_, err = p.startJob(pod, "default", "web-0", jobTarget{Process: "1"}, params, "job")
+			if _, found := p.jobs.get("job"); found != placed || (err == nil) != placed {
+				t.Errorf("expected the job recorded %v, got %v: %v", placed, found, err)
+			}
+		})
+	}
+}
@@ -18,16 +18,17 @@ package provider
 
 import (
 	"context"
-	"time"
 
 	"github.com/emicklei/go-restful"
 	apierr "k8s.io/apimachinery/pkg/api/errors"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
-	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	genericapiserver "k8s.io/apiserver/pkg/server"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/metrics/pkg/apis/custom_metrics"
 
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
@@ -39,102 +40,153 @@ type customKey struct {
 	types.NamespacedName
 }
 
-// Implementation of provider.CustomMetricsProvider
+// Implementation of provider.CustomMetricsProvider and provider.ExternalMetricsProvider
 type colibriProvider struct {
 	client dynamic.Interface
 	mapper apimeta.RESTMapper
+	// objects reads the objects looked up on the paths of results, admission reviews and scrapes
+	objects *objectCache
+
+	values     MetricStore
+	jobs       *jobTracker
+	workloads  *workloadTracker
+	runner     JobRunner
+	validation Validation
+	policy     JobPolicy
+	naming     MetricNaming
+	// recommendation decides the resources recommended from results
+	recommendation RecommendationPolicy
+	// sinks queues the stored results to be written out of the adapter, nil if they are not
+	sinks *sinkQueue
+	// auth guards the web service, nil lets all requests through
+	auth *RequestAuth
+}
 
-	values map[customKey]resource.Quantity
+// Options configures a provider. The zero values of the policies are not their defaults, start from DefaultOptions.
+type Options struct {
+	// Store keeps the parameters and the results of jobs, a memory store keeping all samples if nil
+	Store MetricStore
+	// Runner runs colibri for jobs, no job can be run if nil
+	Runner JobRunner
+	// Validation bounds the parameters of jobs
+	Validation Validation
+	// JobPolicy decides the retries and the default timeout of jobs
+	JobPolicy JobPolicy
+	// MetricNaming decides the names results are served as in the custom metrics API
+	MetricNaming MetricNaming
+	// Recommendation decides the resources recommended from results
+	Recommendation RecommendationPolicy
+	// Sink is given the stored results, nil if they are not written out of the adapter
+	Sink ResultSink
+	// Auth guards the web service, nil lets all requests through
+	Auth *RequestAuth
+	// Informers caches pods, namespaces, ReplicaSets and Jobs, which are read from K8s API server if nil.
+	// It is started by the caller once the provider is made.
+	Informers dynamicinformer.DynamicSharedInformerFactory
 }
 
-func NewProvider(client dynamic.Interface, mapper apimeta.RESTMapper) (provider.CustomMetricsProvider, *restful.WebService) {
-	p := &colibriProvider{
-		client: client,
-		mapper: mapper,
-		values: make(map[customKey]resource.Quantity),
+// DefaultOptions returns the options with the default policies, a memory store and no runner
+func DefaultOptions() Options {
+	return Options{
+		Validation:     DefaultValidation,
+		JobPolicy:      DefaultJobPolicy,
+		MetricNaming:   DefaultMetricNaming,
+		Recommendation: DefaultRecommendationPolicy,
 	}
-	return p, p.webService()
 }
 
-// get the value from the map of provider (p.values)
-func (p *colibriProvider) valueFor(info provider.CustomMetricInfo, name types.NamespacedName) (resource.Quantity, error) {
-	info, _, err := info.Normalized(p.mapper)
-	if err != nil {
-		return resource.Quantity{}, err
+// NewProvider returns the custom and external metrics provider, together with the colibri REST API as a web service
+// and the colibri API group to be served on the secure port
+func NewProvider(client dynamic.Interface, mapper apimeta.RESTMapper, opts Options) (provider.MetricsProvider, *restful.WebService, *genericapiserver.APIGroupInfo) {
+	if opts.Store == nil {
+		opts.Store = NewMemoryStore(0)
 	}
-	ckey := customKey{
-		CustomMetricInfo: info,
-		NamespacedName:   name,
+	p := &colibriProvider{
+		client:         client,
+		mapper:         mapper,
+		objects:        newObjectCache(client, opts.Informers),
+		values:         opts.Store,
+		jobs:           newJobTracker(),
+		workloads:      newWorkloadTracker(),
+		runner:         opts.Runner,
+		validation:     opts.Validation,
+		policy:         opts.JobPolicy,
+		naming:         opts.MetricNaming,
+		recommendation: opts.Recommendation,
+		auth:           opts.Auth,
 	}
-
-	value, found := p.values[ckey]
-	if !found {
-		return resource.Quantity{}, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	if opts.Sink != nil {
+		p.sinks = newSinkQueue(opts.Sink)
+		go p.sinks.run(wait.NeverStop)
 	}
-
-	return value, nil
+	return p, p.webService(), p.apiGroupInfo()
 }
 
-// come out a standardize metric: info+value
-func (p *colibriProvider) metricFor(value resource.Quantity,
+// come out a standardize metric: info+value, at the time the sample is stored
+func (p *colibriProvider) metricFor(value Sample,
 	name types.NamespacedName,
-	info provider.CustomMetricInfo) (*custom_metrics.MetricValue, error) {
+	info provider.CustomMetricInfo,
+	metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
 	objRef, err := helpers.ReferenceFor(p.mapper, name, info)
 	if err != nil {
 		return nil, err
 	}
 
-	return &custom_metrics.MetricValue{
+	metric := &custom_metrics.MetricValue{
 		DescribedObject: objRef,
 		Metric:          custom_metrics.MetricIdentifier{Name: info.Metric},
-		Timestamp:       metav1.Time{time.Now()},
-		Value:           value,
-	}, nil
-}
-
-// list all info of metrics, from the map of provider (p.values)
-func (p *colibriProvider) ListAllMetrics() []provider.CustomMetricInfo {
-
-	// Get unique CustomMetricInfos from wrapper CustomMetricResources
-	infos := make(map[provider.CustomMetricInfo]struct{})
-	for resource := range p.values {
-		infos[resource.CustomMetricInfo] = struct{}{}
+		Timestamp:       metav1.Time{Time: value.Timestamp},
+		Value:           value.Value,
 	}
-
-	// Build slice of CustomMetricInfos to be returns
-	metrics := make([]provider.CustomMetricInfo, 0, len(infos))
-	for info := range infos {
-		metrics = append(metrics, info)
+	if metricSelector != nil && !metricSelector.Empty() {
+		selector, err := metav1.ParseToLabelSelector(metricSelector.String())
+		if err != nil {
+			return nil, err
+		}
+		metric.Metric.Selector = selector
 	}
+	return metric, nil
+}
 
-	return metrics
+// list all info of metrics served, by the metrics in the store of provider (p.values)
+func (p *colibriProvider) ListAllMetrics() []provider.CustomMetricInfo {
+	return p.metricInfos()
 }
 
-// get the standardize metric (info+value) by name
+// get the standardize metric (info+value) by name, if its labels match metricSelector
 func (p *colibriProvider) GetMetricByName(ctx context.Context,
 	name types.NamespacedName,
 	info provider.CustomMetricInfo,
 	metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
-	value, err := p.valueFor(info, name)
+	info, _, err := info.Normalized(p.mapper)
 	if err != nil {
 		return nil, err
 	}
-	return p.metricFor(value, name, info)
+	value, err := p.sampleFor(info, name, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+	return p.metricFor(value, name, info, metricSelector)
 }
 
+// get the standardize metrics of the objects matching selector in namespace,
+// only the objects having the metric, with labels matching metricSelector, are listed
 func (p *colibriProvider) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector,
 	info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
 
+	info, _, err := info.Normalized(p.mapper)
+	if err != nil {
+		return nil, err
+	}
 	names, err := helpers.ListObjectNames(p.mapper, p.client, namespace, selector, info)
 	if err != nil {
 		return nil, err
 	}
 
-	res := make([]custom_metrics.MetricValue, len(names))
-	for i, name := range names {
-		// TODO: not sure what this function used for, need to update later
+	res := make([]custom_metrics.MetricValue, 0, len(names))
+	for _, name := range names {
 		namespacedName := types.NamespacedName{Name: name, Namespace: namespace}
-		value, err := p.valueFor(info, namespacedName)
+		value, err := p.sampleFor(info, namespacedName, metricSelector)
 		if err != nil {
 			if apierr.IsNotFound(err) {
 				continue
@@ -142,11 +194,11 @@ func (p *colibriProvider) GetMetricBySelector(ctx context.Context, namespace str
 			return nil, err
 		}
 
-		metric, err := p.metricFor(value, namespacedName, info)
+		metric, err := p.metricFor(value, namespacedName, info, metricSelector)
 		if err != nil {
 			return nil, err
 		}
-		res[i] = *metric
+		res = append(res, *metric)
 	}
 
 	return &custom_metrics.MetricValueList{Items: res}, nil
@@ -0,0 +1,172 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// newSelectorTestProvider returns a provider with pods web-0, web-1 (app=web) and db-0 (app=db) in default.
+// The process 1 of web-0 is measured by a job with percentile 99, the one of web-1 with percentile 90,
+// and db-0 has no metric. The result of the process 1 of web-0 is stored with its container server.
+func newSelectorTestProvider(naming MetricNaming) *colibriProvider {
+	pods := make([]runtime.Object, 0, 3)
+	for name, app := range map[string]string{"web-0": "web", "web-1": "web", "db-0": "db"} {
+		pod := newTestObject("v1", "Pod", "default", name, nil)
+		pod.SetLabels(map[string]string{"app": app})
+		pods = append(pods, pod)
+	}
+	opts := DefaultOptions()
+	opts.MetricNaming = naming
+	p := newTestProvider(newTestClient(pods...), opts)
+
+	now := time.Now()
+	for pod, pert := range map[string]string{"web-0": "99", "web-1": "90"} {
+		name := types.NamespacedName{Namespace: "default", Name: pod}
+		for metric, value := range map[string]string{"1-cpu": "200m", "1-pert": pert} {
+			info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Metric: metric, Namespaced: true}
+			sample := Sample{Value: resource.MustParse(value), Timestamp: now}
+			if pod == "web-0" && metric == "1-cpu" {
+				sample.Container = "server"
+			}
+			p.values.Add(info, name, sample)
+		}
+	}
+	return p
+}
+
+func TestGetMetricBySelector(t *testing.T) {
+	tests := []struct {
+		name           string
+		naming         MetricNaming
+		metric         string
+		selector       string
+		metricSelector string
+		want           []string
+	}{
+		{name: "only pods having the metric", naming: DefaultMetricNaming, metric: "1-cpu", selector: "", metricSelector: "", want: []string{"web-0", "web-1"}},
+		{name: "pod selector", naming: DefaultMetricNaming, metric: "1-cpu", selector: "app=web", metricSelector: "", want: []string{"web-0", "web-1"}},
+		{name: "no pod has the metric", naming: DefaultMetricNaming, metric: "1-cpu", selector: "app=db", metricSelector: "", want: []string{}},
+		{name: "process label", naming: DefaultMetricNaming, metric: "1-cpu", selector: "", metricSelector: "process=1", want: []string{"web-0", "web-1"}},
+		{name: "another process", naming: DefaultMetricNaming, metric: "1-cpu", selector: "", metricSelector: "process=2", want: []string{}},
+		{name: "percentile label", naming: DefaultMetricNaming, metric: "1-cpu", selector: "app=web", metricSelector: "percentile=99", want: []string{"web-0"}},
+		{name: "percentile not in", naming: DefaultMetricNaming, metric: "1-cpu", selector: "", metricSelector: "process=1,percentile notin (99)", want: []string{"web-1"}},
+		{name: "stable name", naming: MetricNaming{}, metric: CPUMetric, selector: "", metricSelector: "", want: []string{"web-0", "web-1"}},
+		{name: "stable name by process", naming: MetricNaming{}, metric: CPUMetric, selector: "", metricSelector: "process=1,percentile=90", want: []string{"web-1"}},
+		{name: "stable name by container", naming: MetricNaming{}, metric: CPUMetric, selector: "", metricSelector: "container=server", want: []string{"web-0"}},
+		{name: "stable name without result", naming: MetricNaming{}, metric: MemoryMetric, selector: "", metricSelector: "", want: []string{}},
+		{name: "legacy name without aliases", naming: MetricNaming{}, metric: "1-cpu", selector: "", metricSelector: "", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newSelectorTestProvider(tt.naming)
+			info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Metric: tt.metric, Namespaced: true}
+
+			selector, err := labels.Parse(tt.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			metricSelector, err := labels.Parse(tt.metricSelector)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			list, err := p.GetMetricBySelector(context.TODO(), "default", selector, info, metricSelector)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := make([]string, 0, len(list.Items))
+			for _, item := range list.Items {
+				if item.DescribedObject.Name == "" || item.Value.Cmp(resource.MustParse("200m")) != 0 {
+					t.Errorf("unexpected metric value: %+v", item)
+				}
+				if !metricSelector.Empty() && item.Metric.Selector == nil {
+					t.Errorf("expected the metric selector in %+v", item.Metric)
+				}
+				if item.Metric.Name != tt.metric {
+					t.Errorf("expected metric %s, got %s", tt.metric, item.Metric.Name)
+				}
+				got = append(got, item.DescribedObject.Name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestListAllMetrics(t *testing.T) {
+	for naming, want := range map[MetricNaming][]string{
+		{}:              {CPUMetric},
+		{Aliases: true}: {"1-cpu", "1-pert", CPUMetric},
+	} {
+		var got []string
+		for _, info := range newSelectorTestProvider(naming).ListAllMetrics() {
+			got = append(got, info.Metric)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v with %+v, got %v", want, naming, got)
+		}
+	}
+}
+
+func TestGetMetricByNameWithMetricSelector(t *testing.T) {
+	p := newSelectorTestProvider(DefaultMetricNaming)
+	info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Metric: "1-cpu", Namespaced: true}
+
+	tests := []struct {
+		name           string
+		pod            string
+		metricSelector string
+		found          bool
+	}{
+		{name: "no metric selector", pod: "web-1", metricSelector: "", found: true},
+		{name: "matching percentile", pod: "web-0", metricSelector: "percentile=99", found: true},
+		{name: "other percentile", pod: "web-1", metricSelector: "percentile=99", found: false},
+		{name: "no metric", pod: "db-0", metricSelector: "", found: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metricSelector, err := labels.Parse(tt.metricSelector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = p.GetMetricByName(context.TODO(), types.NamespacedName{Namespace: "default", Name: tt.pod}, info, metricSelector)
+			if tt.found && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tt.found && !apierr.IsNotFound(err) {
+				t.Errorf("expected not found, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// labels of an external colibri metric
+const (
+	// workloadKindLabel is the lower-cased kind of the workload, e.g. deployment
+	workloadKindLabel = "workload_kind"
+	workloadLabel     = "workload"
+	// aggregationLabel is how the results of the pods of a workload are aggregated,
+	// known for the workload profilings run since the adapter started
+	aggregationLabel = "aggregation"
+)
+
+// aggregations of the results of the pods of a workload
+const (
+	aggregationMax = "max"
+	aggregationSum = "sum"
+	aggregationAvg = "avg"
+)
+
+// isWorkloadSeries tells whether a series of the metric store holds the aggregated results of workload profilings
+func isWorkloadSeries(series provider.CustomMetricInfo) bool {
+	return series.GroupResource.Resource != "pods" && series.GroupResource != containerResultsResource
+}
+
+// list the stable names of the stored results of workloads, as external metrics
+func (p *colibriProvider) ListAllExternalMetrics() []provider.ExternalMetricInfo {
+	seen := sets.NewString()
+	var infos []provider.ExternalMetricInfo
+	for _, info := range p.values.ListMetricInfos() {
+		if !isWorkloadSeries(info) {
+			continue
+		}
+		_, key, ok := splitSeries(info.Metric)
+		if !ok {
+			continue
+		}
+		name, ok := stableName(key)
+		if !ok || seen.Has(name) {
+			continue
+		}
+		seen.Insert(name)
+		infos = append(infos, provider.ExternalMetricInfo{Metric: name})
+	}
+	return infos
+}
+
+// get the aggregated results of the workloads in namespace, stored by the workload profilings, one value for each workload.
+// A workload is served by the latest result among its processes whose labels match metricSelector.
+func (p *colibriProvider) GetExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector,
+	info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+
+	key, found := resultSeries[info.Metric]
+	if !found {
+		return nil, provider.NewMetricNotFoundError(schema.GroupResource{Group: external_metrics.GroupName}, info.Metric)
+	}
+
+	latest := make(map[workloadRef]external_metrics.ExternalMetricValue)
+	for _, series := range p.values.ListMetricInfos() {
+		if !isWorkloadSeries(series) {
+			continue
+		}
+		pid, seriesKey, ok := splitSeries(series.Metric)
+		if !ok || seriesKey != key {
+			continue
+		}
+		gvk, err := p.mapper.KindFor(series.GroupResource.WithVersion(""))
+		if err != nil {
+			continue
+		}
+
+		for _, name := range p.values.ListNames(series) {
+			if name.Namespace != namespace {
+				continue
+			}
+			sample, found := p.values.Get(series, name)
+			if !found {
+				continue
+			}
+			metricLabels := p.workloadLabels(series, name, gvk.Kind, pid)
+			if !matchesMetric(metricSelector, metricLabels) {
+				continue
+			}
+			// the version of a workload is not kept in the store
+			ref := workloadRef{APIVersion: schema.GroupVersion{Group: gvk.Group}.String(), Kind: gvk.Kind, Name: name.Name}
+			if value, seen := latest[ref]; seen && !sample.Timestamp.After(value.Timestamp.Time) {
+				continue
+			}
+			latest[ref] = external_metrics.ExternalMetricValue{
+				MetricName:   info.Metric,
+				MetricLabels: metricLabels,
+				Timestamp:    metav1.Time{Time: sample.Timestamp},
+				Value:        sample.Value,
+			}
+		}
+	}
+
+	items := make([]external_metrics.ExternalMetricValue, 0, len(latest))
+	for _, item := range latest {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].MetricLabels[workloadKindLabel] != items[j].MetricLabels[workloadKindLabel] {
+			return items[i].MetricLabels[workloadKindLabel] < items[j].MetricLabels[workloadKindLabel]
+		}
+		return items[i].MetricLabels[workloadLabel] < items[j].MetricLabels[workloadLabel]
+	})
+
+	return &external_metrics.ExternalMetricValueList{Items: items}, nil
+}
+
+// workloadLabels returns the labels of the aggregated result of a process of a workload
+func (p *colibriProvider) workloadLabels(series provider.CustomMetricInfo, name types.NamespacedName, kind string, pid string) labels.Set {
+	set := labels.Set{
+		workloadKindLabel: strings.ToLower(kind),
+		workloadLabel:     name.Name,
+		processLabel:      pid,
+	}
+	pertInfo := series
+	pertInfo.Metric = pid + "-pert"
+	if pert, found := p.values.Get(pertInfo, name); found {
+		set[percentileLabel] = pert.Value.String()
+	}
+	if record, found := p.workloads.latestSucceeded(name.Namespace, kind, name.Name, pid); found {
+		set[aggregationLabel] = record.Aggregation
+	}
+	return set
+}
+
+// aggregateSamples aggregates the values of samples, at the time of the latest one
+func aggregateSamples(samples []Sample, aggregation string) (resource.Quantity, time.Time) {
+	value := samples[0].Value.DeepCopy()
+	timestamp := samples[0].Timestamp
+	for _, sample := range samples[1:] {
+		switch aggregation {
+		case aggregationMax:
+			if sample.Value.Cmp(value) > 0 {
+				value = sample.Value.DeepCopy()
+			}
+		case aggregationSum, aggregationAvg:
+			value.Add(sample.Value)
+		}
+		if sample.Timestamp.After(timestamp) {
+			timestamp = sample.Timestamp
+		}
+	}
+	if aggregation == aggregationAvg {
+		value = *resource.NewMilliQuantity(value.MilliValue()/int64(len(samples)), value.Format)
+	}
+	return value, timestamp
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// newExternalTestProvider returns a provider with the aggregated results of the workload profilings in default:
+// the process 1 of the Deployment web at 300m and percentile 99 aggregated by sum, its process 2 at 100m a minute later,
+// and the process 1 of the StatefulSet db at 2 cores, profiled before the adapter started.
+// The pod web-0 has its own result, which is not served.
+func newExternalTestProvider() *colibriProvider {
+	p := newTestProvider(newTestClient(), DefaultOptions())
+
+	now := time.Now()
+	deployments := schema.GroupResource{Group: "apps", Resource: "deployments"}
+	statefulsets := schema.GroupResource{Group: "apps", Resource: "statefulsets"}
+	for _, result := range []struct {
+		res    schema.GroupResource
+		name   string
+		metric string
+		value  string
+		at     time.Time
+	}{
+		{res: deployments, name: "web", metric: "1-cpu", value: "300m", at: now.Add(-time.Minute)},
+		{res: deployments, name: "web", metric: "1-pert", value: "99", at: now.Add(-time.Minute)},
+		{res: deployments, name: "web", metric: "2-cpu", value: "100m", at: now},
+		{res: statefulsets, name: "db", metric: "1-cpu", value: "2", at: now},
+	} {
+		info := p.workloadInfo(result.res, result.metric)
+		p.values.Add(info, types.NamespacedName{Namespace: "default", Name: result.name}, Sample{Value: resource.MustParse(result.value), Timestamp: result.at})
+	}
+	podInfo := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Metric: "1-cpu", Namespaced: true}
+	p.values.Add(podInfo, types.NamespacedName{Namespace: "default", Name: "web-0"}, Sample{Value: resource.MustParse("5"), Timestamp: now})
+
+	finished := now.Add(-time.Minute)
+	p.workloads.add(workloadRecord{ID: "run", Namespace: "default", Kind: "Deployment", Name: "web", Process: "1",
+		Aggregation: aggregationSum, State: JobSucceeded, FinishedAt: &finished})
+	return p
+}
+
+func TestGetExternalMetric(t *testing.T) {
+	tests := []struct {
+		name           string
+		metric         string
+		namespace      string
+		metricSelector string
+		want           map[string]string
+	}{
+		{name: "latest process of each workload", metric: CPUMetric, namespace: "default", want: map[string]string{"web": "100m", "db": "2"}},
+		{name: "workload kind", metric: CPUMetric, namespace: "default", metricSelector: "workload_kind=statefulset", want: map[string]string{"db": "2"}},
+		{name: "process", metric: CPUMetric, namespace: "default", metricSelector: "process=1", want: map[string]string{"web": "300m", "db": "2"}},
+		{name: "percentile", metric: CPUMetric, namespace: "default", metricSelector: "percentile=99", want: map[string]string{"web": "300m"}},
+		{name: "aggregation of profilings since start", metric: CPUMetric, namespace: "default", metricSelector: "aggregation=sum", want: map[string]string{"web": "300m"}},
+		{name: "no result", metric: MemoryMetric, namespace: "default", want: map[string]string{}},
+		{name: "another namespace", metric: CPUMetric, namespace: "other", want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newExternalTestProvider()
+			metricSelector, err := labels.Parse(tt.metricSelector)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			list, err := p.GetExternalMetric(context.TODO(), tt.namespace, metricSelector, provider.ExternalMetricInfo{Metric: tt.metric})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := make(map[string]string, len(list.Items))
+			for _, item := range list.Items {
+				got[item.MetricLabels[workloadLabel]] = item.Value.String()
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestListAllExternalMetrics(t *testing.T) {
+	infos := newExternalTestProvider().ListAllExternalMetrics()
+	if want := []provider.ExternalMetricInfo{{Metric: CPUMetric}}; !reflect.DeepEqual(infos, want) {
+		t.Errorf("expected %v, got %v", want, infos)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// JobPolicy decides how often colibri is retried for a job, and how long a job waits for its result
+type JobPolicy struct {
+	// Retries is how many times colibri is run again after it failed, the backoffLimit of K8s Jobs
+	Retries int
+	// The default timeout of a job is the expected duration of all tries, freq*iter milliseconds each,
+	// scaled by TimeoutFactor, plus TimeoutSlack for scheduling and pulling images
+	TimeoutFactor float64
+	TimeoutSlack  time.Duration
+}
+
+// DefaultJobPolicy retries a job twice, and waits twice as long as expected plus five minutes
+var DefaultJobPolicy = JobPolicy{
+	Retries:       2,
+	TimeoutFactor: 2,
+	TimeoutSlack:  5 * time.Minute,
+}
+
+// timeoutFor returns how long a job with params waits for its result, the timeout of params if it is set
+func (j JobPolicy) timeoutFor(params *jobParam) time.Duration {
+	if params.Timeout > 0 {
+		return time.Duration(params.Timeout) * time.Second
+	}
+	expected := time.Duration(params.Frequency) * time.Duration(params.Iteration) * time.Millisecond
+	return time.Duration(float64(expected)*j.TimeoutFactor)*time.Duration(j.Retries+1) + j.TimeoutSlack
+}
+
+// expireJob stops colibri of a job which is not finished by its deadline,
+// the job is TimedOut unless it has put its result
+func (p *colibriProvider) expireJob(id string, timeout time.Duration) {
+	record, found := p.jobs.get(id)
+	if !found || record.State.finished() {
+		return
+	}
+
+	record = p.setJobState(id, JobTimedOut, "No result within "+timeout.String())
+	if record.JobName == "" {
+		return
+	}
+	if err := p.runner.Stop(JobRef{Namespace: record.JobNamespace, Name: record.JobName}); err != nil {
+		klog.Errorf("Failed to stop timed out job %s: %v", id, err)
+	}
+}
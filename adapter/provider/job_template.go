@@ -0,0 +1,370 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+)
+
+// DefaultJobImage is the image of colibri the job template is rendered with when no image is given,
+// it is built on the nodes and never pulled by default
+const DefaultJobImage = "gabbro:30500/colibri-job:raw"
+
+// DefaultJobImagePullPolicy is the pull policy of the image of colibri when no pull policy is given
+const DefaultJobImagePullPolicy = corev1.PullNever
+
+// DefaultJobTemplate is the K8s Job running colibri when no template is given.
+// The job runs all metrics types and doesn't keep output files,
+// the result token is passed to colibri by COLIBRI_RESULT_TOKEN.
+const DefaultJobTemplate = `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{ .Name | quote }}
+  namespace: colibri
+spec:
+  template:
+    spec:
+      nodeName: {{ .NodeName | quote }}
+      serviceAccountName: colibri-job
+      restartPolicy: Never
+      volumes:
+      - name: proc-dir
+        hostPath:
+          type: Directory
+          path: /proc
+      - name: cgroup-dir
+        hostPath:
+          type: Directory
+          path: /sys/fs/cgroup
+      containers:
+      - name: cjob
+        image: {{ .Image | quote }}
+        imagePullPolicy: {{ .ImagePullPolicy | quote }}
+        command:
+        - colibri
+{{- if .Process }}
+        - --pid
+        - {{ .Process | quote }}
+{{- else }}
+        - --container
+        - {{ .ContainerID | quote }}
+{{- if .Command }}
+        - --match
+        - {{ .Command | quote }}
+{{- end }}
+{{- end }}
+        - --freq
+        - {{ .Params.Frequency | quote }}
+        - --iter
+        - {{ .Params.Iteration | quote }}
+        - --pert
+        - {{ .Params.Percentile | quote }}
+        - --out
+        - {{ printf "api:%s" .ResultID | quote }}
+        - --mtype
+        - all
+        resources:
+          requests:
+            cpu: 100m
+            memory: 64Mi
+        env:
+        - name: COLIBRI_RESULT_TOKEN
+          valueFrom:
+            secretKeyRef:
+              name: {{ .TokenSecret | quote }}
+              key: token
+        volumeMounts:
+        - mountPath: /tmp/proc
+          name: proc-dir
+        - mountPath: /tmp/cgroup
+          name: cgroup-dir
+`
+
+// The values a job template is rendered with
+type jobTemplateData struct {
+	// Name of the K8s Job, unique for every job
+	Name string
+	// ID of the job record
+	JobID string
+	// NodeName is the node of the targeted pod
+	NodeName  string
+	Namespace string
+	Pod       string
+	// Process is empty when the process is targeted by its container,
+	// then colibri discovers it in the container of ContainerID by matching Command
+	Process     string
+	Container   string
+	ContainerID string
+	Command     string
+	Params      jobParam
+	// ResultID is the path the job puts its result to, colibri appends .<processId> if Process is empty
+	ResultID string
+	// TokenSecret is the Secret in the namespace of Job, keeping the result token under key "token"
+	TokenSecret string
+	// Image is the image of colibri given to the template, and ImagePullPolicy its pull policy
+	Image           string
+	ImagePullPolicy corev1.PullPolicy
+}
+
+// TemplateSource returns the text of a job template
+type TemplateSource func() (string, error)
+
+// DefaultTemplateSource always returns DefaultJobTemplate
+func DefaultTemplateSource() TemplateSource {
+	return func() (string, error) {
+		return DefaultJobTemplate, nil
+	}
+}
+
+// FileTemplateSource reads a job template from a file, e.g. a mounted ConfigMap
+func FileTemplateSource(path string) TemplateSource {
+	return func() (string, error) {
+		data, err := os.ReadFile(path)
+		return string(data), err
+	}
+}
+
+// ConfigMapTemplateSource reads a job template from the key of a ConfigMap
+func ConfigMapTemplateSource(client dynamic.Interface, namespace string, name string, key string) TemplateSource {
+	return func() (string, error) {
+		res := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "configmaps"}
+		cm, err := client.Resource(res).Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		text, found, err := unstructured.NestedString(cm.Object, "data", key)
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			return "", fmt.Errorf("key %q is not found in ConfigMap %s/%s", key, namespace, name)
+		}
+		return text, nil
+	}
+}
+
+// JobTemplate renders the K8s Jobs running colibri, safe for concurrent use
+type JobTemplate struct {
+	source     TemplateSource
+	image      string
+	pullPolicy corev1.PullPolicy
+
+	mu   sync.RWMutex
+	text string
+	tmpl *template.Template
+}
+
+// NewJobTemplate loads and validates the template from source, which is rendered with the image of colibri
+// and its pull policy, DefaultJobImage and DefaultJobImagePullPolicy if they are empty
+func NewJobTemplate(source TemplateSource, image string, pullPolicy corev1.PullPolicy) (*JobTemplate, error) {
+	if image == "" {
+		image = DefaultJobImage
+	}
+	switch pullPolicy {
+	case "":
+		pullPolicy = DefaultJobImagePullPolicy
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+	default:
+		return nil, fmt.Errorf("invalid image pull policy %q: must be Always, IfNotPresent or Never", pullPolicy)
+	}
+	t := &JobTemplate{source: source, image: image, pullPolicy: pullPolicy}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload loads the template from source again, the current template is kept if the new one is invalid
+func (t *JobTemplate) Reload() error {
+	text, err := t.source()
+	if err != nil {
+		return err
+	}
+
+	t.mu.RLock()
+	unchanged := t.tmpl != nil && text == t.text
+	t.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	tmpl, err := parseJobTemplate(text)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.text = text
+	t.tmpl = tmpl
+	klog.Infof("Loaded job template")
+
+	return nil
+}
+
+// Run reloads the template every interval until stopCh is closed
+func (t *JobTemplate) Run(interval time.Duration, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := t.Reload(); err != nil {
+			klog.Errorf("Failed to reload job template, keep using the current one: %s", err)
+		}
+	}, interval, stopCh)
+}
+
+func (t *JobTemplate) render(data jobTemplateData) (*unstructured.Unstructured, error) {
+	t.mu.RLock()
+	tmpl := t.tmpl
+	t.mu.RUnlock()
+
+	data.Image = t.image
+	data.ImagePullPolicy = t.pullPolicy
+	return renderJob(tmpl, data)
+}
+
+// the values a job template is validated with, for a process targeted by its ID
+var exampleTemplateData = jobTemplateData{
+	Name:            "example-26386-colibri-00000000",
+	JobID:           "00000000-0000-0000-0000-000000000000",
+	NodeName:        "example-node",
+	Namespace:       "default",
+	Pod:             "example",
+	Process:         "26386",
+	Params:          jobParam{Frequency: 10, Iteration: 1000, Percentile: 99},
+	ResultID:        "default.example.26386",
+	TokenSecret:     "colibri-result-00000000-0000-0000-0000-000000000000",
+	Image:           DefaultJobImage,
+	ImagePullPolicy: DefaultJobImagePullPolicy,
+}
+
+// the values a job template is validated with, for a process discovered in its container
+var exampleContainerTemplateData = jobTemplateData{
+	Name:            "example-server-colibri-00000000",
+	JobID:           "00000000-0000-0000-0000-000000000000",
+	NodeName:        "example-node",
+	Namespace:       "default",
+	Pod:             "example",
+	Container:       "server",
+	ContainerID:     "containerd://0000000000000000000000000000000000000000000000000000000000000000",
+	Command:         "server",
+	Params:          jobParam{Frequency: 10, Iteration: 1000, Percentile: 99},
+	ResultID:        "default.example",
+	TokenSecret:     "colibri-result-00000000-0000-0000-0000-000000000000",
+	Image:           DefaultJobImage,
+	ImagePullPolicy: DefaultJobImagePullPolicy,
+}
+
+// tolerations returns the tolerations of the pods of the jobs rendered by the template
+func (t *JobTemplate) tolerations() ([]corev1.Toleration, error) {
+	job, err := t.render(exampleTemplateData)
+	if err != nil {
+		return nil, err
+	}
+	list, _, err := unstructured.NestedSlice(job.Object, "spec", "template", "spec", "tolerations")
+	if err != nil {
+		return nil, err
+	}
+
+	tolerations := make([]corev1.Toleration, len(list))
+	for i, item := range list {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid toleration in job template: %v", item)
+		}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj, &tolerations[i]); err != nil {
+			return nil, err
+		}
+	}
+	return tolerations, nil
+}
+
+func parseJobTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("job").
+		Funcs(template.FuncMap{"quote": quote}).
+		Option("missingkey=error").
+		Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	// validate by rendering with example values, of both ways to target a process
+	for _, data := range []jobTemplateData{exampleTemplateData, exampleContainerTemplateData} {
+		if _, err := renderJob(tmpl, data); err != nil {
+			return nil, fmt.Errorf("invalid job template: %s", err)
+		}
+	}
+	return tmpl, nil
+}
+
+func renderJob(tmpl *template.Template, data jobTemplateData) (*unstructured.Unstructured, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+
+	job := &unstructured.Unstructured{}
+	if err := yaml.NewYAMLOrJSONDecoder(&buf, buf.Len()).Decode(&job.Object); err != nil {
+		return nil, err
+	}
+	if job.GetAPIVersion() != "batch/v1" || job.GetKind() != "Job" {
+		return nil, fmt.Errorf("expected a batch/v1 Job, got %s %s", job.GetAPIVersion(), job.GetKind())
+	}
+	containers, _, err := unstructured.NestedSlice(job.Object, "spec", "template", "spec", "containers")
+	if err != nil {
+		return nil, err
+	}
+	if len(containers) == 0 {
+		return nil, fmt.Errorf("no container in the pod template of Job")
+	}
+
+	if job.GetName() == "" {
+		job.SetName(data.Name)
+	}
+	if job.GetNamespace() == "" {
+		job.SetNamespace("colibri")
+	}
+	// records of provider are linked to their K8s Jobs by this label
+	labels := job.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[jobIDLabel] = data.JobID
+	job.SetLabels(labels)
+
+	return job, nil
+}
+
+// quote makes a YAML string of any value
+func quote(value interface{}) string {
+	return strconv.Quote(fmt.Sprint(value))
+}
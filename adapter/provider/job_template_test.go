@@ -0,0 +1,112 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestDefaultJobTemplate(t *testing.T) {
+	tests := []struct {
+		name       string
+		image      string
+		pullPolicy corev1.PullPolicy
+		data       jobTemplateData
+		want       string
+		wantPolicy corev1.PullPolicy
+		command    []interface{}
+	}{
+		{name: "process", data: exampleTemplateData, want: "gabbro:30500/colibri-job:raw", wantPolicy: corev1.PullNever,
+			command: []interface{}{"colibri", "--pid", "26386", "--freq", "10", "--iter", "1000", "--pert", "99", "--out", "api:default.example.26386", "--mtype", "all"}},
+		{name: "container", image: "registry.example.com/colibri-job:v1", pullPolicy: corev1.PullIfNotPresent, data: exampleContainerTemplateData,
+			want: "registry.example.com/colibri-job:v1", wantPolicy: corev1.PullIfNotPresent,
+			command: []interface{}{"colibri", "--container", exampleContainerTemplateData.ContainerID, "--match", "server",
+				"--freq", "10", "--iter", "1000", "--pert", "99", "--out", "api:default.example", "--mtype", "all"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobTemplate, err := NewJobTemplate(DefaultTemplateSource(), tt.image, tt.pullPolicy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			job, err := jobTemplate.render(tt.data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			containers, _, _ := unstructured.NestedSlice(job.Object, "spec", "template", "spec", "containers")
+			if len(containers) != 1 {
+				t.Fatalf("expected a container, got %v", containers)
+			}
+			container := containers[0].(map[string]interface{})
+			if container["image"] != tt.want || container["imagePullPolicy"] != string(tt.wantPolicy) {
+				t.Errorf("expected image %s pulled by %s, got %v %v", tt.want, tt.wantPolicy, container["image"], container["imagePullPolicy"])
+			}
+			if requests, _, _ := unstructured.NestedStringMap(container, "resources", "requests"); requests["cpu"] == "" || requests["memory"] == "" {
+				t.Errorf("expected cpu and memory requested, got %v", requests)
+			}
+			if !reflect.DeepEqual(container["command"], tt.command) {
+				t.Errorf("expected command %v, got %v", tt.command, container["command"])
+			}
+			if job.GetLabels()[jobIDLabel] != tt.data.JobID {
+				t.Errorf("expected %s labeled, got %v", jobIDLabel, job.GetLabels())
+			}
+		})
+	}
+
+	if _, err := NewJobTemplate(DefaultTemplateSource(), "", "Sometimes"); err == nil {
+		t.Errorf("expected an invalid pull policy rejected")
+	}
+}
+
+func TestParseJobTemplate(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		valid bool
+	}{
+		{name: "default", text: DefaultJobTemplate, valid: true},
+		{name: "not a Job", text: "apiVersion: v1\nkind: Pod\n"},
+		{name: "unknown value", text: "apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: {{ .Unknown }}\n"},
+		{name: "no container for a process targeted by its container", text: `apiVersion: batch/v1
+kind: Job
+spec:
+  template:
+    spec:
+{{- if .Process }}
+      containers:
+      - name: cjob
+        image: {{ .Image | quote }}
+        command: ["colibri", "--pid", {{ .Process | quote }}]
+{{- end }}
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseJobTemplate(tt.text)
+			if tt.valid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("expected the template to be rejected")
+			}
+		})
+	}
+}
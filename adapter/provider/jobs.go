@@ -0,0 +1,306 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// JobState is the state of a colibri job
+type JobState string
+
+const (
+	JobPending   JobState = "Pending"
+	JobRunning   JobState = "Running"
+	JobSucceeded JobState = "Succeeded"
+	JobFailed    JobState = "Failed"
+	JobTimedOut  JobState = "TimedOut"
+	JobCancelled JobState = "Cancelled"
+)
+
+// finished jobs never change their state again
+func (s JobState) finished() bool {
+	return s == JobSucceeded || s == JobFailed || s == JobTimedOut || s == JobCancelled
+}
+
+// The record of a colibri job launched by runJob
+type jobRecord struct {
+	ID           string     `json:"id" description:"ID of the job"`
+	Namespace    string     `json:"namespace" description:"namespace of the targeted pod"`
+	Pod          string     `json:"pod" description:"targeted pod"`
+	Process      string     `json:"process" description:"targeted process ID, resolved by colibri when the process is targeted by its container"`
+	Container    string     `json:"container,omitempty" description:"container of the targeted process, if it is known"`
+	Command      string     `json:"command,omitempty" description:"regular expression matching the command line of the targeted process"`
+	Params       jobParam   `json:"params" description:"parameters of the job"`
+	JobName      string     `json:"jobName,omitempty" description:"name of the K8s Job (or local process) running colibri"`
+	JobNamespace string     `json:"jobNamespace,omitempty" description:"namespace of the K8s Job running colibri"`
+	State        JobState   `json:"state" description:"Pending, Running, Succeeded, Failed, TimedOut or Cancelled"`
+	Reason       string     `json:"reason,omitempty" description:"why the job is failed or still pending"`
+	CreatedAt    time.Time  `json:"createdAt" description:"time the job is requested"`
+	StartedAt    *time.Time `json:"startedAt,omitempty" description:"time the job is running"`
+	FinishedAt   *time.Time `json:"finishedAt,omitempty" description:"time the job is finished"`
+	Deadline     *time.Time `json:"deadline,omitempty" description:"time the job is TimedOut if it has not put its result"`
+
+	// hash of the result token of job, nil once a result is put or the job is finished
+	tokenHash []byte
+	// the job has put its result
+	resultPut bool
+	// the process is targeted by its container, and Process is set by the result of colibri
+	resolveProcess bool
+}
+
+// jobTarget is the process a job profiles, by its ID, or by its container leaving colibri to discover its ID
+type jobTarget struct {
+	Process string
+	// Container is the name of the container, ContainerID is its runtime ID, e.g. containerd://<id>
+	Container   string
+	ContainerID string
+	// Command matches the command line of the process, the main process of the container if empty
+	Command string
+}
+
+// jobTracker keeps the records of all jobs, safe for concurrent use
+type jobTracker struct {
+	mu   sync.RWMutex
+	jobs map[string]*jobRecord
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{
+		jobs: make(map[string]*jobRecord),
+	}
+}
+
+// add keeps a new record, it returns false if the ID is already taken
+func (t *jobTracker) add(record jobRecord) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, found := t.jobs[record.ID]; found {
+		return false
+	}
+	t.jobs[record.ID] = &record
+	return true
+}
+
+func (t *jobTracker) remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.jobs, id)
+}
+
+func (t *jobTracker) get(id string) (jobRecord, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	record, found := t.jobs[id]
+	if !found {
+		return jobRecord{}, false
+	}
+	return *record, true
+}
+
+// list returns the records matching filter, oldest first
+func (t *jobTracker) list(filter func(*jobRecord) bool) []jobRecord {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	records := make([]jobRecord, 0, len(t.jobs))
+	for _, record := range t.jobs {
+		if filter(record) {
+			records = append(records, *record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+	return records
+}
+
+// update modifies a record which is not finished yet, and returns the updated record
+func (t *jobTracker) update(id string, fn func(*jobRecord)) (jobRecord, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	record, found := t.jobs[id]
+	if !found {
+		return jobRecord{}, false
+	}
+	if !record.State.finished() {
+		fn(record)
+	}
+	return *record, true
+}
+
+// setState moves a job to state, filling the timestamps of the transition.
+// A job is only Succeeded if it has put its result, and never TimedOut after it.
+// It returns whether the job is finished by this transition, a finished job never moves again.
+func (t *jobTracker) setState(id string, state JobState, reason string) (jobRecord, bool) {
+	finished := false
+	record, _ := t.update(id, func(r *jobRecord) {
+		switch {
+		case state == JobSucceeded && !r.resultPut:
+			state, reason = JobFailed, "Colibri finished without putting a result"
+		case state == JobTimedOut && r.resultPut:
+			state, reason = JobSucceeded, "Stopped after putting its result: "+reason
+		}
+
+		now := time.Now()
+		if state != JobPending && r.StartedAt == nil {
+			r.StartedAt = &now
+		}
+		if state.finished() {
+			r.FinishedAt = &now
+			r.tokenHash = nil
+			finished = true
+		}
+		if r.State != state {
+			klog.Infof("Job %s is %s", r.ID, state)
+		}
+		r.State = state
+		r.Reason = reason
+	})
+	return record, finished
+}
+
+// startJob stores the parameters of a job and runs colibri for it.
+// The parameters and the target are validated by the caller, the placement of the job is checked here.
+// When the process is targeted by its container, the parameters are stored once colibri puts the result with the process ID.
+func (p *colibriProvider) startJob(pod *unstructured.Unstructured, ns string, pname string, target jobTarget, params *jobParam, id string) (jobRecord, error) {
+	node, err := p.checkPlacement(pod)
+	if err != nil {
+		return jobRecord{}, err
+	}
+
+	container := target.Container
+	if container == "" {
+		container = onlyContainer(pod)
+	}
+
+	now := time.Now()
+	timeout := p.policy.timeoutFor(params)
+	deadline := now.Add(timeout)
+	record := jobRecord{
+		ID:             id,
+		Namespace:      ns,
+		Pod:            pname,
+		Process:        target.Process,
+		Container:      container,
+		Command:        target.Command,
+		Params:         *params,
+		State:          JobPending,
+		CreatedAt:      now,
+		Deadline:       &deadline,
+		resolveProcess: target.Process == "",
+	}
+	if !p.jobs.add(record) {
+		return jobRecord{}, apierr.NewAlreadyExists(schema.GroupResource{Resource: "jobs"}, id)
+	}
+
+	if target.Process != "" {
+		p.putParams(ns, pname, target.Process, params, now)
+	}
+
+	ref, err := p.runColibriJob(node, params, timeout, ns, pname, target, record.ID)
+	if err != nil {
+		p.setJobState(record.ID, JobFailed, "Failed to create job: "+err.Error())
+		return jobRecord{}, err
+	}
+	record, _ = p.jobs.update(record.ID, func(r *jobRecord) {
+		r.JobName = ref.Name
+		r.JobNamespace = ref.Namespace
+	})
+	time.AfterFunc(timeout, func() {
+		p.expireJob(record.ID, timeout)
+	})
+
+	return record, nil
+}
+
+// putParams stores the parameters of a job of a process, at the time the job is requested
+func (p *colibriProvider) putParams(ns string, pname string, pid string, params *jobParam, timestamp time.Time) {
+	namespacedName := types.NamespacedName{
+		Name:      pname,
+		Namespace: ns,
+	}
+
+	freqInfo := p.infoWrapper(pid+"-freq", namespacedName)
+	p.values.Add(freqInfo.CustomMetricInfo, freqInfo.NamespacedName, Sample{Value: *resource.NewQuantity(int64(params.Frequency), resource.DecimalSI), Timestamp: timestamp})
+
+	iterInfo := p.infoWrapper(pid+"-iter", namespacedName)
+	p.values.Add(iterInfo.CustomMetricInfo, iterInfo.NamespacedName, Sample{Value: *resource.NewQuantity(int64(params.Iteration), resource.DecimalSI), Timestamp: timestamp})
+
+	pertInfo := p.infoWrapper(pid+"-pert", namespacedName)
+	p.values.Add(pertInfo.CustomMetricInfo, pertInfo.NamespacedName, Sample{Value: *resource.NewQuantity(int64(params.Percentile), resource.DecimalSI), Timestamp: timestamp})
+}
+
+// the container of a process is known when its pod has only one container
+func onlyContainer(pod *unstructured.Unstructured) string {
+	containers, _, _ := unstructured.NestedSlice(pod.Object, "spec", "containers")
+	if len(containers) != 1 {
+		return ""
+	}
+	container, _ := containers[0].(map[string]interface{})
+	name, _ := container["name"].(string)
+	return name
+}
+
+// removeParams removes the parameters stored for a job,
+// a process targeted by its container has no parameters stored before its result
+func (p *colibriProvider) removeParams(record jobRecord) {
+	if record.Process == "" {
+		return
+	}
+	namespacedName := types.NamespacedName{Name: record.Pod, Namespace: record.Namespace}
+	for _, key := range []string{"-freq", "-iter", "-pert"} {
+		info := p.infoWrapper(record.Process+key, namespacedName)
+		p.values.DeleteSample(info.CustomMetricInfo, info.NamespacedName, record.CreatedAt)
+	}
+}
+
+// cancelJob stops a job which is not finished yet:
+// the K8s Job is deleted and the parameters stored for the job are removed by setJobState
+func (p *colibriProvider) cancelJob(id string) (jobRecord, error) {
+	record, found := p.jobs.get(id)
+	if !found {
+		return jobRecord{}, apierr.NewNotFound(schema.GroupResource{Resource: "jobs"}, id)
+	}
+	// a cancelled job can be cancelled again, in case deleting the K8s Job failed
+	if record.State.finished() && record.State != JobCancelled {
+		return record, apierr.NewConflict(schema.GroupResource{Resource: "jobs"}, id, errors.New("job is already "+string(record.State)))
+	}
+
+	// mark the job first, so stopping is not taken as a failure
+	record = p.setJobState(id, JobCancelled, "Cancelled by request")
+	klog.Infof("Cancel job %s", id)
+
+	if record.JobName == "" {
+		return record, nil
+	}
+	return record, p.runner.Stop(JobRef{Namespace: record.JobNamespace, Name: record.JobName})
+}
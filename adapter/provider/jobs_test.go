@@ -0,0 +1,200 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// newJobTestProvider returns a provider running jobs by runner, with the job "job" started for the process 1
+// of the running pod default/web-0 and its started container "server"
+func newJobTestProvider(t *testing.T, runner *countingRunner) *colibriProvider {
+	pod := newTestObject("v1", "Pod", "default", "web-0", map[string]interface{}{
+		"nodeName":   "node-1",
+		"containers": []interface{}{map[string]interface{}{"name": "server"}},
+	})
+	if err := unstructured.SetNestedField(pod.Object, "Running", "status", "phase"); err != nil {
+		t.Fatal(err)
+	}
+	statuses := []interface{}{map[string]interface{}{"name": "server", "containerID": "containerd://server"}}
+	if err := unstructured.SetNestedSlice(pod.Object, statuses, "status", "containerStatuses"); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.Runner = runner
+	p := newTestProvider(newTestClient(newTestObject("v1", "Namespace", "", "default", nil), pod), opts)
+
+	params := &jobParam{Frequency: 10, Iteration: 1000, Percentile: 99}
+	if _, err := p.startJob(pod, "default", "web-0", jobTarget{Process: "1"}, params, "job"); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// paramsStored returns whether the parameters of the process 1 of default/web-0 are stored
+func paramsStored(p *colibriProvider) bool {
+	info := p.infoWrapper("1-freq", types.NamespacedName{Namespace: "default", Name: "web-0"})
+	_, found := p.values.Get(info.CustomMetricInfo, info.NamespacedName)
+	return found
+}
+
+func TestFinishJob(t *testing.T) {
+	tests := []struct {
+		name      string
+		resultPut bool
+		finish    func(p *colibriProvider) (jobRecord, error)
+		state     JobState
+		params    bool
+		stopped   bool
+	}{
+		{name: "timed out", finish: func(p *colibriProvider) (jobRecord, error) {
+			p.expireJob("job", time.Minute)
+			record, _ := p.jobs.get("job")
+			return record, nil
+		}, state: JobTimedOut, stopped: true},
+		{name: "timed out after its result", resultPut: true, finish: func(p *colibriProvider) (jobRecord, error) {
+			p.expireJob("job", time.Minute)
+			record, _ := p.jobs.get("job")
+			return record, nil
+		}, state: JobSucceeded, params: true, stopped: true},
+		{name: "cancelled", finish: func(p *colibriProvider) (jobRecord, error) {
+			return p.cancelJob("job")
+		}, state: JobCancelled, stopped: true},
+		{name: "cancelled after its result", resultPut: true, finish: func(p *colibriProvider) (jobRecord, error) {
+			return p.cancelJob("job")
+		}, state: JobCancelled, stopped: true},
+		{name: "failed", finish: func(p *colibriProvider) (jobRecord, error) {
+			return p.setJobState("job", JobFailed, "BackoffLimitExceeded"), nil
+		}, state: JobFailed},
+		{name: "succeeded", resultPut: true, finish: func(p *colibriProvider) (jobRecord, error) {
+			return p.setJobState("job", JobSucceeded, ""), nil
+		}, state: JobSucceeded, params: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &countingRunner{runs: map[string]int{}}
+			p := newJobTestProvider(t, runner)
+			if !paramsStored(p) {
+				t.Fatalf("expected the parameters stored when the job is started")
+			}
+			if tt.resultPut {
+				p.jobs.update("job", func(r *jobRecord) {
+					r.resultPut = true
+				})
+			}
+
+			record, err := tt.finish(p)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if record.State != tt.state || record.FinishedAt == nil {
+				t.Errorf("expected the job finished as %s, got %s at %v", tt.state, record.State, record.FinishedAt)
+			}
+			if got := paramsStored(p); got != tt.params {
+				t.Errorf("expected parameters stored %v, got %v", tt.params, got)
+			}
+			if got := len(runner.stopped) > 0; got != tt.stopped {
+				t.Errorf("expected stopped %v, got %v", tt.stopped, runner.stopped)
+			}
+
+			// the parameters put again for the job, e.g. with its result, are not removed by reports after it is finished
+			p.putParams("default", "web-0", "1", &record.Params, record.CreatedAt)
+			p.setJobState("job", JobFailed, "DeadlineExceeded")
+			p.expireJob("job", time.Minute)
+			if got, _ := p.jobs.get("job"); got.State != tt.state || !reflect.DeepEqual(got.FinishedAt, record.FinishedAt) {
+				t.Errorf("expected the finished job unchanged, got %s at %v", got.State, got.FinishedAt)
+			}
+			if !paramsStored(p) {
+				t.Errorf("expected the parameters put again for the job kept")
+			}
+		})
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	runner := &countingRunner{runs: map[string]int{}}
+	p := newJobTestProvider(t, runner)
+
+	if _, err := p.cancelJob("unknown"); !apierr.IsNotFound(err) {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+	if _, err := p.cancelJob("job"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// a cancelled job can be cancelled again, in case stopping it failed
+	if _, err := p.cancelJob("job"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(runner.stopped) != 2 {
+		t.Errorf("expected the job stopped twice, got %v", runner.stopped)
+	}
+
+	p = newJobTestProvider(t, &countingRunner{runs: map[string]int{}})
+	p.setJobState("job", JobFailed, "BackoffLimitExceeded")
+	if _, err := p.cancelJob("job"); !apierr.IsConflict(err) {
+		t.Errorf("expected Conflict for a failed job, got %v", err)
+	}
+}
+
+func TestCancelRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		code   int
+		cancel bool
+	}{
+		{name: "job", path: "/colibri/jobs/job", code: http.StatusOK, cancel: true},
+		{name: "unknown job", path: "/colibri/jobs/unknown", code: http.StatusNotFound},
+		{name: "jobs of the process", path: "/colibri/default/web-0/1", code: http.StatusOK, cancel: true},
+		{name: "no job of the process", path: "/colibri/default/web-0/2", code: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &countingRunner{runs: map[string]int{}}
+			p := newJobTestProvider(t, runner)
+
+			recorder := serveRequest(p, http.MethodDelete, tt.path, "")
+			if recorder.Code != tt.code {
+				t.Fatalf("expected %d, got %d: %s", tt.code, recorder.Code, recorder.Body.String())
+			}
+			record, _ := p.jobs.get("job")
+			if got := record.State == JobCancelled; got != tt.cancel {
+				t.Errorf("expected cancelled %v, got %s", tt.cancel, record.State)
+			}
+			if got := len(runner.stopped) == 1; got != tt.cancel {
+				t.Errorf("expected stopped %v, got %v", tt.cancel, runner.stopped)
+			}
+		})
+	}
+
+	// a finished job is not cancelled
+	p := newJobTestProvider(t, &countingRunner{runs: map[string]int{}})
+	p.setJobState("job", JobSucceeded, "")
+	if recorder := serveRequest(p, http.MethodDelete, "/colibri/jobs/job", ""); recorder.Code != http.StatusConflict {
+		t.Errorf("expected %d for a finished job, got %d", http.StatusConflict, recorder.Code)
+	}
+	if recorder := serveRequest(p, http.MethodDelete, "/colibri/default/web-0/1", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("expected %d for a process without running jobs, got %d", http.StatusNotFound, recorder.Code)
+	}
+}
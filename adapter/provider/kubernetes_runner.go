@@ -0,0 +1,555 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"math"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+)
+
+// label of K8s Jobs, linking them to the records of provider
+const jobIDLabel = "colibri.io/job-id"
+
+// ownerUIDLabel and ownerAnnotation (namespace/name) of K8s Jobs identify the owner of cleanup of the adapter running them,
+// the Jobs of an adapter whose owner is removed are orphans
+const (
+	ownerUIDLabel   = "colibri.io/owner-uid"
+	ownerAnnotation = "colibri.io/owner"
+)
+
+// K8s Job names are also pod labels, so they are bound by the length of a label value
+const maxJobNameLength = 63
+
+// JobCleanup decides how the K8s Jobs running colibri are cleaned up
+type JobCleanup struct {
+	// TTLSecondsAfterFinished is set to the Jobs not setting it in the job template,
+	// finished Jobs are deleted with their pods after it. Negative keeps finished Jobs.
+	TTLSecondsAfterFinished int
+	// Owner, usually the pod of the adapter keeping the job records, is set as the owner of the Jobs
+	// in OwnerNamespace, so they are garbage collected with it. Nil sets no owner.
+	Owner          *metav1.OwnerReference
+	OwnerNamespace string
+}
+
+// DefaultJobCleanup deletes finished Jobs after an hour
+var DefaultJobCleanup = JobCleanup{TTLSecondsAfterFinished: 3600}
+
+// kubernetesRunner runs colibri as K8s Jobs on the node of the targeted pod
+type kubernetesRunner struct {
+	client      dynamic.Interface
+	jobTemplate *JobTemplate
+	cleanup     JobCleanup
+}
+
+func NewKubernetesRunner(client dynamic.Interface, jobTemplate *JobTemplate, cleanup JobCleanup) JobRunner {
+	return &kubernetesRunner{
+		client:      client,
+		jobTemplate: jobTemplate,
+		cleanup:     cleanup,
+	}
+}
+
+// jobName is unique for every job, so a target is profiled again while the Jobs of its former jobs are kept
+func jobName(spec JobSpec) string {
+	target := spec.Process
+	if target == "" {
+		target = spec.Container
+	}
+	// the name of a ProfilingJob is its ID, its prefix may end with a separator
+	id := spec.ID
+	if len(id) > 8 {
+		id = strings.TrimRight(id[:8], "-.")
+	}
+	suffix := "-colibri-" + id
+
+	prefix := spec.Pod + "-" + target
+	if len(prefix) > maxJobNameLength-len(suffix) {
+		prefix = strings.TrimRight(prefix[:maxJobNameLength-len(suffix)], "-.")
+	}
+	return prefix + suffix
+}
+
+// the pods of K8s Jobs are placed on the node of the targeted pod with the tolerations of the job template
+func (r *kubernetesRunner) Tolerations() ([]corev1.Toleration, error) {
+	return r.jobTemplate.tolerations()
+}
+
+// create the K8s Job running colibri, rendered from the job template
+func (r *kubernetesRunner) Run(spec JobSpec, report JobReporter) (JobRef, error) {
+	klog.Infof("Creating Job...")
+
+	job, err := r.jobTemplate.render(jobTemplateData{
+		Name:        jobName(spec),
+		JobID:       spec.ID,
+		NodeName:    spec.NodeName,
+		Namespace:   spec.Namespace,
+		Pod:         spec.Pod,
+		Process:     spec.Process,
+		Container:   spec.Container,
+		ContainerID: spec.ContainerID,
+		Command:     spec.Command,
+		Params: jobParam{
+			Frequency:  spec.Frequency,
+			Iteration:  spec.Iteration,
+			Percentile: spec.Percentile,
+		},
+		ResultID:    spec.ResultID,
+		TokenSecret: tokenSecretName(spec.ID),
+	})
+	if err != nil {
+		klog.Errorf("Failed to render job: %s", err)
+		return JobRef{}, err
+	}
+	if err := setLimits(job, spec); err != nil {
+		return JobRef{}, err
+	}
+	if err := r.setCleanup(job); err != nil {
+		return JobRef{}, err
+	}
+
+	secret, err := r.createTokenSecret(job.GetNamespace(), spec)
+	if err != nil {
+		klog.Errorf("Failed to create secret of result token: %s", err)
+		return JobRef{}, err
+	}
+
+	jobResource := schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+	result, err := r.client.Resource(jobResource).Namespace(job.GetNamespace()).Create(context.TODO(), job, metav1.CreateOptions{})
+	if err != nil {
+		klog.Errorf("Failed to create job: %s", err)
+		r.deleteTokenSecret(secret)
+		return JobRef{}, err
+	}
+	klog.Infof("Created job %q", result.GetName())
+
+	// the secret is garbage collected with the K8s Job
+	r.ownTokenSecret(secret, result)
+
+	ref := JobRef{Namespace: result.GetNamespace(), Name: result.GetName()}
+	go r.watch(ref, report)
+
+	return ref, nil
+}
+
+// setLimits sets the retries and the timeout of a job to its K8s Job, unless the job template sets them
+func setLimits(job *unstructured.Unstructured, spec JobSpec) error {
+	deadline := int64(math.Ceil(spec.Timeout.Seconds()))
+	for field, value := range map[string]int64{
+		"backoffLimit":          int64(spec.Retries),
+		"activeDeadlineSeconds": deadline,
+	} {
+		_, found, err := unstructured.NestedFieldNoCopy(job.Object, "spec", field)
+		if err != nil {
+			return err
+		}
+		// a job without timeout runs without deadline
+		if found || (field == "activeDeadlineSeconds" && value <= 0) {
+			continue
+		}
+		if err := unstructured.SetNestedField(job.Object, value, "spec", field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setCleanup sets the TTL after finished, unless the job template sets it, and the owner of job
+func (r *kubernetesRunner) setCleanup(job *unstructured.Unstructured) error {
+	_, found, err := unstructured.NestedFieldNoCopy(job.Object, "spec", "ttlSecondsAfterFinished")
+	if err != nil {
+		return err
+	}
+	if !found && r.cleanup.TTLSecondsAfterFinished >= 0 {
+		if err := unstructured.SetNestedField(job.Object, int64(r.cleanup.TTLSecondsAfterFinished), "spec", "ttlSecondsAfterFinished"); err != nil {
+			return err
+		}
+	}
+
+	if r.cleanup.Owner == nil {
+		return nil
+	}
+	// Jobs in every namespace are identified by the owner, for collecting them once it is removed
+	labels := job.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[ownerUIDLabel] = string(r.cleanup.Owner.UID)
+	job.SetLabels(labels)
+	annotations := job.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[ownerAnnotation] = r.cleanup.OwnerNamespace + "/" + r.cleanup.Owner.Name
+	job.SetAnnotations(annotations)
+
+	// an owner in another namespace is regarded as absent, and would get the Job deleted at once
+	if job.GetNamespace() != r.cleanup.OwnerNamespace {
+		klog.V(1).Infof("Job %q is not owned by %s %q in another namespace", job.GetName(), r.cleanup.Owner.Kind, r.cleanup.Owner.Name)
+		return nil
+	}
+	job.SetOwnerReferences(append(job.GetOwnerReferences(), *r.cleanup.Owner))
+	return nil
+}
+
+// CollectOrphans deletes the K8s Jobs of the adapters whose owners of cleanup are removed, together with their pods.
+// The records are not kept over restarts, so the results of these Jobs would be rejected.
+// It is called on startup before any job is run, so the Jobs of this owner are left by a restarted container and
+// deleted too. Jobs of other adapters still running, e.g. other replicas, and of adapters without owners are kept.
+// Nothing is collected if this adapter has no owner, as its own Jobs could not be told from the others.
+func (r *kubernetesRunner) CollectOrphans() error {
+	if r.cleanup.Owner == nil {
+		klog.Infof("Orphaned jobs are not collected: the adapter has no owner")
+		return nil
+	}
+
+	jobResource := schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+	list, err := r.client.Resource(jobResource).Namespace(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: jobIDLabel + "," + ownerUIDLabel,
+	})
+	if err != nil {
+		return err
+	}
+
+	propagation := metav1.DeletePropagationBackground
+	alive := map[string]bool{string(r.cleanup.Owner.UID): false}
+	for _, job := range list.Items {
+		uid := job.GetLabels()[ownerUIDLabel]
+		if _, checked := alive[uid]; !checked {
+			running, err := r.ownerRunning(uid, job.GetAnnotations()[ownerAnnotation])
+			if err != nil {
+				return err
+			}
+			alive[uid] = running
+		}
+		if alive[uid] {
+			continue
+		}
+		err := r.client.Resource(jobResource).Namespace(job.GetNamespace()).Delete(context.TODO(), job.GetName(), metav1.DeleteOptions{
+			PropagationPolicy: &propagation,
+		})
+		if err != nil && !apierr.IsNotFound(err) {
+			return err
+		}
+		klog.Infof("Deleted orphaned job %s/%s", job.GetNamespace(), job.GetName())
+	}
+	return nil
+}
+
+// ownerRunning tells whether the owner pod of the Jobs of an adapter, namespace/name, still exists with its UID
+func (r *kubernetesRunner) ownerRunning(uid string, owner string) (bool, error) {
+	parts := strings.SplitN(owner, "/", 2)
+	if len(parts) != 2 {
+		// the owner cannot be checked, the Jobs are kept
+		return true, nil
+	}
+	podResource := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+	pod, err := r.client.Resource(podResource).Namespace(parts[0]).Get(context.TODO(), parts[1], metav1.GetOptions{})
+	if apierr.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return string(pod.GetUID()) == uid, nil
+}
+
+func tokenSecretName(jobID string) string {
+	return "colibri-result-" + jobID
+}
+
+// createTokenSecret keeps the result token of job in a Secret, for the K8s Job to read it
+func (r *kubernetesRunner) createTokenSecret(namespace string, spec JobSpec) (*unstructured.Unstructured, error) {
+	secret := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]interface{}{
+			"name":      tokenSecretName(spec.ID),
+			"namespace": namespace,
+			"labels": map[string]interface{}{
+				jobIDLabel: spec.ID,
+			},
+		},
+		"type": "Opaque",
+		"stringData": map[string]interface{}{
+			"token": spec.Token,
+		},
+	}}
+
+	secretResource := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "secrets"}
+	return r.client.Resource(secretResource).Namespace(namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
+}
+
+// ownTokenSecret sets the K8s Job as the owner of secret, an orphaned secret is only logged
+func (r *kubernetesRunner) ownTokenSecret(secret *unstructured.Unstructured, job *unstructured.Unstructured) {
+	secret.SetOwnerReferences([]metav1.OwnerReference{{
+		APIVersion: "batch/v1",
+		Kind:       "Job",
+		Name:       job.GetName(),
+		UID:        job.GetUID(),
+	}})
+
+	secretResource := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "secrets"}
+	if _, err := r.client.Resource(secretResource).Namespace(secret.GetNamespace()).Update(context.TODO(), secret, metav1.UpdateOptions{}); err != nil {
+		klog.Errorf("Failed to set owner of secret %q: %s", secret.GetName(), err)
+	}
+}
+
+func (r *kubernetesRunner) deleteTokenSecret(secret *unstructured.Unstructured) {
+	secretResource := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "secrets"}
+	err := r.client.Resource(secretResource).Namespace(secret.GetNamespace()).Delete(context.TODO(), secret.GetName(), metav1.DeleteOptions{})
+	if err != nil && !apierr.IsNotFound(err) {
+		klog.Errorf("Failed to delete secret %q: %s", secret.GetName(), err)
+	}
+}
+
+// delete the K8s Job running colibri, together with its pod
+func (r *kubernetesRunner) Stop(ref JobRef) error {
+	jobResource := schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+	propagation := metav1.DeletePropagationForeground
+	err := r.client.Resource(jobResource).Namespace(ref.Namespace).Delete(context.TODO(), ref.Name, metav1.DeleteOptions{
+		PropagationPolicy: &propagation,
+	})
+	if apierr.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		klog.Errorf("Failed to delete job: %s", err)
+		return err
+	}
+	klog.Infof("Deleted job %q", ref.Name)
+
+	return nil
+}
+
+// watchBackoff is the interval between watches of a job, reset once a watch reports a change of its state
+var watchBackoff = wait.Backoff{Duration: time.Second, Factor: 2, Jitter: 0.1, Steps: math.MaxInt32, Cap: time.Minute}
+
+// watch follows the K8s Job and its Pod, until the job is finished
+func (r *kubernetesRunner) watch(ref JobRef, report JobReporter) {
+	reporter := &jobStateReporter{report: report}
+	backoff := watchBackoff
+	for {
+		finished, changed, err := r.watchOnce(context.TODO(), ref, reporter)
+		if finished {
+			return
+		}
+		if err != nil {
+			klog.Errorf("Failed to watch job %q: %s", ref.Name, err)
+		}
+		if changed {
+			backoff = watchBackoff
+		}
+		time.Sleep(backoff.Step())
+	}
+}
+
+// watchOnce reads the K8s Job and its Pods, then watches them from there. It returns when the job is finished,
+// or when a watch is closed by the API server, and whether the state of the job is changed meanwhile.
+func (r *kubernetesRunner) watchOnce(ctx context.Context, ref JobRef, reporter *jobStateReporter) (finished bool, changed bool, err error) {
+	set := func(state JobState, reason string) {
+		if reporter.set(state, reason) {
+			changed = true
+		}
+	}
+
+	// the Job is read again on every watch, the events while it is not watched are lost
+	jobResource := schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+	job, err := r.client.Resource(jobResource).Namespace(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if apierr.IsNotFound(err) {
+		set(stateFromJob(watch.Event{Type: watch.Deleted, Object: newDeletedJob(ref)}))
+		return true, changed, nil
+	}
+	if err != nil {
+		return false, changed, err
+	}
+
+	podResource := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+	pods, err := r.client.Resource(podResource).Namespace(ref.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "job-name=" + ref.Name,
+	})
+	if err != nil {
+		return false, changed, err
+	}
+	for i := range pods.Items {
+		set(stateFromPod(watch.Event{Type: watch.Added, Object: &pods.Items[i]}))
+	}
+	if state, reason := stateFromJob(watch.Event{Type: watch.Modified, Object: job}); state != "" {
+		set(state, reason)
+		if state.finished() {
+			return true, changed, nil
+		}
+	}
+
+	jobWatch, err := r.client.Resource(jobResource).Namespace(ref.Namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector:   "metadata.name=" + ref.Name,
+		ResourceVersion: job.GetResourceVersion(),
+	})
+	if err != nil {
+		return false, changed, err
+	}
+	defer jobWatch.Stop()
+
+	podWatch, err := r.client.Resource(podResource).Namespace(ref.Namespace).Watch(ctx, metav1.ListOptions{
+		LabelSelector:   "job-name=" + ref.Name,
+		ResourceVersion: pods.GetResourceVersion(),
+	})
+	if err != nil {
+		return false, changed, err
+	}
+	defer podWatch.Stop()
+
+	for {
+		var state JobState
+		var reason string
+		select {
+		case event, ok := <-jobWatch.ResultChan():
+			if !ok {
+				return false, changed, nil
+			}
+			if event.Type == watch.Error {
+				return false, changed, apierr.FromObject(event.Object)
+			}
+			state, reason = stateFromJob(event)
+		case event, ok := <-podWatch.ResultChan():
+			if !ok {
+				return false, changed, nil
+			}
+			if event.Type == watch.Error {
+				return false, changed, apierr.FromObject(event.Object)
+			}
+			state, reason = stateFromPod(event)
+		}
+		if state == "" {
+			continue
+		}
+		set(state, reason)
+		if state.finished() {
+			return true, changed, nil
+		}
+	}
+}
+
+// newDeletedJob is the K8s Job of ref, which is already deleted
+func newDeletedJob(ref JobRef) *unstructured.Unstructured {
+	job := &unstructured.Unstructured{}
+	job.SetNamespace(ref.Namespace)
+	job.SetName(ref.Name)
+	return job
+}
+
+// jobStateReporter reports the changes of the state of a job, over the watches of the job
+type jobStateReporter struct {
+	report  JobReporter
+	state   JobState
+	reason  string
+	running bool
+}
+
+// set reports state unless it is not changed, and returns whether it is reported.
+// A running job is never Pending again: the pod of a retry is pending while the job is still running.
+func (r *jobStateReporter) set(state JobState, reason string) bool {
+	if state == JobPending && r.running {
+		return false
+	}
+	if state == r.state && reason == r.reason {
+		return false
+	}
+	r.running = r.running || state == JobRunning
+	r.state = state
+	r.reason = reason
+	r.report(state, reason)
+	return true
+}
+
+// stateFromJob returns the state of a job by the conditions of its K8s Job, or "" if it is unknown
+func stateFromJob(event watch.Event) (JobState, string) {
+	job, ok := event.Object.(*unstructured.Unstructured)
+	if !ok {
+		return "", ""
+	}
+	if event.Type == watch.Deleted {
+		return JobFailed, "Job " + job.GetName() + " is deleted"
+	}
+
+	conditions, _, _ := unstructured.NestedSlice(job.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ctype, _, _ := unstructured.NestedString(condition, "type")
+		status, _, _ := unstructured.NestedString(condition, "status")
+		reason, _, _ := unstructured.NestedString(condition, "reason")
+		message, _, _ := unstructured.NestedString(condition, "message")
+		if status != "True" {
+			continue
+		}
+		switch {
+		case ctype == "Complete":
+			return JobSucceeded, ""
+		case ctype == "Failed" && reason == "DeadlineExceeded":
+			return JobTimedOut, reason + ": " + message
+		case ctype == "Failed":
+			return JobFailed, reason + ": " + message
+		}
+	}
+
+	return "", ""
+}
+
+// stateFromPod returns the state of a job by the phase of its Pod, or "" if it is unknown
+func stateFromPod(event watch.Event) (JobState, string) {
+	pod, ok := event.Object.(*unstructured.Unstructured)
+	if !ok || event.Type == watch.Deleted {
+		return "", ""
+	}
+
+	phase, _, _ := unstructured.NestedString(pod.Object, "status", "phase")
+	switch phase {
+	case "Pending":
+		// surface why the pod cannot start, e.g. ImagePullBackOff
+		reason := ""
+		statuses, _, _ := unstructured.NestedSlice(pod.Object, "status", "containerStatuses")
+		for _, s := range statuses {
+			status, ok := s.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if waiting, _, _ := unstructured.NestedString(status, "state", "waiting", "reason"); waiting != "" {
+				reason = waiting
+			}
+		}
+		return JobPending, reason
+	case "Running":
+		return JobRunning, ""
+	}
+
+	// Succeeded/Failed pods are judged by the conditions of the K8s Job
+	return "", ""
+}
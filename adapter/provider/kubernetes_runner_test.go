@@ -0,0 +1,228 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+// newOrphanTestJob returns a K8s Job of colibri run by the adapter owned by the pod colibri/owner, unowned if owner is empty
+func newOrphanTestJob(ns string, name string, owner string, uid string) *unstructured.Unstructured {
+	job := newTestObject("batch/v1", "Job", ns, name, nil)
+	job.SetLabels(map[string]string{jobIDLabel: name})
+	if owner != "" {
+		job.SetLabels(map[string]string{jobIDLabel: name, ownerUIDLabel: uid})
+		job.SetAnnotations(map[string]string{ownerAnnotation: "colibri/" + owner})
+	}
+	return job
+}
+
+func TestCollectOrphans(t *testing.T) {
+	self := newTestObject("v1", "Pod", "colibri", "colibri-apiserver-a", nil)
+	self.SetUID("uid-a")
+	replica := newTestObject("v1", "Pod", "colibri", "colibri-apiserver-b", nil)
+	replica.SetUID("uid-b")
+	// the pod is recreated with the same name, the adapter owning the Jobs is gone
+	recreated := newTestObject("v1", "Pod", "colibri", "colibri-apiserver-c", nil)
+	recreated.SetUID("uid-c2")
+	other := newTestObject("batch/v1", "Job", "default", "backup", nil)
+
+	objects := []runtime.Object{self, replica, recreated, other,
+		newOrphanTestJob("default", "own", "colibri-apiserver-a", "uid-a"),
+		newOrphanTestJob("colibri", "own-in-owner-namespace", "colibri-apiserver-a", "uid-a"),
+		newOrphanTestJob("default", "replica", "colibri-apiserver-b", "uid-b"),
+		newOrphanTestJob("default", "removed-owner", "colibri-apiserver-z", "uid-z"),
+		newOrphanTestJob("other", "recreated-owner", "colibri-apiserver-c", "uid-c1"),
+		newOrphanTestJob("default", "unowned", "", ""),
+	}
+
+	tests := []struct {
+		name  string
+		owner *metav1.OwnerReference
+		want  []string
+	}{
+		{
+			name:  "jobs of removed owners and of a restarted container",
+			owner: &metav1.OwnerReference{APIVersion: "v1", Kind: "Pod", Name: "colibri-apiserver-a", UID: types.UID("uid-a")},
+			want:  []string{"backup", "replica", "unowned"},
+		},
+		{
+			name: "no owner known",
+			want: []string{"backup", "own", "own-in-owner-namespace", "recreated-owner", "removed-owner", "replica", "unowned"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobResource := schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+			client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+				jobResource:                       "JobList",
+				{Version: "v1", Resource: "pods"}: "PodList",
+			}, objects...)
+			runner := NewKubernetesRunner(client, nil, JobCleanup{Owner: tt.owner, OwnerNamespace: "colibri"})
+
+			if err := runner.(OrphanCollector).CollectOrphans(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			list, err := client.Resource(jobResource).Namespace(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(list.Items))
+			for _, job := range list.Items {
+				got = append(got, job.GetName())
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected jobs %v kept, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSetCleanupOwner(t *testing.T) {
+	owner := &metav1.OwnerReference{APIVersion: "v1", Kind: "Pod", Name: "colibri-apiserver-a", UID: types.UID("uid-a")}
+	runner := &kubernetesRunner{cleanup: JobCleanup{TTLSecondsAfterFinished: 60, Owner: owner, OwnerNamespace: "colibri"}}
+
+	for ns, owned := range map[string]bool{"colibri": true, "default": false} {
+		job := newTestObject("batch/v1", "Job", ns, "job", nil)
+		if err := runner.setCleanup(job); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if job.GetLabels()[ownerUIDLabel] != "uid-a" || job.GetAnnotations()[ownerAnnotation] != "colibri/colibri-apiserver-a" {
+			t.Errorf("expected the owner identified on the job in %s, got %v %v", ns, job.GetLabels(), job.GetAnnotations())
+		}
+		if got := len(job.GetOwnerReferences()) == 1; got != owned {
+			t.Errorf("expected owned %v in %s, got %v", owned, ns, job.GetOwnerReferences())
+		}
+	}
+}
+
+func TestJobStateReporter(t *testing.T) {
+	var got []string
+	reporter := &jobStateReporter{report: func(state JobState, reason string) {
+		got = append(got, string(state)+":"+reason)
+	}}
+
+	for _, change := range []struct {
+		state  JobState
+		reason string
+	}{
+		{JobPending, ""},
+		{JobPending, "ContainerCreating"},
+		{JobPending, "ContainerCreating"},
+		{JobRunning, ""},
+		// the pod of a retry
+		{JobPending, "ContainerCreating"},
+		{JobRunning, ""},
+		{JobSucceeded, ""},
+	} {
+		reporter.set(change.state, change.reason)
+	}
+
+	want := []string{"Pending:", "Pending:ContainerCreating", "Running:", "Succeeded:"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v reported, got %v", want, got)
+	}
+}
+
+func TestWatchOnce(t *testing.T) {
+	ref := JobRef{Namespace: "colibri", Name: "web-0-1-colibri-00000000"}
+	newJob := func(condition string) *unstructured.Unstructured {
+		job := newTestObject("batch/v1", "Job", ref.Namespace, ref.Name, nil)
+		conditions := []interface{}{map[string]interface{}{"type": condition, "status": "True", "reason": "BackoffLimitExceeded", "message": "retried"}}
+		if err := unstructured.SetNestedSlice(job.Object, conditions, "status", "conditions"); err != nil {
+			t.Fatal(err)
+		}
+		return job
+	}
+	newPod := func(name string, phase string) *unstructured.Unstructured {
+		pod := newTestObject("v1", "Pod", ref.Namespace, name, nil)
+		pod.SetLabels(map[string]string{"job-name": ref.Name})
+		if err := unstructured.SetNestedField(pod.Object, phase, "status", "phase"); err != nil {
+			t.Fatal(err)
+		}
+		return pod
+	}
+
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		want    []JobState
+		reason  string
+	}{
+		{name: "job deleted while not watched", want: []JobState{JobFailed}, reason: "Job " + ref.Name + " is deleted"},
+		{name: "job finished while not watched", objects: []runtime.Object{newJob("Complete"), newPod("tried", "Running")},
+			want: []JobState{JobRunning, JobSucceeded}},
+		{name: "job failed while not watched", objects: []runtime.Object{newJob("Failed"), newPod("tried", "Failed")},
+			want: []JobState{JobFailed}, reason: "BackoffLimitExceeded: retried"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+				{Version: "v1", Resource: "pods"}: "PodList",
+			}, tt.objects...)
+			runner := &kubernetesRunner{client: client}
+
+			var got []JobState
+			var reason string
+			reporter := &jobStateReporter{report: func(state JobState, r string) {
+				got = append(got, state)
+				reason = r
+			}}
+			finished, changed, err := runner.watchOnce(context.TODO(), ref, reporter)
+			if !finished || !changed || err != nil {
+				t.Fatalf("expected the job finished without watching it, got finished %v, changed %v: %v", finished, changed, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) || reason != tt.reason {
+				t.Errorf("expected %v (%s) reported, got %v (%s)", tt.want, tt.reason, got, reason)
+			}
+		})
+	}
+}
+
+func TestJobName(t *testing.T) {
+	tests := []struct {
+		name string
+		spec JobSpec
+		want string
+	}{
+		{name: "process", spec: JobSpec{ID: "3f807767-1676-1457-727e-222a54e3cf41", Pod: "web-0", Process: "1"}, want: "web-0-1-colibri-3f807767"},
+		{name: "container", spec: JobSpec{ID: "3f807767-1676-1457-727e-222a54e3cf41", Pod: "web-0", Container: "server"}, want: "web-0-server-colibri-3f807767"},
+		{name: "short ID", spec: JobSpec{ID: "job", Pod: "web-0", Process: "1"}, want: "web-0-1-colibri-job"},
+		{name: "ID prefix ending with a separator", spec: JobSpec{ID: "profile-web", Pod: "web-0", Process: "1"}, want: "web-0-1-colibri-profile"},
+		{name: "long pod", spec: JobSpec{ID: "job", Pod: strings.Repeat("a", 60), Process: "1"}, want: strings.Repeat("a", 51) + "-colibri-job"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jobName(tt.spec); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// localRunner runs colibri as a process on the host of the adapter,
+// for trying the whole profiling loop without a cluster to schedule jobs.
+//
+// The binary is called with the same arguments as in the K8s Job,
+// and COLIBRI_API_URL, COLIBRI_RESULT_ID and COLIBRI_RESULT_TOKEN are set in its environment,
+// so a stub script can post a result to "$COLIBRI_API_URL/$COLIBRI_RESULT_ID"
+// with the token in header X-Colibri-Result-Token.
+type localRunner struct {
+	binary string
+	apiURL string
+
+	mu    sync.Mutex
+	procs map[string]*os.Process
+}
+
+func NewLocalRunner(binary string, apiURL string) JobRunner {
+	return &localRunner{
+		binary: binary,
+		apiURL: apiURL,
+		procs:  make(map[string]*os.Process),
+	}
+}
+
+func (r *localRunner) Run(spec JobSpec, report JobReporter) (JobRef, error) {
+	cmd := r.command(spec)
+	if err := cmd.Start(); err != nil {
+		klog.Errorf("Failed to start colibri: %s", err)
+		return JobRef{}, err
+	}
+	ref := JobRef{Name: "colibri-" + strconv.Itoa(cmd.Process.Pid)}
+	klog.Infof("Started process %q", ref.Name)
+
+	r.mu.Lock()
+	r.procs[ref.Name] = cmd.Process
+	r.mu.Unlock()
+
+	report(JobRunning, "")
+	go r.wait(ref, spec, cmd, report)
+
+	return ref, nil
+}
+
+// command runs colibri for spec, with the same arguments as in the K8s Job
+func (r *localRunner) command(spec JobSpec) *exec.Cmd {
+	args := []string{"--pid", spec.Process}
+	if spec.Process == "" {
+		args = []string{"--container", spec.ContainerID}
+		if spec.Command != "" {
+			args = append(args, "--match", spec.Command)
+		}
+	}
+	cmd := exec.Command(r.binary, append(args,
+		"--freq", strconv.Itoa(spec.Frequency),
+		"--iter", strconv.Itoa(spec.Iteration),
+		"--pert", strconv.Itoa(spec.Percentile),
+		"--out", "api:"+spec.ResultID,
+		"--mtype", "all",
+	)...)
+	cmd.Env = append(os.Environ(),
+		"COLIBRI_API_URL="+r.apiURL,
+		"COLIBRI_RESULT_ID="+spec.ResultID,
+		"COLIBRI_RESULT_TOKEN="+spec.Token,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// wait follows the process of a job until it is finished,
+// colibri is started again after it failed, up to the retries of the job unless it is stopped
+func (r *localRunner) wait(ref JobRef, spec JobSpec, cmd *exec.Cmd, report JobReporter) {
+	for try := 0; ; try++ {
+		err := cmd.Wait()
+
+		r.mu.Lock()
+		_, running := r.procs[ref.Name]
+		if err == nil || !running || try >= spec.Retries {
+			delete(r.procs, ref.Name)
+			r.mu.Unlock()
+			if err != nil {
+				report(JobFailed, err.Error())
+				return
+			}
+			report(JobSucceeded, "")
+			return
+		}
+
+		klog.Infof("Process %q failed by %s, retrying", ref.Name, err)
+		cmd = r.command(spec)
+		if err := cmd.Start(); err != nil {
+			delete(r.procs, ref.Name)
+			r.mu.Unlock()
+			report(JobFailed, err.Error())
+			return
+		}
+		r.procs[ref.Name] = cmd.Process
+		r.mu.Unlock()
+	}
+}
+
+func (r *localRunner) Stop(ref JobRef) error {
+	// a stopped process is not retried
+	r.mu.Lock()
+	proc, found := r.procs[ref.Name]
+	delete(r.procs, ref.Name)
+	r.mu.Unlock()
+	if !found {
+		return nil
+	}
+
+	if err := proc.Kill(); err != nil && err != os.ErrProcessDone {
+		klog.Errorf("Failed to kill process: %s", err)
+		return err
+	}
+	klog.Infof("Killed process %q", ref.Name)
+
+	return nil
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+// TestLocalRunnerHelper is the stub colibri run by the local runner, it puts a fixed result
+func TestLocalRunnerHelper(t *testing.T) {
+	if os.Getenv("COLIBRI_TEST_HELPER") != "1" {
+		return
+	}
+	body := bytes.NewBufferString(`{"cpu": "250m", "ram": "64Mi", "ingress": "10k", "egress": "20k"}`)
+	req, err := http.NewRequest(http.MethodPost, os.Getenv("COLIBRI_API_URL")+"/"+os.Getenv("COLIBRI_RESULT_ID"), body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	req.Header.Set("Content-Type", restful.MIME_JSON)
+	req.Header.Set(ResultTokenHeader, os.Getenv("COLIBRI_RESULT_TOKEN"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+func newTestObject(apiVersion, kind, namespace, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+		"metadata": map[string]interface{}{
+			"name": name,
+		},
+	}}
+	if namespace != "" {
+		obj.SetNamespace(namespace)
+	}
+	if spec != nil {
+		obj.Object["spec"] = spec
+	}
+	return obj
+}
+
+func TestLocalRunnerProfilingLoop(t *testing.T) {
+	// the stub binary runs this test binary as TestLocalRunnerHelper
+	stub := filepath.Join(t.TempDir(), "colibri")
+	script := fmt.Sprintf("#!/bin/sh\nexec %q -test.run=TestLocalRunnerHelper\n", os.Args[0])
+	if err := os.WriteFile(stub, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("COLIBRI_TEST_HELPER", "1")
+
+	pod := newTestObject("v1", "Pod", "default", "app", map[string]interface{}{"nodeName": "node-1"})
+	pod.Object["status"] = map[string]interface{}{"phase": "Running"}
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme(),
+		newTestObject("v1", "Namespace", "", "default", nil),
+		pod,
+	)
+
+	container := restful.NewContainer()
+	server := httptest.NewServer(container)
+	defer server.Close()
+
+	opts := DefaultOptions()
+	opts.Runner = NewLocalRunner(stub, server.URL+"/colibri")
+	_, ws, _ := NewProvider(client, newTestMapper(), opts)
+	container.Add(ws)
+
+	resp, err := http.Post(server.URL+"/colibri/default/app/42", restful.MIME_JSON,
+		bytes.NewBufferString(`{"freq": 10, "iter": 100, "pert": 99}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record jobRecord
+	if err := json.NewDecoder(resp.Body).Decode(&record); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !record.State.finished() && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		resp, err := http.Get(server.URL + "/colibri/jobs/" + record.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if record.State != JobSucceeded {
+		t.Fatalf("expected job to be Succeeded, got %s (%s)", record.State, record.Reason)
+	}
+
+	// the result of a job never launched is rejected
+	resp, err = http.Post(server.URL+"/colibri/default.app.42", restful.MIME_JSON,
+		bytes.NewBufferString(`{"cpu": "1", "ram": "1Gi", "ingress": "1M", "egress": "1M"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected result without token to be forbidden, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "/colibri/default/app/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result jobResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	expected := jobResult{Cpu: "250m", Ram: "64Mi", Ingress: "10k", Egress: "20k"}
+	if result != expected {
+		t.Fatalf("expected result %+v, got %+v", expected, result)
+	}
+}
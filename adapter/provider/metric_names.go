@@ -0,0 +1,179 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// Stable names of the results in the custom metrics API.
+// The results of the processes of a pod are told apart by the labels of the metric.
+const (
+	CPUMetric     = "colibri_cpu"
+	MemoryMetric  = "colibri_memory"
+	IngressMetric = "colibri_ingress"
+	EgressMetric  = "colibri_egress"
+)
+
+// labels of a colibri metric, which metric selectors are matched against
+const (
+	// processLabel is the ID of the process the metric is measured of
+	processLabel = "process"
+	// containerLabel is the container of the process, set when it is known
+	containerLabel = "container"
+	// percentileLabel is the percentile of data analytics of the job the metric is measured by
+	percentileLabel = "percentile"
+)
+
+// the series of a result in the metric store are named as <processId><key>, by the stable name of the result
+var resultSeries = map[string]string{
+	CPUMetric:     "-cpu",
+	MemoryMetric:  "-ram",
+	IngressMetric: "-ig",
+	EgressMetric:  "-eg",
+}
+
+// MetricNaming decides the names results are served as in the custom metrics API
+type MetricNaming struct {
+	// Aliases also serves every series by its legacy name, <processId>-cpu, <processId>-ram, <processId>-ig and <processId>-eg,
+	// and the job parameters as <processId>-freq, <processId>-iter and <processId>-pert
+	Aliases bool
+}
+
+// DefaultMetricNaming serves the stable names together with the legacy aliases
+var DefaultMetricNaming = MetricNaming{Aliases: true}
+
+// splitSeries splits the name of a series in the metric store into the process ID and the key, e.g. "-cpu"
+func splitSeries(metric string) (string, string, bool) {
+	i := strings.LastIndex(metric, "-")
+	if i <= 0 {
+		return "", "", false
+	}
+	return metric[:i], metric[i:], true
+}
+
+// stableName returns the stable name of the series of a result, false for the series of job parameters
+func stableName(key string) (string, bool) {
+	for name, series := range resultSeries {
+		if series == key {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// metricInfos lists the stable names of the stored results, and the legacy names of all series in alias mode
+func (p *colibriProvider) metricInfos() []provider.CustomMetricInfo {
+	stored := p.values.ListMetricInfos()
+	infos := make([]provider.CustomMetricInfo, 0, len(stored))
+	seen := make(map[provider.CustomMetricInfo]bool)
+	for _, info := range stored {
+		if info.GroupResource == containerResultsResource {
+			continue
+		}
+		if p.naming.Aliases {
+			infos = append(infos, info)
+		}
+		_, key, ok := splitSeries(info.Metric)
+		if !ok {
+			continue
+		}
+		name, ok := stableName(key)
+		if !ok {
+			continue
+		}
+		stable := info
+		stable.Metric = name
+		if !seen[stable] {
+			seen[stable] = true
+			infos = append(infos, stable)
+		}
+	}
+	return infos
+}
+
+// sampleFor returns the sample a metric of an object is served by, if the labels of the metric match metricSelector.
+// A stable name is served by the latest result among the matching processes of the object,
+// a legacy name by its own series in alias mode. The info is normalized by the caller.
+func (p *colibriProvider) sampleFor(info provider.CustomMetricInfo, name types.NamespacedName, metricSelector labels.Selector) (Sample, error) {
+	notFound := provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
+
+	key, stable := resultSeries[info.Metric]
+	if !stable {
+		if !p.naming.Aliases {
+			return Sample{}, notFound
+		}
+		value, found := p.values.Get(info, name)
+		if !found || !matchesMetric(metricSelector, p.labelsFor(info, name)) {
+			return Sample{}, notFound
+		}
+		return value, nil
+	}
+
+	var latest *Sample
+	for _, series := range p.values.ListMetricInfos() {
+		if series.GroupResource != info.GroupResource {
+			continue
+		}
+		if _, seriesKey, ok := splitSeries(series.Metric); !ok || seriesKey != key {
+			continue
+		}
+		value, found := p.values.Get(series, name)
+		if !found || !matchesMetric(metricSelector, p.labelsFor(series, name)) {
+			continue
+		}
+		if latest == nil || value.Timestamp.After(latest.Timestamp) {
+			latest = &value
+		}
+	}
+	if latest == nil {
+		return Sample{}, notFound
+	}
+	return *latest, nil
+}
+
+// get the labels of a series of an object in the metric store
+func (p *colibriProvider) labelsFor(series provider.CustomMetricInfo, name types.NamespacedName) labels.Set {
+	pid, _, ok := splitSeries(series.Metric)
+	if !ok {
+		return labels.Set{}
+	}
+	set := labels.Set{processLabel: pid}
+
+	pertInfo := series
+	pertInfo.Metric = pid + "-pert"
+	if pert, found := p.values.Get(pertInfo, name); found {
+		set[percentileLabel] = pert.Value.String()
+	}
+
+	// the container is stored with the latest result of the process
+	cpuInfo := series
+	cpuInfo.Metric = pid + "-cpu"
+	if cpu, found := p.values.Get(cpuInfo, name); found && cpu.Container != "" {
+		set[containerLabel] = cpu.Container
+	}
+	return set
+}
+
+func matchesMetric(metricSelector labels.Selector, set labels.Set) bool {
+	return metricSelector == nil || metricSelector.Matches(set)
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// the resources read when results are stored, pods are admitted and results are scraped,
+// which are served from informers when the provider is given them
+var cachedResources = []schema.GroupVersionResource{
+	{Group: "", Version: "v1", Resource: "pods"},
+	{Group: "", Version: "v1", Resource: "namespaces"},
+	{Group: "apps", Version: "v1", Resource: "replicasets"},
+	{Group: "batch", Version: "v1", Resource: "jobs"},
+}
+
+// objectCache reads objects from the listers of their informers, or from K8s API server for the resources not cached
+type objectCache struct {
+	client  dynamic.Interface
+	listers map[schema.GroupVersionResource]cache.GenericLister
+}
+
+// newObjectCache registers cachedResources with informers, which are started by the caller.
+// All objects are read from K8s API server if informers is nil.
+func newObjectCache(client dynamic.Interface, informers dynamicinformer.DynamicSharedInformerFactory) *objectCache {
+	c := &objectCache{
+		client:  client,
+		listers: make(map[schema.GroupVersionResource]cache.GenericLister),
+	}
+	if informers == nil {
+		return c
+	}
+	for _, res := range cachedResources {
+		c.listers[res] = informers.ForResource(res).Lister()
+	}
+	return c
+}
+
+// get returns an object, which is shared with the informer if it is cached and must not be modified.
+// An empty ns gets a cluster-scoped object.
+func (c *objectCache) get(res schema.GroupVersionResource, ns string, name string) (*unstructured.Unstructured, error) {
+	lister, cached := c.listers[res]
+	if !cached {
+		return c.client.Resource(res).Namespace(ns).Get(context.TODO(), name, metav1.GetOptions{})
+	}
+
+	var obj runtime.Object
+	var err error
+	if ns == "" {
+		obj, err = lister.Get(name)
+	} else {
+		obj, err = lister.ByNamespace(ns).Get(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected %T in the cache of %s", obj, res)
+	}
+	return u, nil
+}
+
+// cached tells whether a resource is read from its informer
+func (c *objectCache) cached(res schema.GroupVersionResource) bool {
+	_, found := c.listers[res]
+	return found
+}
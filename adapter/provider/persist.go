@@ -0,0 +1,337 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// StoreBackend persists the serialized content of a metric store,
+// so job parameters and results survive restarts of the adapter.
+// The records of jobs and their result tokens are not persisted.
+type StoreBackend interface {
+	// Load returns the last saved content, or nil if nothing is saved yet
+	Load() ([]byte, error)
+	// Save replaces the saved content
+	Save(data []byte) error
+}
+
+// storedMetric is the serialized form of a series in the metric store
+type storedMetric struct {
+	Group      string   `json:"group,omitempty"`
+	Resource   string   `json:"resource"`
+	Namespaced bool     `json:"namespaced"`
+	Metric     string   `json:"metric"`
+	Namespace  string   `json:"namespace,omitempty"`
+	Name       string   `json:"name"`
+	Samples    []Sample `json:"samples,omitempty"`
+
+	// Value is the single value saved before series were stored, only read for compatibility
+	Value *resource.Quantity `json:"value,omitempty"`
+}
+
+// persistentStore is an in-memory MetricStore which saves its changes to a backend
+type persistentStore struct {
+	*memoryStore
+
+	// serialize saving, so an older snapshot never overwrites a newer one
+	saveMu  sync.Mutex
+	backend StoreBackend
+
+	// the changes within interval are saved together, every change is saved at once if it is zero
+	interval time.Duration
+	changed  chan struct{}
+}
+
+// NewPersistentStore creates a MetricStore preloaded with the content saved in backend.
+// Changes are saved at most once every saveInterval, so the changes of the last interval
+// are lost if the adapter stops; zero saves every change at once.
+func NewPersistentStore(backend StoreBackend, retention time.Duration, saveInterval time.Duration) (MetricStore, error) {
+	s := &persistentStore{
+		memoryStore: newMemoryStore(retention),
+		backend:     backend,
+		interval:    saveInterval,
+		changed:     make(chan struct{}, 1),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	// saving starts once the content is loaded, so a store failed to load never saves
+	if saveInterval > 0 {
+		go s.run()
+	}
+	return s, nil
+}
+
+// load adds the content saved in the backend to the store
+func (s *persistentStore) load() error {
+	data, err := s.backend.Load()
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	var metrics []storedMetric
+	if err := json.Unmarshal(data, &metrics); err != nil {
+		return err
+	}
+	for _, m := range metrics {
+		info := provider.CustomMetricInfo{
+			GroupResource: schema.GroupResource{Group: m.Group, Resource: m.Resource},
+			Metric:        m.Metric,
+			Namespaced:    m.Namespaced,
+		}
+		name := types.NamespacedName{Namespace: m.Namespace, Name: m.Name}
+		if m.Value != nil && len(m.Samples) == 0 {
+			m.Samples = []Sample{{Value: *m.Value, Timestamp: time.Now()}}
+		}
+		for _, sample := range m.Samples {
+			s.memoryStore.Add(info, name, sample)
+		}
+	}
+	klog.Infof("Loaded %d stored metrics", len(metrics))
+
+	return nil
+}
+
+func (s *persistentStore) Add(info provider.CustomMetricInfo, name types.NamespacedName, sample Sample) {
+	s.memoryStore.Add(info, name, sample)
+	s.markChanged()
+}
+
+func (s *persistentStore) Delete(info provider.CustomMetricInfo, name types.NamespacedName) {
+	s.memoryStore.Delete(info, name)
+	s.markChanged()
+}
+
+func (s *persistentStore) DeleteSample(info provider.CustomMetricInfo, name types.NamespacedName, timestamp time.Time) {
+	s.memoryStore.DeleteSample(info, name, timestamp)
+	s.markChanged()
+}
+
+// markChanged saves the store at once, or wakes up run to save it with the other changes of the interval
+func (s *persistentStore) markChanged() {
+	if s.interval <= 0 {
+		s.save()
+		return
+	}
+	select {
+	case s.changed <- struct{}{}:
+	default:
+		// a save is already pending, it takes this change
+	}
+}
+
+// run saves the store when it is changed, at most once every interval
+func (s *persistentStore) run() {
+	for range s.changed {
+		s.save()
+		time.Sleep(s.interval)
+	}
+}
+
+// save writes a snapshot of the memory to backend,
+// failures are only logged: the values are still served from memory
+func (s *persistentStore) save() {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.RLock()
+	metrics := make([]storedMetric, 0, len(s.values))
+	for key, series := range s.values {
+		samples := make([]Sample, 0, len(series))
+		for _, sample := range series {
+			samples = append(samples, sample.DeepCopy())
+		}
+		metrics = append(metrics, storedMetric{
+			Group:      key.GroupResource.Group,
+			Resource:   key.GroupResource.Resource,
+			Namespaced: key.Namespaced,
+			Metric:     key.Metric,
+			Namespace:  key.Namespace,
+			Name:       key.Name,
+			Samples:    samples,
+		})
+	}
+	s.mu.RUnlock()
+
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		klog.Errorf("Failed to encode stored metrics: %s", err)
+		return
+	}
+	if err := s.backend.Save(data); err != nil {
+		klog.Errorf("Failed to save stored metrics: %s", err)
+	}
+}
+
+// fileBackend saves the metric store into a file on local disk
+type fileBackend struct {
+	path string
+}
+
+func NewFileBackend(path string) StoreBackend {
+	return &fileBackend{path: path}
+}
+
+func (b *fileBackend) Load() ([]byte, error) {
+	data, err := os.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (b *fileBackend) Save(data []byte) error {
+	dir := filepath.Dir(b.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// write to a temporary file and rename, so a crash never leaves a truncated file
+	tmp, err := os.CreateTemp(dir, filepath.Base(b.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.path)
+}
+
+const storeDataKey = "metrics.json"
+
+// objectBackend saves the metric store into a ConfigMap or a Secret.
+// Be aware of the 1MiB size limit of K8s objects.
+type objectBackend struct {
+	client    dynamic.Interface
+	resource  schema.GroupVersionResource
+	kind      string
+	namespace string
+	name      string
+}
+
+func NewConfigMapBackend(client dynamic.Interface, namespace string, name string) StoreBackend {
+	return &objectBackend{
+		client:    client,
+		resource:  schema.GroupVersionResource{Group: "", Version: "v1", Resource: "configmaps"},
+		kind:      "ConfigMap",
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+func NewSecretBackend(client dynamic.Interface, namespace string, name string) StoreBackend {
+	return &objectBackend{
+		client:    client,
+		resource:  schema.GroupVersionResource{Group: "", Version: "v1", Resource: "secrets"},
+		kind:      "Secret",
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+func (b *objectBackend) Load() ([]byte, error) {
+	obj, err := b.client.Resource(b.resource).Namespace(b.namespace).Get(context.TODO(), b.name, metav1.GetOptions{})
+	if apierr.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, _, err := unstructured.NestedString(obj.Object, "data", storeDataKey)
+	if err != nil || data == "" {
+		return nil, err
+	}
+	if b.kind == "Secret" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	return []byte(data), nil
+}
+
+// Save writes the content to the object, again if the object is modified or created by another writer meanwhile
+func (b *objectBackend) Save(data []byte) error {
+	value := string(data)
+	if b.kind == "Secret" {
+		value = base64.StdEncoding.EncodeToString(data)
+	}
+
+	return retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierr.IsConflict(err) || apierr.IsAlreadyExists(err)
+	}, func() error {
+		return b.save(value)
+	})
+}
+
+func (b *objectBackend) save(value string) error {
+	client := b.client.Resource(b.resource).Namespace(b.namespace)
+	obj, err := client.Get(context.TODO(), b.name, metav1.GetOptions{})
+	if apierr.IsNotFound(err) {
+		obj = &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       b.kind,
+				"metadata": map[string]interface{}{
+					"name":      b.name,
+					"namespace": b.namespace,
+				},
+				"data": map[string]interface{}{
+					storeDataKey: value,
+				},
+			},
+		}
+		_, err = client.Create(context.TODO(), obj, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := unstructured.SetNestedField(obj.Object, value, "data", storeDataKey); err != nil {
+		return err
+	}
+	_, err = client.Update(context.TODO(), obj, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func TestPersistentStoreRoundTrip(t *testing.T) {
+	info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Metric: "1-cpu", Namespaced: true}
+	name := types.NamespacedName{Namespace: "default", Name: "pod"}
+	now := time.Now().Truncate(time.Second)
+
+	tests := []struct {
+		name    string
+		backend func(t *testing.T) StoreBackend
+	}{
+		{name: "file", backend: func(t *testing.T) StoreBackend {
+			return NewFileBackend(filepath.Join(t.TempDir(), "colibri", "metrics.json"))
+		}},
+		{name: "configmap", backend: func(t *testing.T) StoreBackend {
+			return NewConfigMapBackend(fake.NewSimpleDynamicClient(runtime.NewScheme()), "colibri", "store")
+		}},
+		{name: "secret", backend: func(t *testing.T) StoreBackend {
+			return NewSecretBackend(fake.NewSimpleDynamicClient(runtime.NewScheme()), "colibri", "store")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := tt.backend(t)
+			s, err := NewPersistentStore(backend, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Add(info, name, Sample{Value: resource.MustParse("100m"), Timestamp: now.Add(-2 * time.Minute)})
+			s.Add(info, name, Sample{Value: resource.MustParse("150m"), Timestamp: now.Add(-time.Minute)})
+			s.Add(info, name, Sample{Value: resource.MustParse("200m"), Timestamp: now, Container: "server"})
+			s.DeleteSample(info, name, now.Add(-time.Minute))
+
+			loaded, err := NewPersistentStore(backend, 0, 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			history := loaded.History(info, name)
+			if len(history) != 2 ||
+				history[0].Value.Cmp(resource.MustParse("100m")) != 0 || !history[0].Timestamp.Equal(now.Add(-2*time.Minute)) ||
+				history[1].Value.Cmp(resource.MustParse("200m")) != 0 || !history[1].Timestamp.Equal(now) || history[1].Container != "server" {
+				t.Errorf("expected 100m and 200m of container server loaded, got %v", history)
+			}
+		})
+	}
+}
+
+func TestConfigMapBackendConflict(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	backend := NewConfigMapBackend(client, "colibri", "store")
+	if err := backend.Save([]byte("[]")); err != nil {
+		t.Fatal(err)
+	}
+	// another writer updates the ConfigMap between reading and writing it, once
+	conflicts := 0
+	client.PrependReactor("update", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		return true, nil, apierr.NewConflict(schema.GroupResource{Resource: "configmaps"}, "store", errors.New("modified"))
+	})
+
+	if err := backend.Save([]byte(`[{"resource":"pods"}]`)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := backend.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `[{"resource":"pods"}]` || conflicts != 1 {
+		t.Errorf("expected the content saved after %d conflict, got %s", conflicts, data)
+	}
+}
+
+// countingBackend keeps the saved content in memory and counts the saves
+type countingBackend struct {
+	mu    sync.Mutex
+	data  []byte
+	saves int
+}
+
+func (b *countingBackend) Load() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.data, nil
+}
+
+func (b *countingBackend) Save(data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.data = data
+	b.saves++
+	return nil
+}
+
+func (b *countingBackend) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.saves
+}
+
+func TestPersistentStoreSaveInterval(t *testing.T) {
+	backend := &countingBackend{}
+	s, err := NewPersistentStore(backend, 0, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := types.NamespacedName{Namespace: "default", Name: "pod"}
+	for i := 0; i < 100; i++ {
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Metric: fmt.Sprintf("%d-cpu", i), Namespaced: true}
+		s.Add(info, name, Sample{Value: resource.MustParse("100m"), Timestamp: time.Now()})
+	}
+
+	// all changes are saved eventually, in a few saves
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		loaded, err := NewPersistentStore(backend, 0, 0)
+		if err != nil {
+			return false, err
+		}
+		return len(loaded.ListMetricInfos()) == 100, nil
+	})
+	if err != nil {
+		t.Fatalf("changes are not saved: %v", err)
+	}
+	if saves := backend.count(); saves > 3 {
+		t.Errorf("expected the changes saved together, got %d saves", saves)
+	}
+}
@@ -0,0 +1,530 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	profilingv1alpha1 "colibri-apiserver/adapter/apis/profiling/v1alpha1"
+)
+
+// how often the jobs of a running ProfilingJob are checked
+const profilingJobPollInterval = 5 * time.Second
+
+// ProfilingJobController reconciles the ProfilingJobs of profiling.colibri.io:
+// it runs colibri for the targeted pods the same way as the colibri REST API does,
+// and writes the states and the results of the jobs back to the status.
+type ProfilingJobController struct {
+	p        *colibriProvider
+	informer cache.SharedIndexInformer
+	queue    workqueue.RateLimitingInterface
+}
+
+// NewProfilingJobController returns the controller running jobs by p, which is returned by NewProvider
+func NewProfilingJobController(p provider.CustomMetricsProvider, resync time.Duration) (*ProfilingJobController, error) {
+	cp, ok := p.(*colibriProvider)
+	if !ok {
+		return nil, fmt.Errorf("ProfilingJobs can only be run by the colibri provider, got %T", p)
+	}
+	// the CustomResourceDefinition is installed by colibri-apiserver.yml, not by the adapter
+	if _, err := cp.client.Resource(profilingv1alpha1.ProfilingJobsResource).List(context.TODO(), metav1.ListOptions{Limit: 1}); err != nil {
+		if apierr.IsNotFound(err) {
+			return nil, fmt.Errorf("CustomResourceDefinition %s is not installed", profilingv1alpha1.ProfilingJobsResource.GroupResource())
+		}
+		return nil, err
+	}
+
+	c := &ProfilingJobController{
+		p: cp,
+		informer: dynamicinformer.NewFilteredDynamicInformer(cp.client, profilingv1alpha1.ProfilingJobsResource, metav1.NamespaceAll, resync,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}, nil).Informer(),
+		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "profilingjobs"),
+	}
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(old, new interface{}) {
+			c.enqueue(new)
+		},
+		DeleteFunc: c.cancelDeleted,
+	})
+	return c, nil
+}
+
+// Run reconciles ProfilingJobs by workers until stopCh is closed
+func (c *ProfilingJobController) Run(workers int, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	klog.Infof("Starting ProfilingJob controller")
+	go c.informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced) {
+		klog.Errorf("Failed to sync ProfilingJobs")
+		return
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(func() {
+			for c.processNextItem() {
+			}
+		}, time.Second, stopCh)
+	}
+	<-stopCh
+	klog.Infof("Stopped ProfilingJob controller")
+}
+
+func (c *ProfilingJobController) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+func (c *ProfilingJobController) processNextItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	requeueAfter, err := c.reconcile(key.(string))
+	if err != nil {
+		klog.Errorf("Failed to reconcile ProfilingJob %s: %s", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	if requeueAfter > 0 {
+		c.queue.AddAfter(key, requeueAfter)
+	}
+	return true
+}
+
+// reconcile starts a run of a ProfilingJob when it is due, and updates its status by the jobs of the latest run.
+// It returns when the ProfilingJob should be reconciled again, zero if it is not needed.
+func (c *ProfilingJobController) reconcile(key string) (time.Duration, error) {
+	obj, exists, err := c.informer.GetIndexer().GetByKey(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	u := obj.(*unstructured.Unstructured)
+	job := &profilingv1alpha1.ProfilingJob{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), job); err != nil {
+		return 0, err
+	}
+	status := job.Status.DeepCopy()
+
+	now := time.Now()
+	interval, err := scheduleInterval(job.Spec.Schedule)
+	if err != nil {
+		setCondition(status, job.Generation, profilingv1alpha1.ConditionFailed, metav1.ConditionTrue, "InvalidSchedule", err.Error())
+		_, err = c.updateStatus(u, job, status)
+		return 0, err
+	}
+
+	// a changed spec starts a new run, the jobs for the old spec are stopped
+	changed := status.ObservedGeneration != job.Generation
+	if changed {
+		c.cancelRuns(status.Jobs)
+	}
+	active := c.refresh(job.Namespace, status)
+
+	// a scheduled run is skipped while the previous one is still running
+	due := changed || status.LastScheduleTime == nil ||
+		(interval > 0 && !active && !now.Before(status.LastScheduleTime.Add(interval)))
+	if due {
+		// the run is written before its jobs are started, so a retried reconcile starts the same jobs once
+		c.plan(job, status, now)
+		if u, err = c.updateStatus(u, job, status); err != nil {
+			return 0, err
+		}
+		job.Status = *status.DeepCopy()
+	}
+	if c.launch(job, status) {
+		active = c.refresh(job.Namespace, status)
+	}
+	if len(status.Jobs) > 0 {
+		setRunConditions(status, job.Generation)
+	}
+
+	if _, err := c.updateStatus(u, job, status); err != nil {
+		return 0, err
+	}
+
+	switch {
+	case active:
+		return profilingJobPollInterval, nil
+	case interval > 0:
+		return time.Until(status.LastScheduleTime.Add(interval)), nil
+	}
+	return 0, nil
+}
+
+// plan starts a run of a ProfilingJob in its status, with a job to start for each targeted pod
+func (c *ProfilingJobController) plan(job *profilingv1alpha1.ProfilingJob, status *profilingv1alpha1.ProfilingJobStatus, now time.Time) {
+	// the time is kept in seconds, as it is written
+	lastScheduleTime := metav1.NewTime(now).Rfc3339Copy()
+	status.LastScheduleTime = &lastScheduleTime
+	status.ObservedGeneration = job.Generation
+	status.Jobs = nil
+	status.Results = nil
+	status.Conditions = nil
+
+	params := paramsOrDefaults(job.Spec.Frequency, job.Spec.Iteration, job.Spec.Percentile)
+
+	specPath := field.NewPath("spec")
+	errs := c.p.validation.validateParam(params, specPath)
+	errs = append(errs, validateTargetProcess(&job.Spec, specPath)...)
+	if len(errs) > 0 {
+		setCondition(status, job.Generation, profilingv1alpha1.ConditionFailed, metav1.ConditionTrue, "InvalidSpec", errs.ToAggregate().Error())
+		return
+	}
+
+	pods, err := c.targetPods(job)
+	if err == nil && len(pods) == 0 {
+		err = errors.New("no running pod is selected")
+	}
+	if err != nil {
+		setCondition(status, job.Generation, profilingv1alpha1.ConditionFailed, metav1.ConditionTrue, "NoTarget", err.Error())
+		return
+	}
+
+	for _, pod := range pods {
+		status.Jobs = append(status.Jobs, profilingv1alpha1.ProfilingJobRun{
+			Pod:   pod.GetName(),
+			JobID: runJobID(job.UID, job.Generation, lastScheduleTime, pod.GetName()),
+		})
+	}
+}
+
+// launch runs colibri for the jobs of the latest run which are not started yet. A job already recorded
+// by the provider is not started again, e.g. its state failed to be written.
+// It returns whether any job is started.
+func (c *ProfilingJobController) launch(job *profilingv1alpha1.ProfilingJob, status *profilingv1alpha1.ProfilingJobStatus) bool {
+	started := false
+	params := paramsOrDefaults(job.Spec.Frequency, job.Spec.Iteration, job.Spec.Percentile)
+	for i := range status.Jobs {
+		run := &status.Jobs[i]
+		if run.State != "" {
+			continue
+		}
+		started = true
+		if record, found := c.p.jobs.get(run.JobID); found {
+			run.State = string(record.State)
+			run.Reason = record.Reason
+			continue
+		}
+
+		klog.Infof("Run Colibri for ProfilingJob %s/%s on pod %s", job.Namespace, job.Name, run.Pod)
+		pod, err := c.p.checkPod(job.Namespace, run.Pod)
+		if err != nil {
+			run.State = string(JobFailed)
+			run.Reason = "Failed to create job: " + err.Error()
+			continue
+		}
+		target, err := processTarget(pod, &job.Spec)
+		if err != nil {
+			run.State = string(JobFailed)
+			run.Reason = "Failed to create job: " + err.Error()
+			continue
+		}
+		record, err := c.p.startJob(pod, job.Namespace, run.Pod, target, params, run.JobID)
+		if err != nil {
+			run.State = string(JobFailed)
+			run.Reason = "Failed to create job: " + err.Error()
+			continue
+		}
+		run.State = string(record.State)
+		run.Reason = record.Reason
+	}
+	return started
+}
+
+// validateTargetProcess checks a process is targeted by one of its ID, its name and its container
+func validateTargetProcess(spec *profilingv1alpha1.ProfilingJobSpec, fldPath *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+
+	switch {
+	case spec.Process != "":
+		if spec.ProcessName != "" {
+			errs = append(errs, field.Forbidden(fldPath.Child("processName"), "may not be set with process"))
+		}
+		if spec.Container != "" {
+			errs = append(errs, field.Forbidden(fldPath.Child("container"), "may not be set with process"))
+		}
+		if spec.Command != "" {
+			errs = append(errs, field.Forbidden(fldPath.Child("command"), "may not be set with process"))
+		}
+	case spec.ProcessName != "":
+		if spec.Command != "" {
+			errs = append(errs, field.Forbidden(fldPath.Child("command"), "may not be set with processName"))
+		}
+	case spec.Container != "":
+		errs = append(errs, validateContainerTarget(spec.Container, spec.Command, fldPath)...)
+	default:
+		errs = append(errs, field.Required(fldPath.Child("process"), "one of process, processName and container is required"))
+	}
+
+	return errs
+}
+
+// processTarget returns the process of pod targeted by spec: a process targeted by its name is matched by colibri
+// with the executable of its command line, in the container, or in the only container of pod if it is not set
+func processTarget(pod *unstructured.Unstructured, spec *profilingv1alpha1.ProfilingJobSpec) (jobTarget, error) {
+	if spec.Process != "" {
+		return jobTarget{Process: spec.Process}, nil
+	}
+
+	target := jobTarget{Container: spec.Container, Command: spec.Command}
+	if spec.ProcessName != "" {
+		target.Command = `(^|/)` + regexp.QuoteMeta(spec.ProcessName) + `(\s|$)`
+		if target.Container == "" {
+			target.Container = onlyContainer(pod)
+		}
+		if target.Container == "" {
+			return jobTarget{}, errors.New("container is required to find process " + spec.ProcessName + " in pod " + pod.GetName() + " of many containers")
+		}
+	}
+	containerID, err := checkContainer(pod, target.Container)
+	if err != nil {
+		return jobTarget{}, err
+	}
+	target.ContainerID = containerID
+	return target, nil
+}
+
+// runJobID derives the ID of the job of a run for a pod, by the ProfilingJob, the generation of its spec
+// and the schedule time of the run
+func runJobID(uid types.UID, generation int64, scheduled metav1.Time, pod string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d/%d/%s", uid, generation, scheduled.Unix(), pod)))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// targetPods returns the pod, or the running pods selected by labels
+func (c *ProfilingJobController) targetPods(job *profilingv1alpha1.ProfilingJob) ([]*unstructured.Unstructured, error) {
+	target := job.Spec.Target
+	switch {
+	case target.Pod != "" && target.Selector != nil:
+		return nil, errors.New("only one of pod and selector can be set in target")
+	case target.Pod != "":
+		pod, err := c.p.checkPod(job.Namespace, target.Pod)
+		if err != nil {
+			return nil, err
+		}
+		return []*unstructured.Unstructured{pod}, nil
+	case target.Selector != nil:
+		selector, err := metav1.LabelSelectorAsSelector(target.Selector)
+		if err != nil {
+			return nil, err
+		}
+		res := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+		list, err := c.p.client.Resource(res).Namespace(job.Namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return nil, err
+		}
+		pods := make([]*unstructured.Unstructured, 0, len(list.Items))
+		for i := range list.Items {
+			if phase, _, _ := unstructured.NestedString(list.Items[i].Object, "status", "phase"); phase == "Running" {
+				pods = append(pods, &list.Items[i])
+			}
+		}
+		return pods, nil
+	}
+	return nil, errors.New("one of pod and selector should be set in target")
+}
+
+// refresh copies the states and the processes of the jobs of the latest run from their records, and collects
+// the results of the jobs which just succeeded. It returns whether any job is not finished yet.
+func (c *ProfilingJobController) refresh(namespace string, status *profilingv1alpha1.ProfilingJobStatus) bool {
+	active := false
+	for i := range status.Jobs {
+		run := &status.Jobs[i]
+		if JobState(run.State).finished() {
+			continue
+		}
+		if run.State == "" {
+			// not started yet, by launch
+			active = true
+			continue
+		}
+
+		record, found := c.p.jobs.get(run.JobID)
+		if !found {
+			// records are not persisted, e.g. the adapter is restarted
+			run.State = string(JobFailed)
+			run.Reason = "Record of the job is lost"
+			continue
+		}
+		run.State = string(record.State)
+		run.Reason = record.Reason
+		run.Process = record.Process
+		if !record.State.finished() {
+			active = true
+			continue
+		}
+
+		if record.State == JobSucceeded {
+			result, err := c.p.latestResult(types.NamespacedName{Namespace: namespace, Name: run.Pod}, record.Process)
+			if err != nil || result.Timestamp.Before(record.CreatedAt) {
+				run.State = string(JobFailed)
+				run.Reason = "Job succeeded without putting a result"
+				continue
+			}
+			status.Results = append(status.Results, profilingv1alpha1.ProfilingJobResult{
+				Pod:       run.Pod,
+				CPU:       result.Cpu,
+				Memory:    result.Ram,
+				Ingress:   result.Ingress,
+				Egress:    result.Egress,
+				Timestamp: metav1.NewTime(result.Timestamp),
+			})
+		}
+	}
+	return active
+}
+
+// cancelRuns stops the jobs which are not finished yet
+func (c *ProfilingJobController) cancelRuns(runs []profilingv1alpha1.ProfilingJobRun) {
+	for _, run := range runs {
+		if JobState(run.State).finished() {
+			continue
+		}
+		if _, err := c.p.cancelJob(run.JobID); err != nil && !apierr.IsNotFound(err) && !apierr.IsConflict(err) {
+			klog.Errorf("Failed to cancel job %s: %s", run.JobID, err)
+		}
+	}
+}
+
+// cancelDeleted stops the running jobs of a deleted ProfilingJob
+func (c *ProfilingJobController) cancelDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	job := &profilingv1alpha1.ProfilingJob{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), job); err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.cancelRuns(job.Status.Jobs)
+}
+
+// updateStatus writes the status of a ProfilingJob unless it is not changed, and returns the written object
+func (c *ProfilingJobController) updateStatus(u *unstructured.Unstructured, job *profilingv1alpha1.ProfilingJob, status *profilingv1alpha1.ProfilingJobStatus) (*unstructured.Unstructured, error) {
+	if equality.Semantic.DeepEqual(&job.Status, status) {
+		return u, nil
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(status)
+	if err != nil {
+		return nil, err
+	}
+	u = u.DeepCopy()
+	if err := unstructured.SetNestedField(u.Object, content, "status"); err != nil {
+		return nil, err
+	}
+	return c.p.client.Resource(profilingv1alpha1.ProfilingJobsResource).Namespace(u.GetNamespace()).UpdateStatus(context.TODO(), u, metav1.UpdateOptions{})
+}
+
+// setRunConditions sets the conditions of a ProfilingJob by the states of the jobs of its latest run
+func setRunConditions(status *profilingv1alpha1.ProfilingJobStatus, generation int64) {
+	running, succeeded := 0, 0
+	failed := []string{}
+	for _, run := range status.Jobs {
+		switch JobState(run.State) {
+		case JobSucceeded:
+			succeeded++
+		case JobFailed, JobTimedOut, JobCancelled:
+			failed = append(failed, run.Pod+": "+run.State)
+		default:
+			running++
+		}
+	}
+
+	if running > 0 {
+		setCondition(status, generation, profilingv1alpha1.ConditionRunning, metav1.ConditionTrue, "JobsRunning",
+			fmt.Sprintf("%d of %d jobs are running", running, len(status.Jobs)))
+	} else {
+		setCondition(status, generation, profilingv1alpha1.ConditionRunning, metav1.ConditionFalse, "JobsFinished", "all jobs are finished")
+	}
+
+	if succeeded == len(status.Jobs) {
+		setCondition(status, generation, profilingv1alpha1.ConditionComplete, metav1.ConditionTrue, "JobsSucceeded", "all jobs succeeded")
+	} else {
+		setCondition(status, generation, profilingv1alpha1.ConditionComplete, metav1.ConditionFalse, "JobsNotSucceeded",
+			fmt.Sprintf("%d of %d jobs succeeded", succeeded, len(status.Jobs)))
+	}
+
+	if len(failed) > 0 {
+		setCondition(status, generation, profilingv1alpha1.ConditionFailed, metav1.ConditionTrue, "JobsFailed", strings.Join(failed, ", "))
+	} else {
+		setCondition(status, generation, profilingv1alpha1.ConditionFailed, metav1.ConditionFalse, "NoJobFailed", "no job failed")
+	}
+}
+
+func setCondition(status *profilingv1alpha1.ProfilingJobStatus, generation int64, ctype string, value metav1.ConditionStatus, reason string, message string) {
+	apimeta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               ctype,
+		Status:             value,
+		ObservedGeneration: generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// scheduleInterval parses the schedule of a ProfilingJob, zero means it runs once
+func scheduleInterval(schedule string) (time.Duration, error) {
+	if schedule == "" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(schedule)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schedule %q: %s", schedule, err)
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("invalid schedule %q: must be positive", schedule)
+	}
+	return interval, nil
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	clienttesting "k8s.io/client-go/testing"
+
+	profilingv1alpha1 "colibri-apiserver/adapter/apis/profiling/v1alpha1"
+)
+
+// countingRunner counts the jobs it runs by their IDs and records the jobs it stops, the jobs are never finished.
+// The specs of the jobs it runs are kept in specs, if it is not nil.
+type countingRunner struct {
+	mu      sync.Mutex
+	runs    map[string]int
+	specs   map[string]JobSpec
+	stopped []JobRef
+}
+
+func (r *countingRunner) Run(job JobSpec, report JobReporter) (JobRef, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.runs[job.ID]++
+	if r.specs != nil {
+		r.specs[job.ID] = job
+	}
+	return JobRef{Namespace: "colibri", Name: job.ID}, nil
+}
+
+func (r *countingRunner) Stop(ref JobRef) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopped = append(r.stopped, ref)
+	return nil
+}
+
+func (r *countingRunner) counts() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := make(map[string]int, len(r.runs))
+	for id, n := range r.runs {
+		counts[id] = n
+	}
+	return counts
+}
+
+func TestProfilingJobStartsJobsOnce(t *testing.T) {
+	pod := newTestObject("v1", "Pod", "default", "web-0", map[string]interface{}{
+		"nodeName":   "node-1",
+		"containers": []interface{}{map[string]interface{}{"name": "server"}},
+	})
+	if err := unstructured.SetNestedField(pod.Object, "Running", "status", "phase"); err != nil {
+		t.Fatal(err)
+	}
+	profilingJob := newTestObject("profiling.colibri.io/v1alpha1", "ProfilingJob", "default", "web", map[string]interface{}{
+		"target":  map[string]interface{}{"pod": "web-0"},
+		"process": "1",
+	})
+	profilingJob.SetUID("profilingjob")
+	profilingJob.SetGeneration(1)
+
+	res := profilingv1alpha1.ProfilingJobsResource
+	client := newTestClient(newTestObject("v1", "Namespace", "", "default", nil), pod, profilingJob)
+	// the status is written once for the planned run, then writing the started jobs fails once
+	updates := 0
+	client.PrependReactor("update", "profilingjobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates == 2 {
+			return true, nil, apierr.NewConflict(res.GroupResource(), "web", errors.New("modified"))
+		}
+		return false, nil, nil
+	})
+
+	runner := &countingRunner{runs: map[string]int{}}
+	opts := DefaultOptions()
+	opts.Runner = runner
+	c, err := NewProfilingJobController(newTestProvider(client, opts), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reconcile reads from the cache of the informer, which is not started
+	reconcile := func() (*profilingv1alpha1.ProfilingJob, error) {
+		u, err := client.Resource(res).Namespace("default").Get(context.TODO(), "web", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.informer.GetIndexer().Update(u); err != nil {
+			t.Fatal(err)
+		}
+		_, reconcileErr := c.reconcile("default/web")
+
+		u, err = client.Resource(res).Namespace("default").Get(context.TODO(), "web", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		job := &profilingv1alpha1.ProfilingJob{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), job); err != nil {
+			t.Fatal(err)
+		}
+		return job, reconcileErr
+	}
+
+	job, err := reconcile()
+	if err == nil {
+		t.Fatalf("expected the started jobs failed to be written")
+	}
+	if job.Status.LastScheduleTime == nil || len(job.Status.Jobs) != 1 || job.Status.Jobs[0].State != "" {
+		t.Fatalf("expected the planned run written before its jobs are started, got %+v", job.Status)
+	}
+	id := runJobID("profilingjob", 1, *job.Status.LastScheduleTime, "web-0")
+	if job.Status.Jobs[0].JobID != id {
+		t.Errorf("expected job %s derived from the run, got %s", id, job.Status.Jobs[0].JobID)
+	}
+
+	for i := 0; i < 2; i++ {
+		if job, err = reconcile(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if got := runner.counts(); !reflect.DeepEqual(got, map[string]int{id: 1}) {
+		t.Errorf("expected job %s run once, got %v", id, got)
+	}
+	want := []profilingv1alpha1.ProfilingJobRun{{Pod: "web-0", JobID: id, Process: "1", State: string(JobPending)}}
+	if !reflect.DeepEqual(job.Status.Jobs, want) {
+		t.Errorf("expected jobs %+v, got %+v", want, job.Status.Jobs)
+	}
+}
+
+func TestValidateTargetProcess(t *testing.T) {
+	tests := []struct {
+		name string
+		spec profilingv1alpha1.ProfilingJobSpec
+		want []string
+	}{
+		{name: "process ID", spec: profilingv1alpha1.ProfilingJobSpec{Process: "1"}, want: []string{}},
+		{name: "process name", spec: profilingv1alpha1.ProfilingJobSpec{ProcessName: "nginx", Container: "server"}, want: []string{}},
+		{name: "container", spec: profilingv1alpha1.ProfilingJobSpec{Container: "server", Command: "^nginx"}, want: []string{}},
+		{name: "no process", want: []string{"spec.process"}},
+		{name: "process ID and container", spec: profilingv1alpha1.ProfilingJobSpec{Process: "1", ProcessName: "nginx", Container: "server"},
+			want: []string{"spec.container", "spec.processName"}},
+		{name: "process name and command", spec: profilingv1alpha1.ProfilingJobSpec{ProcessName: "nginx", Command: "^nginx"},
+			want: []string{"spec.command"}},
+		{name: "invalid command", spec: profilingv1alpha1.ProfilingJobSpec{Container: "server", Command: "("}, want: []string{"spec.command"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := validateTargetProcess(&tt.spec, field.NewPath("spec"))
+			got := make([]string, 0, len(errs))
+			for _, err := range errs {
+				got = append(got, err.Field)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected invalid %v, got %v", tt.want, errs)
+			}
+		})
+	}
+}
+
+func TestProcessTarget(t *testing.T) {
+	newPod := func(containers ...string) *unstructured.Unstructured {
+		specs := []interface{}{}
+		statuses := []interface{}{}
+		for _, name := range containers {
+			specs = append(specs, map[string]interface{}{"name": name})
+			statuses = append(statuses, map[string]interface{}{"name": name, "containerID": "containerd://" + name})
+		}
+		pod := newTestObject("v1", "Pod", "default", "web-0", map[string]interface{}{"containers": specs})
+		if err := unstructured.SetNestedSlice(pod.Object, statuses, "status", "containerStatuses"); err != nil {
+			t.Fatal(err)
+		}
+		return pod
+	}
+	nginx := `(^|/)nginx(\s|$)`
+
+	tests := []struct {
+		name  string
+		pod   *unstructured.Unstructured
+		spec  profilingv1alpha1.ProfilingJobSpec
+		want  jobTarget
+		valid bool
+	}{
+		{name: "process ID", pod: newPod("server", "sidecar"), spec: profilingv1alpha1.ProfilingJobSpec{Process: "1"},
+			want: jobTarget{Process: "1"}, valid: true},
+		{name: "process name in its container", pod: newPod("server", "sidecar"), spec: profilingv1alpha1.ProfilingJobSpec{ProcessName: "nginx", Container: "server"},
+			want: jobTarget{Container: "server", ContainerID: "containerd://server", Command: nginx}, valid: true},
+		{name: "process name in the only container", pod: newPod("server"), spec: profilingv1alpha1.ProfilingJobSpec{ProcessName: "nginx"},
+			want: jobTarget{Container: "server", ContainerID: "containerd://server", Command: nginx}, valid: true},
+		{name: "process name in one of containers", pod: newPod("server", "sidecar"), spec: profilingv1alpha1.ProfilingJobSpec{ProcessName: "nginx"}},
+		{name: "container", pod: newPod("server", "sidecar"), spec: profilingv1alpha1.ProfilingJobSpec{Container: "sidecar", Command: "^envoy"},
+			want: jobTarget{Container: "sidecar", ContainerID: "containerd://sidecar", Command: "^envoy"}, valid: true},
+		{name: "unknown container", pod: newPod("server"), spec: profilingv1alpha1.ProfilingJobSpec{Container: "unknown"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := processTarget(tt.pod, &tt.spec)
+			if tt.valid && (err != nil || got != tt.want) {
+				t.Errorf("expected %+v, got %+v: %v", tt.want, got, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("expected the target rejected, got %+v", got)
+			}
+		})
+	}
+
+	// the name is matched with the executable of the command line
+	match := regexp.MustCompile(nginx)
+	for command, want := range map[string]bool{"nginx": true, "/usr/sbin/nginx -g daemon off;": true, "nginx-exporter": false, "/bin/sh -c mynginx": false} {
+		if got := match.MatchString(command); got != want {
+			t.Errorf("expected %q matched %v, got %v", command, want, got)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// the labels of the Prometheus gauges of results, besides those of the custom metrics
+var prometheusLabels = []string{"namespace", "pod", processLabel, containerLabel, percentileLabel, workloadKindLabel, workloadLabel}
+
+// A Prometheus gauge of the results, in the unit its name ends with
+type prometheusGauge struct {
+	desc *prometheus.Desc
+	// scale converts the base value of a result, e.g. cores of cpu, into the unit of the gauge
+	scale float64
+}
+
+// the Prometheus gauges, by the keys of the series of results in the metric store
+var prometheusGauges = map[string]prometheusGauge{
+	"-cpu": {desc: prometheus.NewDesc("colibri_cpu_millicores", "CPU utilization of a process measured by colibri, in millicores", prometheusLabels, nil), scale: 1000},
+	"-ram": {desc: prometheus.NewDesc("colibri_memory_bytes", "Memory utilization of a process measured by colibri, in bytes", prometheusLabels, nil), scale: 1},
+	"-ig":  {desc: prometheus.NewDesc("colibri_ingress_bps", "Ingress traffic bandwidth of a process measured by colibri, per second", prometheusLabels, nil), scale: 1},
+	"-eg":  {desc: prometheus.NewDesc("colibri_egress_bps", "Egress traffic bandwidth of a process measured by colibri, per second", prometheusLabels, nil), scale: 1},
+}
+
+// resultCollector exports the latest result of every process in the metric store of provider as Prometheus gauges
+type resultCollector struct {
+	p *colibriProvider
+}
+
+// MetricsPath is the non-resource path the Prometheus metrics of results are served at on the secure port,
+// next to the metrics of the adapter itself at /metrics
+const MetricsPath = "/metrics/colibri"
+
+// NewMetricsHandler returns the handler of the Prometheus metrics of the results stored by p, which is returned by NewProvider.
+// It is served at MetricsPath of the secure port, where requests are authenticated and authorized like the other non-resource paths.
+func NewMetricsHandler(p provider.CustomMetricsProvider) (http.Handler, error) {
+	cp, ok := p.(*colibriProvider)
+	if !ok {
+		return nil, fmt.Errorf("results can only be exported from the colibri provider, got %T", p)
+	}
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(&resultCollector{p: cp}); err != nil {
+		return nil, err
+	}
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{}), nil
+}
+
+func (c *resultCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, gauge := range prometheusGauges {
+		ch <- gauge.desc
+	}
+}
+
+// Collect reads the results at the time of scraping, so it is always in sync with the metric store.
+// The pods are read from the cache of provider.
+func (c *resultCollector) Collect(ch chan<- prometheus.Metric) {
+	// the workloads of the pods are looked up once in a scrape
+	workloads := make(map[types.NamespacedName]workloadRef)
+	for _, series := range c.p.values.ListMetricInfos() {
+		if series.GroupResource.Resource != "pods" {
+			continue
+		}
+		_, key, ok := splitSeries(series.Metric)
+		if !ok {
+			continue
+		}
+		gauge, ok := prometheusGauges[key]
+		if !ok {
+			continue
+		}
+
+		for _, name := range c.p.values.ListNames(series) {
+			sample, found := c.p.values.Get(series, name)
+			if !found {
+				continue
+			}
+			ref, found := workloads[name]
+			if !found {
+				ref = c.workloadOf(name)
+				workloads[name] = ref
+			}
+
+			set := c.p.labelsFor(series, name)
+			metric, err := prometheus.NewConstMetric(gauge.desc, prometheus.GaugeValue, quantityIn(sample.Value, gauge.scale),
+				name.Namespace, name.Name, set[processLabel], set[containerLabel], set[percentileLabel], strings.ToLower(ref.Kind), ref.Name)
+			if err != nil {
+				klog.Errorf("Failed to export %s of %s: %v", series.Metric, name, err)
+				continue
+			}
+			ch <- metric
+		}
+	}
+}
+
+// workloadOf returns the workload of a pod for the labels of its results, empty if the pod is removed
+func (c *resultCollector) workloadOf(name types.NamespacedName) workloadRef {
+	ref, err := c.p.podWorkload(name.Namespace, name.Name)
+	if err != nil {
+		if !apierr.IsNotFound(err) {
+			klog.Errorf("Failed to find workload of pod %s: %v", name, err)
+		}
+		return workloadRef{}
+	}
+	return ref
+}
+
+// quantityIn converts a quantity into a unit, by scaling its base value, e.g. 250m cpu is 0.25 cores and 250 millicores
+func quantityIn(q resource.Quantity, scale float64) float64 {
+	return q.AsApproximateFloat64() * scale
+}
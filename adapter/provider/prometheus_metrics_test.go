@@ -0,0 +1,84 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func TestResultCollector(t *testing.T) {
+	rs := newTestObject("apps/v1", "ReplicaSet", "default", "web-1", nil)
+	rs.SetOwnerReferences([]metav1.OwnerReference{ownerOf("apps/v1", "Deployment", "web")})
+	pod := newTestObject("v1", "Pod", "default", "web-1-a", nil)
+	pod.SetOwnerReferences([]metav1.OwnerReference{ownerOf("apps/v1", "ReplicaSet", "web-1")})
+	p := newTestProvider(newTestClient(rs, pod, newTestObject("v1", "Pod", "default", "solo", nil)), DefaultOptions())
+
+	now := time.Now()
+	for _, result := range []struct {
+		pod    string
+		values map[string]string
+	}{
+		{pod: "web-1-a", values: map[string]string{"1-cpu": "250m", "1-ram": "100Mi", "1-ig": "12k", "1-eg": "1500m", "1-pert": "99"}},
+		{pod: "solo", values: map[string]string{"7-cpu": "2"}},
+		// the pod is removed, its result is kept
+		{pod: "gone", values: map[string]string{"3-ram": "1Ki"}},
+	} {
+		for metric, value := range result.values {
+			info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Metric: metric, Namespaced: true}
+			sample := Sample{Value: resource.MustParse(value), Timestamp: now}
+			if result.pod == "web-1-a" {
+				sample.Container = "server"
+			}
+			p.values.Add(info, types.NamespacedName{Namespace: "default", Name: result.pod}, sample)
+		}
+	}
+	// results kept for recommendations and aggregated for workloads are not exported
+	p.putContainerResult(jobRecord{Namespace: "default", Pod: "web-1-a", Container: "server"}, workloadRef{APIVersion: "apps/v1", Kind: "Deployment", Name: "web"},
+		&jobResult{Cpu: "250m", Ram: "100Mi"}, now)
+	p.values.Add(p.workloadInfo(schema.GroupResource{Group: "apps", Resource: "deployments"}, "1-cpu"), types.NamespacedName{Namespace: "default", Name: "web"},
+		Sample{Value: resource.MustParse("250m"), Timestamp: now})
+
+	expected := `
+# HELP colibri_cpu_millicores CPU utilization of a process measured by colibri, in millicores
+# TYPE colibri_cpu_millicores gauge
+colibri_cpu_millicores{container="server",namespace="default",percentile="99",pod="web-1-a",process="1",workload="web",workload_kind="deployment"} 250
+colibri_cpu_millicores{container="",namespace="default",percentile="",pod="solo",process="7",workload="solo",workload_kind="pod"} 2000
+# HELP colibri_memory_bytes Memory utilization of a process measured by colibri, in bytes
+# TYPE colibri_memory_bytes gauge
+colibri_memory_bytes{container="server",namespace="default",percentile="99",pod="web-1-a",process="1",workload="web",workload_kind="deployment"} 1.048576e+08
+colibri_memory_bytes{container="",namespace="default",percentile="",pod="gone",process="3",workload="",workload_kind=""} 1024
+# HELP colibri_ingress_bps Ingress traffic bandwidth of a process measured by colibri, per second
+# TYPE colibri_ingress_bps gauge
+colibri_ingress_bps{container="server",namespace="default",percentile="99",pod="web-1-a",process="1",workload="web",workload_kind="deployment"} 12000
+# HELP colibri_egress_bps Egress traffic bandwidth of a process measured by colibri, per second
+# TYPE colibri_egress_bps gauge
+colibri_egress_bps{container="server",namespace="default",percentile="99",pod="web-1-a",process="1",workload="web",workload_kind="deployment"} 1.5
+`
+	if err := testutil.CollectAndCompare(&resultCollector{p: p}, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// RecommendationPolicy decides how the resources of containers are recommended from their results
+type RecommendationPolicy struct {
+	// RequestHeadroom is added to the highest result of a container for its requests, e.g. 0.15 for 15%
+	RequestHeadroom float64
+	// LimitHeadroom is added to the highest result of a container for its limits, limits are never below requests
+	LimitHeadroom float64
+	// CPUStep (millicores) and MemoryStep (bytes) are what requests and limits are rounded up to multiples of
+	CPUStep    int64
+	MemoryStep int64
+	// MaxAge ignores the results older than it, zero uses all retained results
+	MaxAge time.Duration
+}
+
+// DefaultRecommendationPolicy requests 15% and limits 50% above the highest result, rounded up to 10m CPU and 1Mi memory
+var DefaultRecommendationPolicy = RecommendationPolicy{
+	RequestHeadroom: 0.15,
+	LimitHeadroom:   0.5,
+	CPUStep:         10,
+	MemoryStep:      1024 * 1024,
+}
+
+// The resources recommended for the containers of a workload
+type recommendation struct {
+	Namespace  string                    `json:"namespace" description:"namespace of the workload"`
+	Kind       string                    `json:"kind" description:"kind of the workload"`
+	Name       string                    `json:"name" description:"name of the workload"`
+	Containers []containerRecommendation `json:"containers" description:"recommendations of the containers having results"`
+	Timestamp  time.Time                 `json:"timestamp" description:"time the recommendation is made"`
+}
+
+// The resources recommended for a container, in the form of the resources of a container spec
+type containerRecommendation struct {
+	Name       string                   `json:"name" description:"name of the container"`
+	Requests   corev1.ResourceList      `json:"requests" description:"recommended cpu and memory requests"`
+	Limits     corev1.ResourceList      `json:"limits" description:"recommended cpu and memory limits"`
+	Confidence recommendationConfidence `json:"confidence" description:"what the recommendation is made of"`
+}
+
+// What a recommendation is made of, more samples of more pods make a recommendation more confident
+type recommendationConfidence struct {
+	Samples     int       `json:"samples" description:"number of results"`
+	Pods        int       `json:"pods" description:"number of pods having the results"`
+	Percentiles []int     `json:"percentiles" description:"percentiles of data analytics of the jobs putting the results"`
+	Oldest      time.Time `json:"oldest" description:"time of the oldest result"`
+	Latest      time.Time `json:"latest" description:"time of the latest result"`
+}
+
+// the results of a container, across the runs and the pods of a workload
+type containerSamples struct {
+	cpu         []Sample
+	memory      []Sample
+	pods        sets.String
+	percentiles map[int]bool
+}
+
+// containerResultsResource keeps the results of the containers of workloads, named <group kind>/<workload>/<container>/<pod>,
+// so a workload is recommended from the results of its removed pods too. It is not served by the custom metrics API.
+var containerResultsResource = schema.GroupResource{Group: ColibriGroup, Resource: "containerresults"}
+
+// the series of the results of a container of a pod of a workload, by the keys of the series of pods
+type containerSeries struct {
+	workload  workloadRef
+	container string
+	pod       string
+}
+
+func containerInfo(key string) provider.CustomMetricInfo {
+	return provider.CustomMetricInfo{GroupResource: containerResultsResource, Metric: key, Namespaced: true}
+}
+
+func (c containerSeries) name(ns string) types.NamespacedName {
+	return types.NamespacedName{Namespace: ns, Name: strings.Join([]string{c.workload.groupKind().String(), c.workload.Name, c.container, c.pod}, "/")}
+}
+
+// parseContainerSeries parses the name of the series of a container, the version of its workload is not kept
+func parseContainerSeries(name types.NamespacedName) (containerSeries, bool) {
+	parts := strings.Split(name.Name, "/")
+	if len(parts) != 4 {
+		return containerSeries{}, false
+	}
+	gk := schema.ParseGroupKind(parts[0])
+	return containerSeries{
+		workload:  workloadRef{APIVersion: schema.GroupVersion{Group: gk.Group}.String(), Kind: gk.Kind, Name: parts[1]},
+		container: parts[2],
+		pod:       parts[3],
+	}, true
+}
+
+// putContainerResult keeps a result as of the container of its process, in the workload of its pod.
+// The results of processes in unknown containers, of pods with more containers targeted by process ID, are not kept.
+func (p *colibriProvider) putContainerResult(record jobRecord, ref workloadRef, metrics *jobResult, timestamp time.Time) {
+	if record.Container == "" {
+		return
+	}
+	name := containerSeries{workload: ref, container: record.Container, pod: record.Pod}.name(record.Namespace)
+	for key, value := range map[string]string{"-cpu": metrics.Cpu, "-ram": metrics.Ram} {
+		q, err := resource.ParseQuantity(value)
+		if err != nil {
+			continue
+		}
+		p.values.Add(containerInfo(key), name, Sample{Value: q, Timestamp: timestamp})
+	}
+	pert := *resource.NewQuantity(int64(record.Params.Percentile), resource.DecimalSI)
+	p.values.Add(containerInfo("-pert"), name, Sample{Value: pert, Timestamp: timestamp})
+}
+
+// recommend makes the recommendations for the containers of a workload from the stored results of its pods
+func (p *colibriProvider) recommend(ns string, kind string, name string) (recommendation, error) {
+	workload, res, gvk, err := p.resolveWorkload(ns, kind, name)
+	if err != nil {
+		return recommendation{}, err
+	}
+	return p.recommendWorkload(workload, res, gvk)
+}
+
+// recommendWorkload makes the recommendations for the containers in the pod template of a resolved workload
+func (p *colibriProvider) recommendWorkload(workload *unstructured.Unstructured, res schema.GroupVersionResource, gvk schema.GroupVersionKind) (recommendation, error) {
+	ref := workloadRef{APIVersion: gvk.GroupVersion().String(), Kind: gvk.Kind, Name: workload.GetName()}
+	return p.recommendFor(workload.GetNamespace(), ref, res.GroupResource(), templateContainers(workload))
+}
+
+// recommendFor makes the recommendations for containers of a workload from the results kept for them,
+// including the results of the removed pods of the workload
+func (p *colibriProvider) recommendFor(ns string, ref workloadRef, res schema.GroupResource, containers []string) (recommendation, error) {
+	known := sets.NewString(containers...)
+
+	var since time.Time
+	if p.recommendation.MaxAge > 0 {
+		since = time.Now().Add(-p.recommendation.MaxAge)
+	}
+
+	samples := make(map[string]*containerSamples)
+	cpuInfo, memoryInfo, pertInfo := containerInfo("-cpu"), containerInfo("-ram"), containerInfo("-pert")
+	for _, name := range p.values.ListNames(cpuInfo) {
+		series, ok := parseContainerSeries(name)
+		if !ok || !series.workload.is(ref) || !known.Has(series.container) {
+			continue
+		}
+		if samples[series.container] == nil {
+			samples[series.container] = &containerSamples{pods: sets.NewString(), percentiles: make(map[int]bool)}
+		}
+		s := samples[series.container]
+
+		perts := p.values.History(pertInfo, name)
+		for _, sample := range p.values.History(cpuInfo, name) {
+			if sample.Timestamp.Before(since) {
+				continue
+			}
+			s.cpu = append(s.cpu, sample)
+			s.pods.Insert(series.pod)
+			if pert, found := sampleAt(perts, sample.Timestamp); found {
+				s.percentiles[int(pert.Value.Value())] = true
+			}
+		}
+		for _, sample := range p.values.History(memoryInfo, name) {
+			if !sample.Timestamp.Before(since) {
+				s.memory = append(s.memory, sample)
+			}
+		}
+	}
+
+	rec := recommendation{Namespace: ns, Kind: ref.Kind, Name: ref.Name, Timestamp: time.Now()}
+	for _, container := range containers {
+		s, found := samples[container]
+		if !found || len(s.cpu) == 0 {
+			continue
+		}
+		rec.Containers = append(rec.Containers, p.recommendContainer(container, s))
+	}
+	if len(rec.Containers) == 0 {
+		return rec, provider.NewMetricNotFoundForError(res, "recommendation", ref.Name)
+	}
+	return rec, nil
+}
+
+// recommendContainer applies the headroom and the rounding of the policy of provider to the highest results of a container
+func (p *colibriProvider) recommendContainer(name string, s *containerSamples) containerRecommendation {
+	policy := p.recommendation
+	rec := containerRecommendation{
+		Name:     name,
+		Requests: corev1.ResourceList{},
+		Limits:   corev1.ResourceList{},
+		Confidence: recommendationConfidence{
+			Samples: len(s.cpu),
+			Pods:    s.pods.Len(),
+			Oldest:  s.cpu[0].Timestamp,
+			Latest:  s.cpu[0].Timestamp,
+		},
+	}
+	for _, sample := range s.cpu {
+		if sample.Timestamp.Before(rec.Confidence.Oldest) {
+			rec.Confidence.Oldest = sample.Timestamp
+		}
+		if sample.Timestamp.After(rec.Confidence.Latest) {
+			rec.Confidence.Latest = sample.Timestamp
+		}
+	}
+	for pert := range s.percentiles {
+		rec.Confidence.Percentiles = append(rec.Confidence.Percentiles, pert)
+	}
+	sort.Ints(rec.Confidence.Percentiles)
+
+	highestCPU := highest(s.cpu)
+	cpu := highestCPU.MilliValue()
+	rec.Requests[corev1.ResourceCPU] = *resource.NewMilliQuantity(roundUp(float64(cpu)*(1+policy.RequestHeadroom), policy.CPUStep), resource.DecimalSI)
+	rec.Limits[corev1.ResourceCPU] = *resource.NewMilliQuantity(roundUp(float64(cpu)*(1+math.Max(policy.LimitHeadroom, policy.RequestHeadroom)), policy.CPUStep), resource.DecimalSI)
+	if len(s.memory) > 0 {
+		highestMemory := highest(s.memory)
+		memory := highestMemory.Value()
+		rec.Requests[corev1.ResourceMemory] = *resource.NewQuantity(roundUp(float64(memory)*(1+policy.RequestHeadroom), policy.MemoryStep), resource.BinarySI)
+		rec.Limits[corev1.ResourceMemory] = *resource.NewQuantity(roundUp(float64(memory)*(1+math.Max(policy.LimitHeadroom, policy.RequestHeadroom)), policy.MemoryStep), resource.BinarySI)
+	}
+	return rec
+}
+
+// containersPath returns the path of the containers in the pod template of a workload, or of a pod, with the containers
+func containersPath(workload *unstructured.Unstructured) ([]string, []interface{}) {
+	for _, path := range [][]string{
+		{"spec", "template", "spec", "containers"},
+		{"spec", "jobTemplate", "spec", "template", "spec", "containers"},
+		{"spec", "containers"},
+	} {
+		if containers, found, _ := unstructured.NestedSlice(workload.Object, path...); found {
+			return path, containers
+		}
+	}
+	return nil, nil
+}
+
+// templateContainers returns the names of the containers in the pod template of a workload, or of a pod
+func templateContainers(workload *unstructured.Unstructured) []string {
+	_, containers := containersPath(workload)
+	names := make([]string, 0, len(containers))
+	for _, c := range containers {
+		container, _ := c.(map[string]interface{})
+		if name, _ := container["name"].(string); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// sampleAt returns the latest sample of series, oldest first, taken at or before t
+func sampleAt(series []Sample, t time.Time) (Sample, bool) {
+	for i := len(series) - 1; i >= 0; i-- {
+		if !series[i].Timestamp.After(t) {
+			return series[i], true
+		}
+	}
+	return Sample{}, false
+}
+
+func highest(samples []Sample) resource.Quantity {
+	value := samples[0].Value
+	for _, sample := range samples[1:] {
+		if sample.Value.Cmp(value) > 0 {
+			value = sample.Value
+		}
+	}
+	return value
+}
+
+// roundUp rounds value up to a multiple of step, no rounding if step is not positive
+func roundUp(value float64, step int64) int64 {
+	if step <= 0 {
+		return int64(math.Ceil(value))
+	}
+	return int64(math.Ceil(value/float64(step))) * step
+}
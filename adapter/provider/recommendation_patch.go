@@ -0,0 +1,289 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// modes of patching a workload with its recommendation
+const (
+	patchModeDryRun = "dryRun"
+	patchModeApply  = "apply"
+)
+
+// types of the patch of a workload
+const (
+	patchTypeStrategic = "strategic"
+	patchTypeJSON      = "json"
+)
+
+// appliedRecommendationAnnotation records on a workload who applied which recommendation, and when
+const appliedRecommendationAnnotation = "colibri.io/applied-recommendation"
+
+// the field manager of the patches applied to workloads
+const patchFieldManager = "colibri-apiserver"
+
+// Parameters of patching a workload with its recommendation
+type recommendationPatchParam struct {
+	Mode      string `json:"mode" description:"dryRun returns the patch and the changes only, apply also patches the workload" default:"dryRun"`
+	PatchType string `json:"patchType" description:"strategic (strategic merge patch) or json (JSON patch)" default:"strategic"`
+}
+
+// A change of the resources of a container made by a patch
+type resourceChange struct {
+	Container string              `json:"container" description:"name of the container"`
+	Field     string              `json:"field" description:"requests or limits"`
+	Resource  corev1.ResourceName `json:"resource" description:"cpu or memory"`
+	From      *resource.Quantity  `json:"from,omitempty" description:"value before the patch, omitted if it is not set"`
+	To        resource.Quantity   `json:"to" description:"value after the patch"`
+}
+
+// The patch of a workload by its recommendation, and whether it is applied
+type recommendationPatch struct {
+	Namespace string           `json:"namespace" description:"namespace of the workload"`
+	Kind      string           `json:"kind" description:"kind of the workload"`
+	Name      string           `json:"name" description:"name of the workload"`
+	Mode      string           `json:"mode" description:"dryRun or apply"`
+	PatchType string           `json:"patchType" description:"strategic or json"`
+	Patch     json.RawMessage  `json:"patch" description:"patch of the workload, null if nothing is changed"`
+	Changes   []resourceChange `json:"changes" description:"changes of the resources of containers made by the patch"`
+	Applied   bool             `json:"applied" description:"whether the workload is patched"`
+	AppliedBy string           `json:"appliedBy,omitempty" description:"user applying the patch"`
+	AppliedAt *time.Time       `json:"appliedAt,omitempty" description:"time the patch is applied"`
+}
+
+// The value of appliedRecommendationAnnotation
+type appliedRecommendation struct {
+	AppliedBy string           `json:"appliedBy"`
+	AppliedAt time.Time        `json:"appliedAt"`
+	Changes   []resourceChange `json:"changes"`
+}
+
+// owningWorkload finds a workload by its kind and name, a pod is taken as the workload controlling it,
+// as the resources of a pod cannot be patched
+func (p *colibriProvider) owningWorkload(ns string, kind string, name string) (*unstructured.Unstructured, schema.GroupVersionResource, schema.GroupVersionKind, error) {
+	workload, res, gvk, err := p.resolveWorkload(ns, kind, name)
+	if err != nil || gvk.Kind != "Pod" {
+		return workload, res, gvk, err
+	}
+	ref, err := p.workloadOf(workload)
+	if err != nil {
+		return nil, res, gvk, err
+	}
+	if ref.groupKind() == (schema.GroupKind{Kind: "Pod"}) {
+		return nil, res, gvk, apierr.NewBadRequest(fmt.Sprintf("pod %s is not controlled by a workload, its resources cannot be patched", name))
+	}
+	return p.workloadByRef(ns, ref)
+}
+
+// patchRecommendation makes the patch setting the resources of the containers of a workload to its recommendation,
+// and applies it in apply mode, recorded by appliedRecommendationAnnotation. The parameters are validated by the caller.
+func (p *colibriProvider) patchRecommendation(workload *unstructured.Unstructured, res schema.GroupVersionResource, gvk schema.GroupVersionKind,
+	params *recommendationPatchParam, user string) (recommendationPatch, error) {
+
+	rec, err := p.recommendWorkload(workload, res, gvk)
+	if err != nil {
+		return recommendationPatch{}, err
+	}
+	result := recommendationPatch{
+		Namespace: workload.GetNamespace(),
+		Kind:      gvk.Kind,
+		Name:      workload.GetName(),
+		Mode:      params.Mode,
+		PatchType: params.PatchType,
+		Patch:     json.RawMessage("null"),
+		Changes:   []resourceChange{},
+	}
+
+	path, containers := containersPath(workload)
+	patched, changes := containerPatches(containers, rec)
+	result.Changes = append(result.Changes, changes...)
+	if len(patched) == 0 {
+		return result, nil
+	}
+
+	var annotation string
+	now := time.Now()
+	if params.Mode == patchModeApply {
+		data, err := json.Marshal(appliedRecommendation{AppliedBy: user, AppliedAt: now, Changes: result.Changes})
+		if err != nil {
+			return result, err
+		}
+		annotation = string(data)
+	}
+
+	var patchType types.PatchType
+	var patch []byte
+	switch params.PatchType {
+	case patchTypeJSON:
+		patchType = types.JSONPatchType
+		patch, err = jsonPatch(workload, path, containers, patched, annotation)
+	default:
+		patchType = types.StrategicMergePatchType
+		patch, err = strategicPatch(path, containers, patched, annotation)
+	}
+	if err != nil {
+		return result, err
+	}
+	result.Patch = patch
+
+	if params.Mode != patchModeApply {
+		return result, nil
+	}
+	_, err = p.client.Resource(res).Namespace(result.Namespace).Patch(context.TODO(), result.Name, patchType, patch, metav1.PatchOptions{
+		FieldManager: patchFieldManager,
+	})
+	if err != nil {
+		return result, err
+	}
+	result.Applied = true
+	result.AppliedBy = user
+	result.AppliedAt = &now
+	klog.Infof("User %s applied recommendation to %s %s/%s: %s", user, gvk.Kind, result.Namespace, result.Name, annotation)
+
+	return result, nil
+}
+
+// containerPatches returns the resources of the containers changed by a recommendation, by their indexes,
+// with the changes. Other resources of the containers are kept.
+func containerPatches(containers []interface{}, rec recommendation) (map[int]map[string]interface{}, []resourceChange) {
+	recommended := make(map[string]containerRecommendation, len(rec.Containers))
+	for _, c := range rec.Containers {
+		recommended[c.Name] = c
+	}
+
+	patched := make(map[int]map[string]interface{})
+	var changes []resourceChange
+	for i, c := range containers {
+		container, _ := c.(map[string]interface{})
+		name, _ := container["name"].(string)
+		containerRec, found := recommended[name]
+		if !found {
+			continue
+		}
+		resources, _, _ := unstructured.NestedMap(container, "resources")
+		if resources == nil {
+			resources = make(map[string]interface{})
+		}
+		changed := false
+		for _, field := range []string{"requests", "limits"} {
+			values := containerRec.Requests
+			if field == "limits" {
+				values = containerRec.Limits
+			}
+			if len(values) == 0 {
+				continue
+			}
+			current, _, _ := unstructured.NestedMap(resources, field)
+			next := make(map[string]interface{}, len(current)+len(values))
+			for key, value := range current {
+				next[key] = value
+			}
+			for _, resourceName := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+				to, found := values[resourceName]
+				if !found {
+					continue
+				}
+				change := resourceChange{Container: name, Field: field, Resource: resourceName, To: to}
+				if value, found := current[string(resourceName)]; found {
+					if from, err := resource.ParseQuantity(fmt.Sprint(value)); err == nil {
+						if from.Cmp(to) == 0 {
+							continue
+						}
+						change.From = &from
+					}
+				}
+				next[string(resourceName)] = to.String()
+				changes = append(changes, change)
+				changed = true
+			}
+			resources[field] = next
+		}
+		if changed {
+			patched[i] = resources
+		}
+	}
+	return patched, changes
+}
+
+// strategicPatch merges the resources of the changed containers, matched by their names, and the annotation if it is set
+func strategicPatch(path []string, containers []interface{}, patched map[int]map[string]interface{}, annotation string) ([]byte, error) {
+	list := make([]interface{}, 0, len(patched))
+	for i, c := range containers {
+		resources, found := patched[i]
+		if !found {
+			continue
+		}
+		container, _ := c.(map[string]interface{})
+		list = append(list, map[string]interface{}{"name": container["name"], "resources": resources})
+	}
+
+	patch := make(map[string]interface{})
+	if err := unstructured.SetNestedSlice(patch, list, path...); err != nil {
+		return nil, err
+	}
+	if annotation != "" {
+		if err := unstructured.SetNestedField(patch, annotation, "metadata", "annotations", appliedRecommendationAnnotation); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(patch)
+}
+
+// jsonPatch replaces the resources of the changed containers, tested by their names at their indexes,
+// and adds the annotation if it is set
+func jsonPatch(workload *unstructured.Unstructured, path []string, containers []interface{}, patched map[int]map[string]interface{}, annotation string) ([]byte, error) {
+	var ops []map[string]interface{}
+	for i, c := range containers {
+		resources, found := patched[i]
+		if !found {
+			continue
+		}
+		container, _ := c.(map[string]interface{})
+		pointer := "/" + strings.Join(path, "/") + "/" + strconv.Itoa(i)
+		ops = append(ops,
+			map[string]interface{}{"op": "test", "path": pointer + "/name", "value": container["name"]},
+			map[string]interface{}{"op": "add", "path": pointer + "/resources", "value": resources},
+		)
+	}
+
+	if annotation != "" {
+		if workload.GetAnnotations() == nil {
+			ops = append(ops, map[string]interface{}{"op": "add", "path": "/metadata/annotations",
+				"value": map[string]interface{}{appliedRecommendationAnnotation: annotation}})
+		} else {
+			key := strings.ReplaceAll(strings.ReplaceAll(appliedRecommendationAnnotation, "~", "~0"), "/", "~1")
+			ops = append(ops, map[string]interface{}{"op": "add", "path": "/metadata/annotations/" + key, "value": annotation})
+		}
+	}
+	return json.Marshal(ops)
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// newRecommendationTestProvider returns a provider keeping the results of the container server of the Deployment web:
+// 430m/64Mi of pod web-a (removed since) at percentile 99 and 200m/32Mi of pod web-b at percentile 90 a minute ago,
+// 900m/256Mi of web-a an hour ago, and 2 cores of the container sidecar and of the Deployment db.
+func newRecommendationTestProvider() *colibriProvider {
+	p := newTestProvider(newTestClient(), DefaultOptions())
+
+	web := workloadRef{APIVersion: "apps/v1", Kind: "Deployment", Name: "web"}
+	db := workloadRef{APIVersion: "apps/v1", Kind: "Deployment", Name: "db"}
+	now := time.Now()
+	for _, result := range []struct {
+		workload   workloadRef
+		container  string
+		pod        string
+		cpu        string
+		ram        string
+		percentile int
+		age        time.Duration
+	}{
+		{workload: web, container: "server", pod: "web-a", cpu: "900m", ram: "256Mi", percentile: 99, age: time.Hour},
+		{workload: web, container: "server", pod: "web-a", cpu: "430m", ram: "64Mi", percentile: 99, age: time.Minute},
+		{workload: web, container: "server", pod: "web-b", cpu: "200m", ram: "32Mi", percentile: 90, age: time.Minute},
+		{workload: web, container: "sidecar", pod: "web-b", cpu: "2", ram: "1Gi", percentile: 90, age: time.Minute},
+		{workload: db, container: "server", pod: "db-0", cpu: "2", ram: "1Gi", percentile: 99, age: time.Minute},
+	} {
+		record := jobRecord{Namespace: "default", Pod: result.pod, Container: result.container, Params: jobParam{Percentile: result.percentile}}
+		p.putContainerResult(record, result.workload, &jobResult{Cpu: result.cpu, Ram: result.ram}, now.Add(-result.age))
+	}
+	return p
+}
+
+func TestRecommendFor(t *testing.T) {
+	web := workloadRef{APIVersion: "apps/v1", Kind: "Deployment", Name: "web"}
+	tests := []struct {
+		name        string
+		policy      RecommendationPolicy
+		workload    workloadRef
+		containers  []string
+		requests    corev1.ResourceList
+		limits      corev1.ResourceList
+		samples     int
+		pods        int
+		percentiles []int
+	}{
+		{
+			name:        "highest result with headroom, rounded up",
+			policy:      RecommendationPolicy{RequestHeadroom: 0.15, LimitHeadroom: 0.5, CPUStep: 10, MemoryStep: 1024 * 1024, MaxAge: 30 * time.Minute},
+			workload:    web,
+			containers:  []string{"server"},
+			requests:    corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m"), corev1.ResourceMemory: resource.MustParse("74Mi")},
+			limits:      corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("650m"), corev1.ResourceMemory: resource.MustParse("96Mi")},
+			samples:     2,
+			pods:        2,
+			percentiles: []int{90, 99},
+		},
+		{
+			name:        "all retained results",
+			policy:      RecommendationPolicy{RequestHeadroom: 0, LimitHeadroom: 1, CPUStep: 100, MemoryStep: 0},
+			workload:    web,
+			containers:  []string{"server"},
+			requests:    corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("900m"), corev1.ResourceMemory: resource.MustParse("256Mi")},
+			limits:      corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1800m"), corev1.ResourceMemory: resource.MustParse("512Mi")},
+			samples:     3,
+			pods:        2,
+			percentiles: []int{90, 99},
+		},
+		{
+			name:        "limits are never below requests",
+			policy:      RecommendationPolicy{RequestHeadroom: 0.5, LimitHeadroom: 0.1, CPUStep: 10, MemoryStep: 1024 * 1024, MaxAge: 30 * time.Minute},
+			workload:    web,
+			containers:  []string{"server"},
+			requests:    corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("650m"), corev1.ResourceMemory: resource.MustParse("96Mi")},
+			limits:      corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("650m"), corev1.ResourceMemory: resource.MustParse("96Mi")},
+			samples:     2,
+			pods:        2,
+			percentiles: []int{90, 99},
+		},
+		{
+			name:        "workload referred by another version",
+			policy:      RecommendationPolicy{MaxAge: 30 * time.Minute},
+			workload:    workloadRef{APIVersion: "apps/v1beta2", Kind: "Deployment", Name: "web"},
+			containers:  []string{"server"},
+			requests:    corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("430m"), corev1.ResourceMemory: resource.MustParse("64Mi")},
+			limits:      corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("430m"), corev1.ResourceMemory: resource.MustParse("64Mi")},
+			samples:     2,
+			pods:        2,
+			percentiles: []int{90, 99},
+		},
+		{
+			name:       "containers not asked for",
+			policy:     DefaultRecommendationPolicy,
+			workload:   web,
+			containers: []string{"proxy"},
+		},
+		{
+			name:       "workload of another group",
+			policy:     DefaultRecommendationPolicy,
+			workload:   workloadRef{APIVersion: "extensions/v1beta1", Kind: "Deployment", Name: "web"},
+			containers: []string{"server"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newRecommendationTestProvider()
+			p.recommendation = tt.policy
+			res := schema.GroupResource{Group: "apps", Resource: "deployments"}
+
+			rec, err := p.recommendFor("default", tt.workload, res, tt.containers)
+			if tt.requests == nil {
+				if !apierr.IsNotFound(err) {
+					t.Fatalf("expected not found, got %v with %+v", err, rec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(rec.Containers) != 1 || rec.Containers[0].Name != "server" {
+				t.Fatalf("expected the recommendation of server only, got %+v", rec.Containers)
+			}
+			got := rec.Containers[0]
+			for name, want := range tt.requests {
+				if q := got.Requests[name]; q.Cmp(want) != 0 {
+					t.Errorf("expected %s request %s, got %s", name, want.String(), q.String())
+				}
+			}
+			for name, want := range tt.limits {
+				if q := got.Limits[name]; q.Cmp(want) != 0 {
+					t.Errorf("expected %s limit %s, got %s", name, want.String(), q.String())
+				}
+			}
+			if got.Confidence.Samples != tt.samples || got.Confidence.Pods != tt.pods || !reflect.DeepEqual(got.Confidence.Percentiles, tt.percentiles) {
+				t.Errorf("expected %d samples of %d pods at %v, got %+v", tt.samples, tt.pods, tt.percentiles, got.Confidence)
+			}
+		})
+	}
+}
@@ -17,13 +17,17 @@ limitations under the License.
 package provider
 
 import (
+	"errors"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/emicklei/go-restful"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
 	"k8s.io/klog/v2"
 
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
@@ -33,6 +37,17 @@ type jobParam struct {
 	Frequency  int `json:"freq" description:"frequency of query" default:"10"`
 	Iteration  int `json:"iter" description:"iteration of query" default:"1000"`
 	Percentile int `json:"pert" description:"percentile of data analytics" default:"99"`
+	Timeout    int `json:"timeout,omitempty" description:"seconds to wait for the result, derived from freq and iter if 0" default:"0"`
+}
+
+// Parameters of a job targeting a process by its container, colibri discovers the process ID
+type containerJobParam struct {
+	Container  string `json:"container" description:"container of the targeted process"`
+	Command    string `json:"command" description:"regular expression matching the command line of the targeted process, the main process of the container if empty"`
+	Frequency  int    `json:"freq" description:"frequency of query" default:"10"`
+	Iteration  int    `json:"iter" description:"iteration of query" default:"1000"`
+	Percentile int    `json:"pert" description:"percentile of data analytics" default:"99"`
+	Timeout    int    `json:"timeout" description:"seconds to wait for the result, derived from freq and iter if 0" default:"0"`
 }
 
 // The returned results could directly used on K8s deployment: with unit tag if required
@@ -43,30 +58,114 @@ type jobResult struct {
 	Egress  string `json:"egress" description:"Egress traffic bandwidth" default:"0k"`
 }
 
+// A result with the time it is stored
+type jobResultSample struct {
+	jobResult
+	Timestamp time.Time `json:"timestamp" description:"Time the result is stored"`
+}
+
 func (p *colibriProvider) webService() *restful.WebService {
 	ws := new(restful.WebService)
 	ws.Path("/colibri").Consumes(restful.MIME_JSON).Produces(restful.MIME_JSON)
 
 	//run Colibri with specified parameters
 	ws.Route(ws.POST("/{namespace}/{pod}/{process}").
+		Filter(p.authorize("create", profilingJobsResource, pathNamespace)).
 		To(p.runJob).
-		Reads(jobParam{}))
-
-	//put result (from colibri job)
+		Reads(jobParam{}).
+		Writes(jobRecord{}))
+
+	//run Colibri for a process found by its container and command
+	ws.Route(ws.POST("/{namespace}/{pod}").
+		Filter(p.authorize("create", profilingJobsResource, pathNamespace)).
+		To(p.runContainerJob).
+		Reads(containerJobParam{}).
+		Writes(jobRecord{}))
+
+	//cancel running jobs of a process
+	ws.Route(ws.DELETE("/{namespace}/{pod}/{process}").
+		Filter(p.authorize("delete", profilingJobsResource, pathNamespace)).
+		To(p.cancelTargetJobs).
+		Writes([]jobRecord{}))
+
+	//cancel a job
+	ws.Route(ws.DELETE("/jobs/{jobId}").
+		Filter(p.authorize("delete", profilingJobsResource, p.jobNamespace)).
+		To(p.cancelJobByID).
+		Writes(jobRecord{}))
+
+	//get status of a job
+	ws.Route(ws.GET("/jobs/{jobId}").
+		Filter(p.authorize("get", profilingJobsResource, p.jobNamespace)).
+		To(p.getJob).
+		Writes(jobRecord{}))
+
+	//list jobs
+	ws.Route(ws.GET("/jobs").
+		Filter(p.authorize("list", profilingJobsResource, queryNamespace)).
+		To(p.listJobs).
+		Param(ws.QueryParameter("namespace", "only jobs targeting the namespace")).
+		Param(ws.QueryParameter("pod", "only jobs targeting the pod")).
+		Param(ws.QueryParameter("process", "only jobs targeting the process")).
+		Param(ws.QueryParameter("state", "only jobs in the state")).
+		Writes([]jobRecord{}))
+
+	//put result (from colibri job), authorized by the result token of job instead of the user
 	ws.Route(ws.POST("/{resultId}").
 		To(p.putResult).
+		Param(ws.HeaderParameter(ResultTokenHeader, "result token given to the job")).
 		Reads(jobResult{}))
 
 	//get parameters
 	ws.Route(ws.GET("/{namespace}/{pod}/{process}/param").
+		Filter(p.authorize("get", profilingJobsResource, pathNamespace)).
 		To(p.getParameter).
 		Writes(jobParam{}))
 
 	//get result
 	ws.Route(ws.GET("/{namespace}/{pod}/{process}").
+		Filter(p.authorize("get", profileResultsResource, pathNamespace)).
 		To(p.getResult).
 		Writes(jobResult{}))
 
+	//get all retained results
+	ws.Route(ws.GET("/{namespace}/{pod}/{process}/history").
+		Filter(p.authorize("get", profileResultsResource, pathNamespace)).
+		To(p.getHistory).
+		Writes([]jobResultSample{}))
+
+	//profile a workload, by a job for each sampled pod
+	ws.Route(ws.POST("/{namespace}/workloads/{kind}/{name}").
+		Filter(p.authorize("create", profilingJobsResource, pathNamespace)).
+		To(p.runWorkload).
+		Reads(workloadParam{}).
+		Writes(workloadRecord{}))
+
+	//get status of a workload profiling
+	ws.Route(ws.GET("/workloads/{workloadId}").
+		Filter(p.authorize("get", profilingJobsResource, p.workloadNamespace)).
+		To(p.getWorkload).
+		Writes(workloadRecord{}))
+
+	//get resources recommended for the containers of a workload
+	ws.Route(ws.GET("/{namespace}/workloads/{kind}/{name}/recommendation").
+		Filter(p.authorize("get", profileResultsResource, pathNamespace)).
+		To(p.getRecommendation).
+		Writes(recommendation{}))
+
+	//patch a workload with its recommended resources, the user must also be allowed to patch the workload to apply it
+	ws.Route(ws.POST("/{namespace}/workloads/{kind}/{name}/recommendation").
+		Filter(p.authorize("create", recommendationsResource, pathNamespace)).
+		To(p.patchWorkloadRecommendation).
+		Reads(recommendationPatchParam{}).
+		Writes(recommendationPatch{}))
+
+	//get aggregated result of a workload
+	ws.Route(ws.GET("/{namespace}/workloads/{kind}/{name}/{process}").
+		Filter(p.authorize("get", profileResultsResource, pathNamespace)).
+		To(p.getWorkloadResult).
+		Writes(jobResultSample{}))
+
 	return ws
 }
 
@@ -100,38 +199,80 @@ func (p *colibriProvider) runJob(request *restful.Request, response *restful.Res
 	pid := request.PathParameter("process")
 
 	klog.Infof("Run Colibri for: " + ns + "." + pname + "." + pid)
-	namespacedName := types.NamespacedName{
-		Name:      pname,
-		Namespace: ns,
-	}
 
 	// check all naming on the path is existing/running compute unit
 	pod, err := p.checkPod(ns, pname)
 	if err != nil {
-		response.WriteError(http.StatusBadRequest, err)
+		writeStatusError(response, err)
 		return
 	}
 
-	//TODO: check what if parameters are not valid numbers
+	// omitted parameters keep their defaults
 	params := new(jobParam)
+	applyDefaults(params)
 	if err := request.ReadEntity(&params); err != nil {
 		response.WriteError(http.StatusBadRequest, err)
 		return
 	}
+	if errs := p.validation.validateParam(params, nil); len(errs) > 0 {
+		writeStatusError(response, apierr.NewInvalid(schema.GroupKind{Group: "colibri", Kind: "jobParam"}, ns+"."+pname+"."+pid, errs))
+		return
+	}
 
-	freqInfo := p.infoWrapper(pid+"-freq", namespacedName)
-	p.values[freqInfo] = *resource.NewQuantity(int64(params.Frequency), resource.DecimalSI)
+	record, err := p.startJob(pod, ns, pname, jobTarget{Process: pid}, params, string(uuid.NewUUID()))
+	if err != nil {
+		writeStatusError(response, err)
+		return
+	}
 
-	iterInfo := p.infoWrapper(pid+"-iter", namespacedName)
-	p.values[iterInfo] = *resource.NewQuantity(int64(params.Iteration), resource.DecimalSI)
+	klog.Infof("Started Colibri job: " + ns + "." + pname + "." + pid)
+	response.WriteEntity(record)
+}
 
-	pertInfo := p.infoWrapper(pid+"-pert", namespacedName)
-	p.values[pertInfo] = *resource.NewQuantity(int64(params.Percentile), resource.DecimalSI)
+// run colibri for a process targeted by its container and command,
+// the process ID is discovered by colibri and recorded with its result
+func (p *colibriProvider) runContainerJob(request *restful.Request, response *restful.Response) {
+	ns := request.PathParameter("namespace")
+	pname := request.PathParameter("pod")
 
-	p.runColibriJob(pod, params, ns, pname, pid)
-	klog.Infof("Started Colibri job: " + ns + "." + pname + "." + pid)
-	response.Write([]byte("Running colibri: " + ns + " " + pname + " " + pid + "\n"))
+	pod, err := p.checkPod(ns, pname)
+	if err != nil {
+		writeStatusError(response, err)
+		return
+	}
+
+	// omitted parameters keep their defaults
+	params := new(containerJobParam)
+	applyDefaults(params)
+	if err := request.ReadEntity(&params); err != nil {
+		response.WriteError(http.StatusBadRequest, err)
+		return
+	}
+	klog.Infof("Run Colibri for: " + ns + "." + pname + " in container " + params.Container)
+
+	jobParams := &jobParam{Frequency: params.Frequency, Iteration: params.Iteration, Percentile: params.Percentile, Timeout: params.Timeout}
+	errs := p.validation.validateParam(jobParams, nil)
+	errs = append(errs, validateContainerTarget(params.Container, params.Command, nil)...)
+	if len(errs) > 0 {
+		writeStatusError(response, apierr.NewInvalid(schema.GroupKind{Group: "colibri", Kind: "containerJobParam"}, ns+"."+pname, errs))
+		return
+	}
+
+	containerID, err := checkContainer(pod, params.Container)
+	if err != nil {
+		writeStatusError(response, err)
+		return
+	}
+
+	target := jobTarget{Container: params.Container, ContainerID: containerID, Command: params.Command}
+	record, err := p.startJob(pod, ns, pname, target, jobParams, string(uuid.NewUUID()))
+	if err != nil {
+		writeStatusError(response, err)
+		return
+	}
 
+	klog.Infof("Started Colibri job: " + ns + "." + pname + " in container " + params.Container)
+	response.WriteEntity(record)
 }
 
 // get parameters of a job
@@ -147,44 +288,111 @@ func (p *colibriProvider) getParameter(request *restful.Request, response *restf
 	}
 	//TODO: check all naming is legel
 	freqInfo := p.infoWrapper(pid+"-freq", namespacedName)
-	freq, found := p.values[freqInfo]
+	freq, found := p.values.Get(freqInfo.CustomMetricInfo, freqInfo.NamespacedName)
 	if !found {
 		response.WriteErrorString(http.StatusBadRequest, provider.NewMetricNotFoundError(freqInfo.GroupResource, freqInfo.Metric).Error())
 		return
 	}
 
 	iterInfo := p.infoWrapper(pid+"-iter", namespacedName)
-	iter, found := p.values[iterInfo]
+	iter, found := p.values.Get(iterInfo.CustomMetricInfo, iterInfo.NamespacedName)
 	if !found {
 		response.WriteErrorString(http.StatusBadRequest, provider.NewMetricNotFoundError(iterInfo.GroupResource, iterInfo.Metric).Error())
 		return
 	}
 
 	pertInfo := p.infoWrapper(pid+"-pert", namespacedName)
-	pert, found := p.values[pertInfo]
+	pert, found := p.values.Get(pertInfo.CustomMetricInfo, pertInfo.NamespacedName)
 	if !found {
 		response.WriteErrorString(http.StatusBadRequest, provider.NewMetricNotFoundError(pertInfo.GroupResource, pertInfo.Metric).Error())
 		return
 	}
 
 	response.WriteEntity(jobParam{
-		Frequency:  int(freq.Value()),
-		Iteration:  int(iter.Value()),
-		Percentile: int(pert.Value()),
+		Frequency:  int(freq.Value.Value()),
+		Iteration:  int(iter.Value.Value()),
+		Percentile: int(pert.Value.Value()),
 	})
 }
 
-func (p *colibriProvider) putMetric(value string, key string, nsname types.NamespacedName) error {
+// putMetric stores a metric of a result, with the container of the process if it is known
+func (p *colibriProvider) putMetric(value string, key string, nsname types.NamespacedName, container string, timestamp time.Time) error {
 	q, err := resource.ParseQuantity(value)
 	if err != nil {
 		return err
 	}
 	info := p.infoWrapper(key, nsname)
-	p.values[info] = q
+	p.values.Add(info.CustomMetricInfo, info.NamespacedName, Sample{Value: q, Timestamp: timestamp, Container: container})
 
 	return nil
 }
 
+// storeResult stores a result put by the job holding token, and returns the ID of the job.
+// Only a launched job can put its result, and only once: its token is consumed before the result is stored,
+// and given back if storing it fails, so the job can put its result again.
+func (p *colibriProvider) storeResult(ns string, pname string, pid string, token string, metrics *jobResult) (string, error) {
+	record, found := p.jobs.consumeResultToken(ns, pname, pid, token)
+	if !found {
+		klog.Errorf("Reject result for %s.%s.%s: no running job holds the token", ns, pname, pid)
+		return "", apierr.NewForbidden(schema.GroupResource{Group: ColibriGroup, Resource: profileResultsResource}, ns+"."+pname+"."+pid,
+			errors.New("no running job of the process holds the result token"))
+	}
+
+	namespacedName := types.NamespacedName{
+		Name:      pname,
+		Namespace: ns,
+	}
+
+	// all metrics of a result share the same timestamp, so they can be matched in history
+	now := time.Now()
+	var stored []string
+	for _, metric := range []struct {
+		key   string
+		value string
+	}{
+		{key: "-cpu", value: metrics.Cpu},
+		{key: "-ram", value: metrics.Ram},
+		{key: "-ig", value: metrics.Ingress},
+		{key: "-eg", value: metrics.Egress},
+	} {
+		if err := p.putMetric(metric.value, pid+metric.key, namespacedName, record.Container, now); err != nil {
+			klog.Errorf("Failed to store result of job %s for %s.%s.%s: %v", record.ID, ns, pname, pid, err)
+			p.rollbackResult(record, token, stored, namespacedName, now)
+			return "", err
+		}
+		stored = append(stored, pid+metric.key)
+	}
+
+	if record.resolveProcess {
+		klog.Infof("Job %s resolved process %s in container %s", record.ID, pid, record.Container)
+		p.putParams(ns, pname, pid, &record.Params, record.CreatedAt)
+	}
+
+	// the result is kept for the recommendations of the workload of the pod, even after the pod is removed
+	ref, err := p.podWorkload(ns, pname)
+	if err != nil {
+		klog.Errorf("Failed to find workload of pod %s/%s, result of job %s is not kept for recommendations: %v", ns, pname, record.ID, err)
+	} else {
+		p.putContainerResult(record, ref, metrics, now)
+	}
+	p.sinkResult(record, ref, pid, metrics, now)
+
+	return record.ID, nil
+}
+
+// rollbackResult removes the metrics of a result stored partially, and gives the token back to its job
+func (p *colibriProvider) rollbackResult(record jobRecord, token string, keys []string, name types.NamespacedName, timestamp time.Time) {
+	for _, key := range keys {
+		info := p.infoWrapper(key, name)
+		p.values.DeleteSample(info.CustomMetricInfo, info.NamespacedName, timestamp)
+	}
+	restored, found := p.jobs.restoreResultToken(record.ID, token)
+	// the job is finished meanwhile, without a result
+	if found && restored.State.finished() {
+		p.removeParams(restored)
+	}
+}
+
 func (p *colibriProvider) putResult(request *restful.Request, response *restful.Response) {
 
 	klog.Infof("Get request for putting result")
@@ -202,87 +410,308 @@ func (p *colibriProvider) putResult(request *restful.Request, response *restful.
 		return
 	}
 
-	//TODO: check what if parameters are not valid numbers
+	// omitted metrics keep their defaults
 	metrics := new(jobResult)
+	applyDefaults(metrics)
 	if err := request.ReadEntity(&metrics); err != nil {
 		response.WriteError(http.StatusBadRequest, err)
 		return
 	}
-
-	namespacedName := types.NamespacedName{
-		Name:      pname,
-		Namespace: ns,
-	}
-
-	if err := p.putMetric(metrics.Cpu, pid+"-cpu", namespacedName); err != nil {
-		response.WriteError(http.StatusInternalServerError, err)
+	if errs := validateResult(metrics, nil); len(errs) > 0 {
+		writeStatusError(response, apierr.NewInvalid(schema.GroupKind{Group: "colibri", Kind: "jobResult"}, ns+"."+pname+"."+pid, errs))
 		return
 	}
 
-	if err := p.putMetric(metrics.Ram, pid+"-ram", namespacedName); err != nil {
-		response.WriteError(http.StatusInternalServerError, err)
+	jobID, err := p.storeResult(ns, pname, pid, request.HeaderParameter(ResultTokenHeader), metrics)
+	if err != nil {
+		writeStatusError(response, err)
 		return
 	}
 
-	if err := p.putMetric(metrics.Ingress, pid+"-ig", namespacedName); err != nil {
-		response.WriteError(http.StatusInternalServerError, err)
-		return
+	klog.Infof("Put result of job %s for: %s.%s.%s", jobID, ns, pname, pid)
+	response.Write([]byte("Put Colibri result: " + ns + "." + pname + "." + pid + "\n"))
+
+}
+
+func (p *colibriProvider) getResult(request *restful.Request, response *restful.Response) {
+
+	ns := request.PathParameter("namespace")
+	pname := request.PathParameter("pod")
+	pid := request.PathParameter("process")
+
+	klog.Infof("Get results of: " + ns + " " + pname + " " + pid)
+	namespacedName := types.NamespacedName{
+		Name:      pname,
+		Namespace: ns,
 	}
 
-	if err := p.putMetric(metrics.Egress, pid+"-eg", namespacedName); err != nil {
-		response.WriteError(http.StatusInternalServerError, err)
+	result, err := p.latestResult(namespacedName, pid)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, err.Error())
 		return
 	}
 
-	klog.Infof("Put result for: " + ns + "." + pname + "." + pid)
-	response.Write([]byte("Put Colibri result: " + ns + "." + pname + "." + pid + "\n"))
+	response.WriteEntity(result.jobResult)
+}
 
+// latestResult returns the latest result of a process, with the time it is stored
+func (p *colibriProvider) latestResult(namespacedName types.NamespacedName, pid string) (jobResultSample, error) {
+	result := jobResultSample{}
+	for _, metric := range []struct {
+		key   string
+		field *string
+	}{
+		{key: "-cpu", field: &result.Cpu},
+		{key: "-ram", field: &result.Ram},
+		{key: "-ig", field: &result.Ingress},
+		{key: "-eg", field: &result.Egress},
+	} {
+		info := p.infoWrapper(pid+metric.key, namespacedName)
+		sample, found := p.values.Get(info.CustomMetricInfo, info.NamespacedName)
+		if !found {
+			return result, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+		}
+		*metric.field = sample.Value.String()
+		result.Timestamp = sample.Timestamp
+	}
+
+	return result, nil
 }
 
-func (p *colibriProvider) getResult(request *restful.Request, response *restful.Response) {
+// get all retained results of a job, oldest first
+func (p *colibriProvider) getHistory(request *restful.Request, response *restful.Response) {
 
 	ns := request.PathParameter("namespace")
 	pname := request.PathParameter("pod")
 	pid := request.PathParameter("process")
 
-	klog.Infof("Get results of: " + ns + " " + pname + " " + pid)
+	klog.Infof("Get result history of: " + ns + " " + pname + " " + pid)
 	namespacedName := types.NamespacedName{
 		Name:      pname,
 		Namespace: ns,
 	}
 
+	// results are indexed by the cpu series, other metrics are matched by timestamp
 	cpuInfo := p.infoWrapper(pid+"-cpu", namespacedName)
-	cpu, found := p.values[cpuInfo]
-	if !found {
+	cpuSeries := p.values.History(cpuInfo.CustomMetricInfo, cpuInfo.NamespacedName)
+	if len(cpuSeries) == 0 {
 		response.WriteErrorString(http.StatusBadRequest, provider.NewMetricNotFoundError(cpuInfo.GroupResource, cpuInfo.Metric).Error())
 		return
 	}
 
-	ramInfo := p.infoWrapper(pid+"-ram", namespacedName)
-	ram, found := p.values[ramInfo]
+	history := make([]jobResultSample, len(cpuSeries))
+	index := make(map[time.Time]int, len(cpuSeries))
+	for i, sample := range cpuSeries {
+		history[i].Timestamp = sample.Timestamp
+		history[i].Cpu = sample.Value.String()
+		index[sample.Timestamp] = i
+	}
+
+	for _, metric := range []struct {
+		key   string
+		field func(*jobResultSample) *string
+	}{
+		{key: "-ram", field: func(r *jobResultSample) *string { return &r.Ram }},
+		{key: "-ig", field: func(r *jobResultSample) *string { return &r.Ingress }},
+		{key: "-eg", field: func(r *jobResultSample) *string { return &r.Egress }},
+	} {
+		info := p.infoWrapper(pid+metric.key, namespacedName)
+		for _, sample := range p.values.History(info.CustomMetricInfo, info.NamespacedName) {
+			if i, found := index[sample.Timestamp]; found {
+				*metric.field(&history[i]) = sample.Value.String()
+			}
+		}
+	}
+
+	response.WriteEntity(history)
+}
+
+// get the record of a job
+func (p *colibriProvider) getJob(request *restful.Request, response *restful.Response) {
+	id := request.PathParameter("jobId")
+
+	record, found := p.jobs.get(id)
 	if !found {
-		response.WriteErrorString(http.StatusBadRequest, provider.NewMetricNotFoundError(ramInfo.GroupResource, ramInfo.Metric).Error())
+		response.WriteErrorString(http.StatusNotFound, "Job "+id+" is not existed\n")
 		return
 	}
+	response.WriteEntity(record)
+}
 
-	igInfo := p.infoWrapper(pid+"-ig", namespacedName)
-	ig, found := p.values[igInfo]
-	if !found {
-		response.WriteErrorString(http.StatusBadRequest, provider.NewMetricNotFoundError(igInfo.GroupResource, igInfo.Metric).Error())
+// list the records of jobs, filtered by query parameters
+func (p *colibriProvider) listJobs(request *restful.Request, response *restful.Response) {
+	ns := request.QueryParameter("namespace")
+	pname := request.QueryParameter("pod")
+	pid := request.QueryParameter("process")
+	state := JobState(request.QueryParameter("state"))
+
+	response.WriteEntity(p.jobs.list(func(r *jobRecord) bool {
+		return (ns == "" || r.Namespace == ns) &&
+			(pname == "" || r.Pod == pname) &&
+			(pid == "" || r.Process == pid) &&
+			(state == "" || r.State == state)
+	}))
+}
+
+// cancel a job by its ID
+func (p *colibriProvider) cancelJobByID(request *restful.Request, response *restful.Response) {
+	id := request.PathParameter("jobId")
+
+	record, err := p.cancelJob(id)
+	if err != nil {
+		writeStatusError(response, err)
+		return
+	}
+	response.WriteEntity(record)
+}
+
+// cancel all jobs of a process which are not finished yet
+func (p *colibriProvider) cancelTargetJobs(request *restful.Request, response *restful.Response) {
+	ns := request.PathParameter("namespace")
+	pname := request.PathParameter("pod")
+	pid := request.PathParameter("process")
+
+	klog.Infof("Cancel Colibri for: " + ns + "." + pname + "." + pid)
+	running := p.jobs.list(func(r *jobRecord) bool {
+		return r.Namespace == ns && r.Pod == pname && r.Process == pid && !r.State.finished()
+	})
+	if len(running) == 0 {
+		response.WriteErrorString(http.StatusNotFound, "No running job for: "+ns+"."+pname+"."+pid+"\n")
+		return
+	}
+
+	records := make([]jobRecord, 0, len(running))
+	for _, r := range running {
+		record, err := p.cancelJob(r.ID)
+		if err != nil {
+			writeStatusError(response, err)
+			return
+		}
+		records = append(records, record)
+	}
+	response.WriteEntity(records)
+}
+
+// profile the pods of a workload, with the same parameters for all jobs
+func (p *colibriProvider) runWorkload(request *restful.Request, response *restful.Response) {
+	ns := request.PathParameter("namespace")
+	kind := request.PathParameter("kind")
+	name := request.PathParameter("name")
+
+	klog.Infof("Run Colibri for workload: " + ns + "." + kind + "." + name)
+
+	// omitted parameters keep their defaults
+	params := new(workloadParam)
+	applyDefaults(params)
+	if err := request.ReadEntity(&params); err != nil {
+		response.WriteError(http.StatusBadRequest, err)
+		return
+	}
+	if errs := p.validation.validateWorkloadParam(params); len(errs) > 0 {
+		writeStatusError(response, apierr.NewInvalid(schema.GroupKind{Group: "colibri", Kind: "workloadParam"}, ns+"."+kind+"."+name, errs))
 		return
 	}
 
-	egInfo := p.infoWrapper(pid+"-eg", namespacedName)
-	eg, found := p.values[egInfo]
+	record, err := p.startWorkloadJob(ns, kind, name, params)
+	if err != nil {
+		writeStatusError(response, err)
+		return
+	}
+
+	klog.Infof("Started Colibri jobs of workload: " + ns + "." + kind + "." + name)
+	response.WriteEntity(record)
+}
+
+// get the record of a workload profiling
+func (p *colibriProvider) getWorkload(request *restful.Request, response *restful.Response) {
+	id := request.PathParameter("workloadId")
+
+	record, found := p.workloads.get(id)
 	if !found {
-		response.WriteErrorString(http.StatusBadRequest, provider.NewMetricNotFoundError(egInfo.GroupResource, egInfo.Metric).Error())
+		response.WriteErrorString(http.StatusNotFound, "Workload profiling "+id+" is not existed\n")
 		return
 	}
+	response.WriteEntity(record)
+}
 
-	response.WriteEntity(jobResult{
-		Cpu:     cpu.String(),
-		Ram:     ram.String(),
-		Ingress: ig.String(),
-		Egress:  eg.String(),
-	})
+// get the latest aggregated result of a workload
+func (p *colibriProvider) getWorkloadResult(request *restful.Request, response *restful.Response) {
+	ns := request.PathParameter("namespace")
+	kind := request.PathParameter("kind")
+	name := request.PathParameter("name")
+	pid := request.PathParameter("process")
+
+	result, err := p.latestWorkloadResult(ns, kind, name, pid)
+	if err != nil {
+		writeStatusError(response, err)
+		return
+	}
+	response.WriteEntity(result)
+}
+
+// get resources recommended for the containers of a workload, from the results of its pods
+func (p *colibriProvider) getRecommendation(request *restful.Request, response *restful.Response) {
+	ns := request.PathParameter("namespace")
+	kind := request.PathParameter("kind")
+	name := request.PathParameter("name")
+
+	klog.Infof("Recommend resources of: " + ns + " " + kind + " " + name)
+	rec, err := p.recommend(ns, kind, name)
+	if err != nil {
+		writeStatusError(response, err)
+		return
+	}
+	response.WriteEntity(rec)
+}
+
+// patch a workload, or the workload controlling a pod, with its recommended resources
+func (p *colibriProvider) patchWorkloadRecommendation(request *restful.Request, response *restful.Response) {
+	ns := request.PathParameter("namespace")
+	kind := request.PathParameter("kind")
+	name := request.PathParameter("name")
+
+	// omitted parameters keep their defaults
+	params := new(recommendationPatchParam)
+	applyDefaults(params)
+	if err := request.ReadEntity(&params); err != nil {
+		response.WriteError(http.StatusBadRequest, err)
+		return
+	}
+	if errs := validateRecommendationPatchParam(params); len(errs) > 0 {
+		writeStatusError(response, apierr.NewInvalid(schema.GroupKind{Group: "colibri", Kind: "recommendationPatchParam"}, ns+"."+kind+"."+name, errs))
+		return
+	}
+
+	workload, res, gvk, err := p.owningWorkload(ns, kind, name)
+	if err != nil {
+		writeStatusError(response, err)
+		return
+	}
+	// the workload is patched by the adapter, on behalf of the user
+	if params.Mode == patchModeApply {
+		if err := p.authorizeOn(request, "patch", res.GroupResource(), ns, workload.GetName()); err != nil {
+			writeStatusError(response, err)
+			return
+		}
+	}
+
+	klog.Infof("Patch recommendation of: " + ns + " " + gvk.Kind + " " + workload.GetName() + " in " + params.Mode + " mode")
+	patch, err := p.patchRecommendation(workload, res, gvk, params, requestUser(request))
+	if err != nil {
+		writeStatusError(response, err)
+		return
+	}
+	response.WriteEntity(patch)
+}
+
+// write err as a metav1.Status with the HTTP code carried by K8s API errors, 500 for others
+func writeStatusError(response *restful.Response, err error) {
+	status, ok := err.(apierr.APIStatus)
+	if !ok {
+		status = apierr.NewInternalError(err)
+	}
+	s := status.Status()
+	s.Kind = "Status"
+	s.APIVersion = "v1"
+	response.WriteHeaderAndEntity(int(s.Code), s)
 }
@@ -0,0 +1,229 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+// resultAnnotationPrefix is followed by the process ID in the annotation of a pod holding the latest result of the process
+const resultAnnotationPrefix = "colibri.io/result-"
+
+// latestResultAnnotation of a workload holds the latest result of its pods
+const latestResultAnnotation = "colibri.io/latest-result"
+
+// ResultSummary is the compact summary of a stored result
+type ResultSummary struct {
+	Pod        string    `json:"pod"`
+	Process    string    `json:"process"`
+	Container  string    `json:"container,omitempty"`
+	Cpu        string    `json:"cpu"`
+	Ram        string    `json:"ram"`
+	Ingress    string    `json:"ingress"`
+	Egress     string    `json:"egress"`
+	Percentile int       `json:"pert"`
+	Timestamp  time.Time `json:"timestamp"`
+	JobID      string    `json:"job"`
+}
+
+// ResultTarget is the pod a result is of, with the workload controlling it
+type ResultTarget struct {
+	Namespace string
+	Pod       string
+	// Workload is the resource of the workload, empty if the pod is not controlled by a workload
+	Workload     schema.GroupVersionResource
+	WorkloadName string
+}
+
+// ResultSink writes the summary of each result stored by provider out of the adapter
+type ResultSink interface {
+	// PutResult writes the summary of a result of target
+	PutResult(target ResultTarget, summary ResultSummary) error
+}
+
+// annotationSink writes results as annotations of the pods and their workloads
+type annotationSink struct {
+	client dynamic.Interface
+}
+
+// NewAnnotationSink returns the sink writing the latest result of a process as an annotation of its pod,
+// colibri.io/result-<processId>, and the latest result of the pods of a workload as colibri.io/latest-result of the workload.
+// The results are kept by K8s, visible by kubectl describe.
+func NewAnnotationSink(client dynamic.Interface) ResultSink {
+	return &annotationSink{client: client}
+}
+
+func (s *annotationSink) PutResult(target ResultTarget, summary ResultSummary) error {
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	podResource := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+	if err := s.annotate(podResource, target.Namespace, target.Pod, resultAnnotationPrefix+summary.Process, string(data)); err != nil {
+		return err
+	}
+	if target.WorkloadName == "" {
+		return nil
+	}
+	return s.annotate(target.Workload, target.Namespace, target.WorkloadName, latestResultAnnotation, string(data))
+}
+
+// annotate sets an annotation of an object by a merge patch, keeping its other annotations
+func (s *annotationSink) annotate(res schema.GroupVersionResource, ns string, name string, key string, value string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{key: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Resource(res).Namespace(ns).Patch(context.TODO(), name, types.MergePatchType, patch, metav1.PatchOptions{
+		FieldManager: patchFieldManager,
+	})
+	return err
+}
+
+// how many times writing a result to the sink is retried before it is dropped
+const maxSinkRetries = 5
+
+// the process of a pod whose latest result is written to the sink
+type sinkKey struct {
+	namespace string
+	pod       string
+	process   string
+}
+
+type sinkItem struct {
+	target  ResultTarget
+	summary ResultSummary
+}
+
+// sinkQueue writes results to a sink out of the paths storing them, by a worker.
+// A result waiting in the queue is replaced by a newer result of the same process.
+type sinkQueue struct {
+	sink  ResultSink
+	queue workqueue.RateLimitingInterface
+
+	mu      sync.Mutex
+	pending map[sinkKey]sinkItem
+}
+
+func newSinkQueue(sink ResultSink) *sinkQueue {
+	return &sinkQueue{
+		sink:    sink,
+		queue:   workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "results"),
+		pending: make(map[sinkKey]sinkItem),
+	}
+}
+
+func (q *sinkQueue) add(target ResultTarget, summary ResultSummary) {
+	key := sinkKey{namespace: target.Namespace, pod: target.Pod, process: summary.Process}
+	q.mu.Lock()
+	q.pending[key] = sinkItem{target: target, summary: summary}
+	q.mu.Unlock()
+	q.queue.Add(key)
+}
+
+// run writes the queued results until stopCh is closed
+func (q *sinkQueue) run(stopCh <-chan struct{}) {
+	go wait.Until(func() {
+		for q.processNextItem() {
+		}
+	}, time.Second, stopCh)
+	<-stopCh
+	q.queue.ShutDown()
+}
+
+func (q *sinkQueue) processNextItem() bool {
+	obj, quit := q.queue.Get()
+	if quit {
+		return false
+	}
+	defer q.queue.Done(obj)
+
+	key := obj.(sinkKey)
+	q.mu.Lock()
+	item, found := q.pending[key]
+	delete(q.pending, key)
+	q.mu.Unlock()
+	if !found {
+		q.queue.Forget(key)
+		return true
+	}
+
+	if err := q.sink.PutResult(item.target, item.summary); err != nil {
+		if q.queue.NumRequeues(key) >= maxSinkRetries {
+			klog.Errorf("Failed to write result of job %s, dropped: %v", item.summary.JobID, err)
+			q.queue.Forget(key)
+			return true
+		}
+		klog.Errorf("Failed to write result of job %s, retrying: %v", item.summary.JobID, err)
+		q.mu.Lock()
+		if _, newer := q.pending[key]; !newer {
+			q.pending[key] = item
+		}
+		q.mu.Unlock()
+		q.queue.AddRateLimited(key)
+		return true
+	}
+	q.queue.Forget(key)
+	return true
+}
+
+// sinkResult queues a result stored for a job to be written to the sink of provider, if there is one.
+// ref is the workload of the pod, empty if it is unknown. The result is already stored, so failures are only logged.
+func (p *colibriProvider) sinkResult(record jobRecord, ref workloadRef, pid string, metrics *jobResult, timestamp time.Time) {
+	if p.sinks == nil {
+		return
+	}
+
+	target := ResultTarget{Namespace: record.Namespace, Pod: record.Pod}
+	if ref.Name != "" && ref.groupKind() != (schema.GroupKind{Kind: "Pod"}) {
+		res, err := p.resourceOf(ref)
+		if err != nil {
+			klog.Errorf("Failed to find resource of %s %s: %v", ref.Kind, ref.Name, err)
+		} else {
+			target.Workload, target.WorkloadName = res, ref.Name
+		}
+	}
+
+	p.sinks.add(target, ResultSummary{
+		Pod:        record.Pod,
+		Process:    pid,
+		Container:  record.Container,
+		Cpu:        metrics.Cpu,
+		Ram:        metrics.Ram,
+		Ingress:    metrics.Ingress,
+		Egress:     metrics.Egress,
+		Percentile: record.Params.Percentile,
+		Timestamp:  timestamp,
+		JobID:      record.ID,
+	})
+}
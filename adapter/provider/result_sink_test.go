@@ -0,0 +1,141 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func TestAnnotationSink(t *testing.T) {
+	podResource := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	summary := ResultSummary{Pod: "web-1-a", Process: "1", Container: "server", Cpu: "250m", Ram: "64Mi", Percentile: 99, JobID: "job"}
+	want, err := json.Marshal(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		target   ResultTarget
+		workload bool
+	}{
+		{name: "pod of a workload", target: ResultTarget{Namespace: "default", Pod: "web-1-a", Workload: deployments, WorkloadName: "web"}, workload: true},
+		{name: "pod of no workload", target: ResultTarget{Namespace: "default", Pod: "web-1-a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newTestObject("v1", "Pod", "default", "web-1-a", nil)
+			pod.SetAnnotations(map[string]string{"other": "kept"})
+			client := fake.NewSimpleDynamicClient(runtime.NewScheme(), pod, newTestObject("apps/v1", "Deployment", "default", "web", nil))
+
+			if err := NewAnnotationSink(client).PutResult(tt.target, summary); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			pod, err := client.Resource(podResource).Namespace("default").Get(context.TODO(), "web-1-a", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pod.GetAnnotations(); !reflect.DeepEqual(got, map[string]string{"other": "kept", resultAnnotationPrefix + "1": string(want)}) {
+				t.Errorf("unexpected annotations of pod: %v", got)
+			}
+			workload, err := client.Resource(deployments).Namespace("default").Get(context.TODO(), "web", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, found := workload.GetAnnotations()[latestResultAnnotation]; found != tt.workload || (found && got != string(want)) {
+				t.Errorf("unexpected annotations of workload: %v", workload.GetAnnotations())
+			}
+		})
+	}
+}
+
+// recordingSink records the results put to it, after failing the first fails of them
+type recordingSink struct {
+	mu      sync.Mutex
+	fails   int
+	results []ResultTarget
+}
+
+func (s *recordingSink) PutResult(target ResultTarget, summary ResultSummary) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fails > 0 {
+		s.fails--
+		return errors.New("unavailable")
+	}
+	s.results = append(s.results, target)
+	return nil
+}
+
+func (s *recordingSink) written() []ResultTarget {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ResultTarget(nil), s.results...)
+}
+
+func TestSinkResult(t *testing.T) {
+	tests := []struct {
+		name  string
+		ref   workloadRef
+		fails int
+		want  ResultTarget
+	}{
+		{name: "workload mapped by the group version of its ref", ref: workloadRef{APIVersion: "apps/v1", Kind: "Deployment", Name: "web"},
+			want: ResultTarget{Namespace: "default", Pod: "web-1-a", Workload: schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}, WorkloadName: "web"}},
+		{name: "workload of an unknown group", ref: workloadRef{APIVersion: "example.com/v1", Kind: "Deployment", Name: "web"},
+			want: ResultTarget{Namespace: "default", Pod: "web-1-a"}},
+		{name: "pod of no workload", ref: workloadRef{APIVersion: "v1", Kind: "Pod", Name: "web-1-a"},
+			want: ResultTarget{Namespace: "default", Pod: "web-1-a"}},
+		{name: "workload unknown", want: ResultTarget{Namespace: "default", Pod: "web-1-a"}},
+		{name: "retried", ref: workloadRef{APIVersion: "v1", Kind: "Pod", Name: "web-1-a"}, fails: 2,
+			want: ResultTarget{Namespace: "default", Pod: "web-1-a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{fails: tt.fails}
+			opts := DefaultOptions()
+			opts.Sink = sink
+			p := newTestProvider(newTestClient(), opts)
+
+			record := jobRecord{ID: "job", Namespace: "default", Pod: "web-1-a", Container: "server"}
+			p.sinkResult(record, tt.ref, "1", &jobResult{Cpu: "250m"}, time.Now())
+
+			if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+				return len(sink.written()) > 0, nil
+			}); err != nil {
+				t.Fatalf("result is not written: %v", err)
+			}
+			if got := sink.written(); !reflect.DeepEqual(got, []ResultTarget{tt.want}) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
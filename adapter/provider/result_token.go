@@ -0,0 +1,89 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+)
+
+// ResultTokenHeader carries the per-job credential when a colibri job puts its result
+const ResultTokenHeader = "X-Colibri-Result-Token"
+
+// newResultToken mints a random credential for a job, and returns it with its hash kept by provider
+func newResultToken() (string, []byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashResultToken(token), nil
+}
+
+func hashResultToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// consumeResultToken finds the unfinished job of a process holding token, and expires the token before the result
+// is stored, so a job puts only one result. A job targeting the process by its container takes the process ID of the result.
+// It returns the record of the job, and whether it is found.
+func (t *jobTracker) consumeResultToken(namespace string, pod string, process string, token string) (jobRecord, bool) {
+	if token == "" {
+		return jobRecord{}, false
+	}
+	hash := hashResultToken(token)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, record := range t.jobs {
+		if record.Namespace != namespace || record.Pod != pod || record.State.finished() {
+			continue
+		}
+		if record.Process != process && !(record.resolveProcess && record.Process == "") {
+			continue
+		}
+		if record.tokenHash != nil && subtle.ConstantTimeCompare(record.tokenHash, hash) == 1 {
+			record.tokenHash = nil
+			record.resultPut = true
+			record.Process = process
+			return *record, true
+		}
+	}
+	return jobRecord{}, false
+}
+
+// restoreResultToken gives back the token consumed by a job whose result failed to be stored,
+// so the job can put its result again. It returns the record of the job, and whether it is found.
+func (t *jobTracker) restoreResultToken(id string, token string) (jobRecord, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	record, found := t.jobs[id]
+	if !found {
+		return jobRecord{}, false
+	}
+	record.tokenHash = hashResultToken(token)
+	record.resultPut = false
+	if record.resolveProcess {
+		record.Process = ""
+	}
+	return *record, true
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"net/http"
+	"testing"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestResultToken(t *testing.T) {
+	runner := &countingRunner{runs: map[string]int{}, specs: map[string]JobSpec{}}
+	p := newJobTestProvider(t, runner)
+	token := runner.specs["job"].Token
+	if token == "" {
+		t.Fatalf("expected a result token given to the job")
+	}
+	result := &jobResult{Cpu: "250m", Ram: "64Mi", Ingress: "10k", Egress: "20k"}
+
+	for name, put := range map[string]struct {
+		pid   string
+		token string
+	}{
+		"no token":          {pid: "1"},
+		"unknown token":     {pid: "1", token: "unknown"},
+		"another process":   {pid: "2", token: token},
+		"token of its hash": {pid: "1", token: string(hashResultToken(token))},
+	} {
+		if _, err := p.storeResult("default", "web-0", put.pid, put.token, result); !apierr.IsForbidden(err) {
+			t.Errorf("expected Forbidden with %s, got %v", name, err)
+		}
+	}
+
+	// the token is given back when the result fails to be stored, so the job can put its result again
+	if _, err := p.storeResult("default", "web-0", "1", token, &jobResult{Cpu: "100m", Ram: "a lot", Ingress: "0", Egress: "0"}); err == nil {
+		t.Fatalf("expected an invalid result not stored")
+	}
+	if record, _ := p.jobs.get("job"); record.tokenHash == nil || record.resultPut {
+		t.Fatalf("expected the token given back after storing the result failed")
+	}
+	info := p.infoWrapper("1-cpu", types.NamespacedName{Namespace: "default", Name: "web-0"})
+	if _, found := p.values.Get(info.CustomMetricInfo, info.NamespacedName); found {
+		t.Fatalf("expected the metrics of the result failed to be stored removed")
+	}
+
+	id, err := p.storeResult("default", "web-0", "1", token, result)
+	if err != nil || id != "job" {
+		t.Fatalf("expected the result of job stored, got %s: %v", id, err)
+	}
+	if record, _ := p.jobs.get("job"); record.tokenHash != nil || !record.resultPut {
+		t.Errorf("expected the token consumed once the result is stored")
+	}
+	if _, err := p.storeResult("default", "web-0", "1", token, result); !apierr.IsForbidden(err) {
+		t.Errorf("expected Forbidden for the second result, got %v", err)
+	}
+
+	// the token is given by its header on the web service
+	runner = &countingRunner{runs: map[string]int{}, specs: map[string]JobSpec{}}
+	p = newJobTestProvider(t, runner)
+	body := `{"cpu": "250m", "ram": "64Mi", "ingress": "10k", "egress": "20k"}`
+	if recorder := serveRequest(p, http.MethodPost, "/colibri/default.web-0.1", body); recorder.Code != http.StatusForbidden {
+		t.Errorf("expected %d without token, got %d", http.StatusForbidden, recorder.Code)
+	}
+	if recorder := serveRequest(p, http.MethodPost, "/colibri/default.web-0.1", body, ResultTokenHeader, runner.specs["job"].Token); recorder.Code != http.StatusOK {
+		t.Errorf("expected %d with the token, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestResultTokenOfContainerJob(t *testing.T) {
+	runner := &countingRunner{runs: map[string]int{}, specs: map[string]JobSpec{}}
+	p := newJobTestProvider(t, runner)
+	pod, err := p.checkPod("default", "web-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := &jobParam{Frequency: 10, Iteration: 1000, Percentile: 99}
+	if _, err := p.startJob(pod, "default", "web-0", jobTarget{Container: "server", ContainerID: "containerd://server"}, params, "container-job"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the process discovered by colibri is taken from the result
+	id, err := p.storeResult("default", "web-0", "42", runner.specs["container-job"].Token, &jobResult{Cpu: "1", Ram: "1Mi", Ingress: "1k", Egress: "1k"})
+	if err != nil || id != "container-job" {
+		t.Fatalf("expected the result of container-job stored, got %s: %v", id, err)
+	}
+	if record, _ := p.jobs.get("container-job"); record.Process != "42" {
+		t.Errorf("expected process 42 resolved, got %q", record.Process)
+	}
+	info := p.infoWrapper("42-freq", types.NamespacedName{Namespace: "default", Name: "web-0"})
+	if _, found := p.values.Get(info.CustomMetricInfo, info.NamespacedName); !found {
+		t.Errorf("expected the parameters of the resolved process stored")
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// JobSpec is what a runner needs to know to run colibri for a job
+type JobSpec struct {
+	// ID of the job record
+	ID string
+	// the targeted process, by its ID, or by its container when Process is empty
+	Namespace string
+	Pod       string
+	Process   string
+	// Container is the name of the targeted container, ContainerID is its runtime ID, e.g. containerd://<id>
+	Container   string
+	ContainerID string
+	// Command matches the command line of the targeted process in the container, the main process if empty
+	Command string
+	// NodeName is the node of the targeted pod
+	NodeName   string
+	Frequency  int
+	Iteration  int
+	Percentile int
+	// ResultID is the path colibri puts its result to.
+	// When the process is targeted by its container, it is <namespace>.<pod> and colibri appends .<processId> it discovers.
+	ResultID string
+	// Token is the credential colibri puts its result with, in header ResultTokenHeader
+	Token string
+	// Retries is how many times colibri is run again after it failed, within Timeout of the job
+	Retries int
+	Timeout time.Duration
+}
+
+// JobRef identifies what a runner started for a job
+type JobRef struct {
+	Namespace string
+	Name      string
+}
+
+// JobReporter receives the state changes of a job
+type JobReporter func(state JobState, reason string)
+
+// NodeRunner is a JobRunner running colibri on the node of the targeted pod,
+// so the node must be Ready, schedulable, and its taints tolerated before a job is run
+type NodeRunner interface {
+	JobRunner
+	// Tolerations returns the tolerations colibri runs with
+	Tolerations() ([]corev1.Toleration, error)
+}
+
+// OrphanCollector is a JobRunner leaving the jobs of a stopped adapter behind, to be collected on startup
+type OrphanCollector interface {
+	JobRunner
+	// CollectOrphans deletes the jobs of the adapters no longer running
+	CollectOrphans() error
+}
+
+// JobRunner runs colibri for the jobs of provider
+type JobRunner interface {
+	// Run starts colibri for job, and reports its state changes to report until it is finished
+	Run(job JobSpec, report JobReporter) (JobRef, error)
+	// Stop terminates colibri started for ref, it is not an error if it is already gone
+	Stop(ref JobRef) error
+}
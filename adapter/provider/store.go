@@ -0,0 +1,191 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// Sample is a value of a metric at the time it is stored
+type Sample struct {
+	Value     resource.Quantity `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+	// Container is the container of the process a result is measured of, empty if it is not known
+	Container string `json:"container,omitempty"`
+}
+
+// DeepCopy returns a copy of the sample, Quantity caches its string form
+func (s Sample) DeepCopy() Sample {
+	s.Value = s.Value.DeepCopy()
+	return s
+}
+
+// MetricStore keeps the values of colibri metrics (job parameters and results) as time series.
+// It is shared by the REST handlers and the custom metrics API,
+// so implementations must be safe for concurrent use.
+type MetricStore interface {
+	// Get returns the latest sample of a metric of an object, and whether it is found
+	Get(info provider.CustomMetricInfo, name types.NamespacedName) (Sample, bool)
+	// Add appends a sample to the series of a metric of an object
+	Add(info provider.CustomMetricInfo, name types.NamespacedName, sample Sample)
+	// History returns all retained samples of a metric of an object, oldest first
+	History(info provider.CustomMetricInfo, name types.NamespacedName) []Sample
+	// Delete removes the whole series of a metric of an object, no-op if it is not found
+	Delete(info provider.CustomMetricInfo, name types.NamespacedName)
+	// DeleteSample removes the samples stored at timestamp from the series of a metric of an object
+	DeleteSample(info provider.CustomMetricInfo, name types.NamespacedName, timestamp time.Time)
+	// ListMetricInfos returns the unique infos of all stored metrics
+	ListMetricInfos() []provider.CustomMetricInfo
+	// ListNames returns the objects having a series of the metric
+	ListNames(info provider.CustomMetricInfo) []types.NamespacedName
+}
+
+// memoryStore is a MetricStore keeping all series in memory
+type memoryStore struct {
+	mu     sync.RWMutex
+	values map[customKey][]Sample
+
+	// samples older than retention are dropped, except the latest one of a series.
+	// Zero means samples are kept forever.
+	retention time.Duration
+}
+
+func NewMemoryStore(retention time.Duration) MetricStore {
+	return newMemoryStore(retention)
+}
+
+func newMemoryStore(retention time.Duration) *memoryStore {
+	return &memoryStore{
+		values:    make(map[customKey][]Sample),
+		retention: retention,
+	}
+}
+
+func (s *memoryStore) Get(info provider.CustomMetricInfo, name types.NamespacedName) (Sample, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	series := s.values[customKey{CustomMetricInfo: info, NamespacedName: name}]
+	if len(series) == 0 {
+		return Sample{}, false
+	}
+	// Quantity caches its string form, hand out a copy
+	return series[len(series)-1].DeepCopy(), true
+}
+
+func (s *memoryStore) Add(info provider.CustomMetricInfo, name types.NamespacedName, sample Sample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := customKey{CustomMetricInfo: info, NamespacedName: name}
+	series := append(s.values[key], sample.DeepCopy())
+	// keep the series in time order, samples are usually added in order
+	for i := len(series) - 1; i > 0 && series[i].Timestamp.Before(series[i-1].Timestamp); i-- {
+		series[i], series[i-1] = series[i-1], series[i]
+	}
+	s.values[key] = s.prune(series)
+}
+
+func (s *memoryStore) History(info provider.CustomMetricInfo, name types.NamespacedName) []Sample {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	series := s.values[customKey{CustomMetricInfo: info, NamespacedName: name}]
+	history := make([]Sample, 0, len(series))
+	for _, sample := range s.prune(series) {
+		history = append(history, sample.DeepCopy())
+	}
+	return history
+}
+
+func (s *memoryStore) Delete(info provider.CustomMetricInfo, name types.NamespacedName) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.values, customKey{CustomMetricInfo: info, NamespacedName: name})
+}
+
+func (s *memoryStore) DeleteSample(info provider.CustomMetricInfo, name types.NamespacedName, timestamp time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := customKey{CustomMetricInfo: info, NamespacedName: name}
+	series := make([]Sample, 0, len(s.values[key]))
+	for _, sample := range s.values[key] {
+		if !sample.Timestamp.Equal(timestamp) {
+			series = append(series, sample)
+		}
+	}
+	if len(series) == 0 {
+		delete(s.values, key)
+		return
+	}
+	s.values[key] = series
+}
+
+func (s *memoryStore) ListMetricInfos() []provider.CustomMetricInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Get unique CustomMetricInfos from wrapper CustomMetricResources
+	infos := make(map[provider.CustomMetricInfo]struct{})
+	for key := range s.values {
+		infos[key.CustomMetricInfo] = struct{}{}
+	}
+
+	// Build slice of CustomMetricInfos to be returns
+	metrics := make([]provider.CustomMetricInfo, 0, len(infos))
+	for info := range infos {
+		metrics = append(metrics, info)
+	}
+
+	return metrics
+}
+
+func (s *memoryStore) ListNames(info provider.CustomMetricInfo) []types.NamespacedName {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]types.NamespacedName, 0)
+	for key := range s.values {
+		if key.CustomMetricInfo == info {
+			names = append(names, key.NamespacedName)
+		}
+	}
+	return names
+}
+
+// prune returns the part of series within the retention window.
+// The latest sample is always kept, so a metric never disappears because it is old.
+func (s *memoryStore) prune(series []Sample) []Sample {
+	if s.retention == 0 || len(series) == 0 {
+		return series
+	}
+
+	deadline := time.Now().Add(-s.retention)
+	i := 0
+	for i < len(series)-1 && series[i].Timestamp.Before(deadline) {
+		i++
+	}
+	return series[i:]
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/fake"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	profilingv1alpha1 "colibri-apiserver/adapter/apis/profiling/v1alpha1"
+)
+
+// newTestMapper maps pods, namespaces and the workloads of apps/v1 and batch/v1
+func newTestMapper() apimeta.RESTMapper {
+	mapper := apimeta.NewDefaultRESTMapper([]schema.GroupVersion{{Version: "v1"}, {Group: "apps", Version: "v1"}, {Group: "batch", Version: "v1"}})
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, apimeta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, apimeta.RESTScopeRoot)
+	for _, kind := range []string{"Deployment", "ReplicaSet", "StatefulSet", "DaemonSet"} {
+		mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: kind}, apimeta.RESTScopeNamespace)
+	}
+	for _, kind := range []string{"Job", "CronJob"} {
+		mapper.Add(schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: kind}, apimeta.RESTScopeNamespace)
+	}
+	return mapper
+}
+
+// testListKinds are the list kinds of the resources listed by the provider and its controller
+var testListKinds = map[schema.GroupVersionResource]string{
+	{Version: "v1", Resource: "pods"}:                        "PodList",
+	{Version: "v1", Resource: "namespaces"}:                  "NamespaceList",
+	{Group: "apps", Version: "v1", Resource: "replicasets"}:  "ReplicaSetList",
+	{Group: "apps", Version: "v1", Resource: "deployments"}:  "DeploymentList",
+	{Group: "apps", Version: "v1", Resource: "statefulsets"}: "StatefulSetList",
+	{Group: "batch", Version: "v1", Resource: "jobs"}:        "JobList",
+	profilingv1alpha1.ProfilingJobsResource:                  "ProfilingJobList",
+}
+
+// newTestClient returns a fake dynamic client of objects, which lists the resources of testListKinds
+func newTestClient(objects ...runtime.Object) *fake.FakeDynamicClient {
+	return fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), testListKinds, objects...)
+}
+
+// newTestProvider returns the provider of opts on client, with the resources of newTestMapper
+func newTestProvider(client dynamic.Interface, opts Options) *colibriProvider {
+	prov, _, _ := NewProvider(client, newTestMapper(), opts)
+	return prov.(*colibriProvider)
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore(0)
+	info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Metric: "1-cpu", Namespaced: true}
+	name := types.NamespacedName{Namespace: "default", Name: "pod"}
+
+	if _, found := s.Get(info, name); found {
+		t.Fatalf("expected no value in an empty store")
+	}
+
+	now := time.Now()
+	s.Add(info, name, Sample{Value: resource.MustParse("200m"), Timestamp: now})
+	s.Add(info, name, Sample{Value: resource.MustParse("100m"), Timestamp: now.Add(-time.Minute)})
+	value, found := s.Get(info, name)
+	if !found || value.Value.Cmp(resource.MustParse("200m")) != 0 || !value.Timestamp.Equal(now) {
+		t.Fatalf("expected 200m at %v, got %v at %v (found: %v)", now, value.Value.String(), value.Timestamp, found)
+	}
+	if history := s.History(info, name); len(history) != 2 || history[0].Value.Cmp(resource.MustParse("100m")) != 0 {
+		t.Fatalf("unexpected history: %v", history)
+	}
+	if infos := s.ListMetricInfos(); len(infos) != 1 || infos[0] != info {
+		t.Fatalf("unexpected metric infos: %v", infos)
+	}
+
+	s.Delete(info, name)
+	if _, found := s.Get(info, name); found {
+		t.Fatalf("expected value to be deleted")
+	}
+	if infos := s.ListMetricInfos(); len(infos) != 0 {
+		t.Fatalf("unexpected metric infos: %v", infos)
+	}
+}
+
+func TestMemoryStoreRetention(t *testing.T) {
+	s := NewMemoryStore(time.Hour)
+	info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Metric: "1-cpu", Namespaced: true}
+	name := types.NamespacedName{Namespace: "default", Name: "pod"}
+	now := time.Now()
+
+	s.Add(info, name, Sample{Value: resource.MustParse("1"), Timestamp: now.Add(-3 * time.Hour)})
+	s.Add(info, name, Sample{Value: resource.MustParse("2"), Timestamp: now.Add(-2 * time.Hour)})
+	if history := s.History(info, name); len(history) != 1 || history[0].Value.Cmp(resource.MustParse("2")) != 0 {
+		t.Fatalf("expected only the latest expired sample to be kept, got %v", history)
+	}
+
+	s.Add(info, name, Sample{Value: resource.MustParse("3"), Timestamp: now})
+	if history := s.History(info, name); len(history) != 1 || history[0].Value.Cmp(resource.MustParse("3")) != 0 {
+		t.Fatalf("expected expired samples to be dropped, got %v", history)
+	}
+}
+
+// run with -race: handlers and custom metrics API access the store at the same time
+func TestProviderConcurrentAccess(t *testing.T) {
+	p := &colibriProvider{
+		mapper: newTestMapper(),
+		values: NewMemoryStore(0),
+		jobs:   newJobTracker(),
+		naming: MetricNaming{Aliases: true},
+	}
+	name := types.NamespacedName{Namespace: "default", Name: "pod"}
+	info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Metric: "0-cpu", Namespaced: true}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := p.putMetric(fmt.Sprintf("%dm", j), fmt.Sprintf("%d-cpu", i), name, "", time.Now()); err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				p.GetMetricByName(context.TODO(), name, info, labels.Everything())
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				p.ListAllMetrics()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 8 aliases and colibri_cpu
+	if metrics := p.ListAllMetrics(); len(metrics) != 9 {
+		t.Fatalf("expected 9 metrics, got %d", len(metrics))
+	}
+	value, err := p.GetMetricByName(context.TODO(), name, info, labels.Everything())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value.Value.Cmp(resource.MustParse("99m")) != 0 {
+		t.Fatalf("expected 99m, got %v", value.Value.String())
+	}
+}
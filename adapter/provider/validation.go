@@ -0,0 +1,209 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Validation holds the bounds of job parameters accepted by runJob
+type Validation struct {
+	// MinFrequency and MaxFrequency bound the query interval in millisecond
+	MinFrequency int
+	MaxFrequency int
+	// MaxIteration bounds the query iterations
+	MaxIteration int
+	// Percentiles are the allowed percentiles, any of 1-100 is allowed if empty
+	Percentiles []int
+	// MaxTimeout bounds the timeout in second requested for a job
+	MaxTimeout int
+}
+
+// DefaultValidation is used when no bound is configured
+var DefaultValidation = Validation{
+	MinFrequency: 1,
+	MaxFrequency: 60000,
+	MaxIteration: 100000,
+	MaxTimeout:   86400,
+}
+
+// validateParam checks params against the bounds, fldPath is the path of params in the request (nil for the root)
+func (v Validation) validateParam(params *jobParam, fldPath *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+
+	if params.Frequency < v.MinFrequency || params.Frequency > v.MaxFrequency {
+		errs = append(errs, field.Invalid(fldPath.Child("freq"), params.Frequency,
+			fmt.Sprintf("must be between %d and %d", v.MinFrequency, v.MaxFrequency)))
+	}
+	if params.Iteration < 1 || params.Iteration > v.MaxIteration {
+		errs = append(errs, field.Invalid(fldPath.Child("iter"), params.Iteration,
+			fmt.Sprintf("must be between 1 and %d", v.MaxIteration)))
+	}
+	if len(v.Percentiles) == 0 {
+		if params.Percentile < 1 || params.Percentile > 100 {
+			errs = append(errs, field.Invalid(fldPath.Child("pert"), params.Percentile, "must be between 1 and 100"))
+		}
+	} else if !containsInt(v.Percentiles, params.Percentile) {
+		allowed := make([]string, 0, len(v.Percentiles))
+		for _, p := range v.Percentiles {
+			allowed = append(allowed, strconv.Itoa(p))
+		}
+		errs = append(errs, field.NotSupported(fldPath.Child("pert"), params.Percentile, allowed))
+	}
+	if params.Timeout < 0 || params.Timeout > v.MaxTimeout {
+		errs = append(errs, field.Invalid(fldPath.Child("timeout"), params.Timeout,
+			fmt.Sprintf("must be between 0 and %d", v.MaxTimeout)))
+	}
+
+	return errs
+}
+
+// validateContainerTarget checks a process targeted by its container and command
+func validateContainerTarget(container string, command string, fldPath *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+
+	if container == "" {
+		errs = append(errs, field.Required(fldPath.Child("container"), ""))
+	}
+	if _, err := regexp.Compile(command); err != nil {
+		errs = append(errs, field.Invalid(fldPath.Child("command"), command, err.Error()))
+	}
+
+	return errs
+}
+
+// validateWorkloadParam checks the parameters of profiling a workload, the ones of its jobs against the bounds
+func (v Validation) validateWorkloadParam(params *workloadParam) field.ErrorList {
+	errs := v.validateParam(&jobParam{
+		Frequency:  params.Frequency,
+		Iteration:  params.Iteration,
+		Percentile: params.Percentile,
+		Timeout:    params.Timeout,
+	}, nil)
+
+	if params.Process == "" {
+		errs = append(errs, field.Required(field.NewPath("process"), ""))
+	}
+	if params.Sample < 0 {
+		errs = append(errs, field.Invalid(field.NewPath("sample"), params.Sample, "must be non-negative"))
+	}
+	switch params.Aggregation {
+	case aggregationMax, aggregationSum, aggregationAvg:
+	default:
+		errs = append(errs, field.NotSupported(field.NewPath("aggregation"), params.Aggregation, []string{aggregationMax, aggregationSum, aggregationAvg}))
+	}
+
+	return errs
+}
+
+// validateRecommendationPatchParam checks the mode and the type of the patch of a workload
+func validateRecommendationPatchParam(params *recommendationPatchParam) field.ErrorList {
+	errs := field.ErrorList{}
+
+	switch params.Mode {
+	case patchModeDryRun, patchModeApply:
+	default:
+		errs = append(errs, field.NotSupported(field.NewPath("mode"), params.Mode, []string{patchModeDryRun, patchModeApply}))
+	}
+	switch params.PatchType {
+	case patchTypeStrategic, patchTypeJSON:
+	default:
+		errs = append(errs, field.NotSupported(field.NewPath("patchType"), params.PatchType, []string{patchTypeStrategic, patchTypeJSON}))
+	}
+
+	return errs
+}
+
+func validateResult(result *jobResult, fldPath *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+
+	for _, f := range []struct {
+		name  string
+		value string
+	}{
+		{name: "cpu", value: result.Cpu},
+		{name: "ram", value: result.Ram},
+		{name: "ingress", value: result.Ingress},
+		{name: "egress", value: result.Egress},
+	} {
+		q, err := resource.ParseQuantity(f.value)
+		if err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child(f.name), f.value, err.Error()))
+			continue
+		}
+		if q.Sign() < 0 {
+			errs = append(errs, field.Invalid(fldPath.Child(f.name), f.value, "must be non-negative"))
+		}
+	}
+
+	return errs
+}
+
+// applyDefaults sets the fields of the struct pointed by obj to the values of their "default" tags,
+// it is called before decoding a request, so only the omitted fields keep the defaults
+func applyDefaults(obj interface{}) {
+	v := reflect.ValueOf(obj).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		def, found := t.Field(i).Tag.Lookup("default")
+		if !found {
+			continue
+		}
+		switch f := v.Field(i); f.Kind() {
+		case reflect.String:
+			f.SetString(def)
+		case reflect.Int:
+			// the tags are written by us, a broken one is a bug
+			n, err := strconv.Atoi(def)
+			if err != nil {
+				panic(fmt.Sprintf("invalid default of %s.%s: %s", t.Name(), t.Field(i).Name, err))
+			}
+			f.SetInt(int64(n))
+		}
+	}
+}
+
+// paramsOrDefaults returns the parameters of a job declared by an object, zero values are omitted ones keeping their defaults
+func paramsOrDefaults(frequency int, iteration int, percentile int) *jobParam {
+	params := new(jobParam)
+	applyDefaults(params)
+	if frequency != 0 {
+		params.Frequency = frequency
+	}
+	if iteration != 0 {
+		params.Iteration = iteration
+	}
+	if percentile != 0 {
+		params.Percentile = percentile
+	}
+	return params
+}
+
+func containsInt(list []int, n int) bool {
+	for _, item := range list {
+		if item == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// serveRequest serves a request to the colibri web service of p, with the headers given in pairs
+func serveRequest(p *colibriProvider, method string, path string, body string, headers ...string) *httptest.ResponseRecorder {
+	container := restful.NewContainer()
+	container.Add(p.webService())
+
+	request := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	request.Header.Set("Content-Type", restful.MIME_JSON)
+	for i := 0; i+1 < len(headers); i += 2 {
+		request.Header.Set(headers[i], headers[i+1])
+	}
+	recorder := httptest.NewRecorder()
+	container.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// invalidFields returns the fields of the causes of an Invalid status written to recorder
+func invalidFields(t *testing.T, recorder *httptest.ResponseRecorder) []string {
+	var status metav1.Status
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatalf("expected a Status, got %s: %v", recorder.Body.String(), err)
+	}
+	if status.Reason != metav1.StatusReasonInvalid || status.Details == nil {
+		t.Fatalf("expected Invalid, got %+v", status)
+	}
+	fields := make([]string, 0, len(status.Details.Causes))
+	for _, cause := range status.Details.Causes {
+		fields = append(fields, cause.Field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func TestValidateParam(t *testing.T) {
+	v := Validation{MinFrequency: 10, MaxFrequency: 1000, MaxIteration: 100, Percentiles: []int{50, 99}, MaxTimeout: 60}
+	tests := []struct {
+		name   string
+		params jobParam
+		want   []string
+	}{
+		{name: "valid", params: jobParam{Frequency: 10, Iteration: 100, Percentile: 99, Timeout: 60}, want: []string{}},
+		{name: "frequency out of bounds", params: jobParam{Frequency: 5, Iteration: 1, Percentile: 50}, want: []string{"spec.freq"}},
+		{name: "no iteration", params: jobParam{Frequency: 10, Percentile: 50}, want: []string{"spec.iter"}},
+		{name: "percentile not allowed", params: jobParam{Frequency: 10, Iteration: 1, Percentile: 90}, want: []string{"spec.pert"}},
+		{name: "all invalid", params: jobParam{Frequency: 2000, Iteration: 101, Percentile: 100, Timeout: -1},
+			want: []string{"spec.freq", "spec.iter", "spec.pert", "spec.timeout"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := v.validateParam(&tt.params, field.NewPath("spec"))
+			got := make([]string, 0, len(errs))
+			for _, err := range errs {
+				got = append(got, err.Field)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected invalid %v, got %v", tt.want, errs)
+			}
+		})
+	}
+}
+
+func TestInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		body string
+		want []string
+	}{
+		{name: "job parameters", path: "/colibri/default/web-0/1", body: `{"freq": 0, "iter": -1, "pert": 101}`,
+			want: []string{"freq", "iter", "pert"}},
+		{name: "container target", path: "/colibri/default/web-0", body: `{"command": "("}`,
+			want: []string{"command", "container"}},
+		{name: "result", path: "/colibri/default.web-0.1", body: `{"cpu": "a lot", "ram": "-1Mi"}`,
+			want: []string{"cpu", "ram"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &countingRunner{runs: map[string]int{}}
+			p := newJobTestProvider(t, runner)
+
+			recorder := serveRequest(p, http.MethodPost, tt.path, tt.body)
+			if recorder.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("expected %d, got %d: %s", http.StatusUnprocessableEntity, recorder.Code, recorder.Body.String())
+			}
+			if got := invalidFields(t, recorder); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected invalid %v, got %v", tt.want, got)
+			}
+			if got := runner.counts(); !reflect.DeepEqual(got, map[string]int{"job": 1}) {
+				t.Errorf("expected no job started for an invalid request, got %v", got)
+			}
+		})
+	}
+}
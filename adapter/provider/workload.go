@@ -0,0 +1,507 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// workloadRef is the workload controlling pods, or a pod which is not controlled
+type workloadRef struct {
+	APIVersion string
+	Kind       string
+	Name       string
+}
+
+// refOf returns the workload an owner reference refers to
+func refOf(owner *metav1.OwnerReference) workloadRef {
+	return workloadRef{APIVersion: owner.APIVersion, Kind: owner.Kind, Name: owner.Name}
+}
+
+// groupKind returns the group and the kind of a workload
+func (r workloadRef) groupKind() schema.GroupKind {
+	gv, _ := schema.ParseGroupVersion(r.APIVersion)
+	return schema.GroupKind{Group: gv.Group, Kind: r.Kind}
+}
+
+// is tells whether two refs are of the same workload, regardless of the versions they are referred by
+func (r workloadRef) is(other workloadRef) bool {
+	return r.groupKind() == other.groupKind() && r.Name == other.Name
+}
+
+// workloadOf returns the workload controlling a pod.
+// Pods of a ReplicaSet are taken as pods of its Deployment, and pods of a Job as pods of its CronJob.
+func (p *colibriProvider) workloadOf(pod *unstructured.Unstructured) (workloadRef, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return workloadRef{APIVersion: "v1", Kind: "Pod", Name: pod.GetName()}, nil
+	}
+
+	var res schema.GroupVersionResource
+	switch ref := refOf(owner); ref.groupKind() {
+	case schema.GroupKind{Group: "apps", Kind: "ReplicaSet"}:
+		res = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}
+	case schema.GroupKind{Group: "batch", Kind: "Job"}:
+		res = schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+	default:
+		return ref, nil
+	}
+
+	parent, err := p.objects.get(res, pod.GetNamespace(), owner.Name)
+	if apierr.IsNotFound(err) && p.objects.cached(res) {
+		// the parent of a pod created just now may not be in the cache yet
+		parent, err = p.client.Resource(res).Namespace(pod.GetNamespace()).Get(context.TODO(), owner.Name, metav1.GetOptions{})
+	}
+	if apierr.IsNotFound(err) {
+		return refOf(owner), nil
+	}
+	if err != nil {
+		return workloadRef{}, err
+	}
+	if grandOwner := metav1.GetControllerOf(parent); grandOwner != nil {
+		return refOf(grandOwner), nil
+	}
+	return refOf(owner), nil
+}
+
+// resourceOf returns the resource of a workload, mapped by the group and the version it is referred by
+func (p *colibriProvider) resourceOf(ref workloadRef) (schema.GroupVersionResource, error) {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return schema.GroupVersionResource{}, err
+	}
+	mapping, err := p.mapper.RESTMapping(ref.groupKind(), gv.Version)
+	if err != nil {
+		return schema.GroupVersionResource{}, err
+	}
+	return mapping.Resource, nil
+}
+
+// workloadByRef gets a workload by its ref, and returns it with its resource
+func (p *colibriProvider) workloadByRef(ns string, ref workloadRef) (*unstructured.Unstructured, schema.GroupVersionResource, schema.GroupVersionKind, error) {
+	gvk := schema.FromAPIVersionAndKind(ref.APIVersion, ref.Kind)
+	res, err := p.resourceOf(ref)
+	if err != nil {
+		return nil, res, gvk, err
+	}
+	workload, err := p.client.Resource(res).Namespace(ns).Get(context.TODO(), ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, res, gvk, err
+	}
+	return workload, res, gvk, nil
+}
+
+// podWorkload returns the workload controlling a pod by its name
+func (p *colibriProvider) podWorkload(ns string, name string) (workloadRef, error) {
+	podResource := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+	pod, err := p.objects.get(podResource, ns, name)
+	if err != nil {
+		return workloadRef{}, err
+	}
+	return p.workloadOf(pod)
+}
+
+// Parameters of profiling a workload, by a job for each sampled pod
+type workloadParam struct {
+	Process     string `json:"process" description:"targeted process ID in each pod"`
+	Frequency   int    `json:"freq" description:"frequency of query" default:"10"`
+	Iteration   int    `json:"iter" description:"iteration of query" default:"1000"`
+	Percentile  int    `json:"pert" description:"percentile of data analytics" default:"99"`
+	Timeout     int    `json:"timeout" description:"seconds each job waits for its result, derived from freq and iter if 0" default:"0"`
+	Sample      int    `json:"sample" description:"number of pods profiled, chosen randomly, all running pods if 0" default:"0"`
+	Aggregation string `json:"aggregation" description:"how results of pods are aggregated: max, sum or avg" default:"max"`
+}
+
+// The record of profiling a workload launched by runWorkload
+type workloadRecord struct {
+	ID          string           `json:"id" description:"ID of the workload profiling"`
+	Namespace   string           `json:"namespace" description:"namespace of the workload"`
+	Kind        string           `json:"kind" description:"kind of the workload"`
+	Name        string           `json:"name" description:"name of the workload"`
+	Process     string           `json:"process" description:"targeted process ID in each pod"`
+	Params      jobParam         `json:"params" description:"parameters of the jobs"`
+	Aggregation string           `json:"aggregation" description:"how results of pods are aggregated"`
+	Jobs        []string         `json:"jobs" description:"IDs of the jobs of the sampled pods"`
+	State       JobState         `json:"state" description:"Pending while starting jobs, Running until all jobs are finished, then Succeeded if any job succeeded, otherwise Failed"`
+	Reason      string           `json:"reason,omitempty" description:"why the profiling is failed"`
+	Result      *jobResultSample `json:"result,omitempty" description:"aggregated result of the succeeded jobs"`
+	CreatedAt   time.Time        `json:"createdAt" description:"time the profiling is requested"`
+	FinishedAt  *time.Time       `json:"finishedAt,omitempty" description:"time all jobs are finished"`
+
+	// the workload resource the aggregated result is stored for
+	resource schema.GroupResource
+}
+
+// workloadTracker keeps the records of all workload profilings, safe for concurrent use
+type workloadTracker struct {
+	mu   sync.RWMutex
+	runs map[string]*workloadRecord
+}
+
+func newWorkloadTracker() *workloadTracker {
+	return &workloadTracker{
+		runs: make(map[string]*workloadRecord),
+	}
+}
+
+func (t *workloadTracker) add(record workloadRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.runs[record.ID] = &record
+}
+
+func (t *workloadTracker) get(id string) (workloadRecord, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	record, found := t.runs[id]
+	if !found {
+		return workloadRecord{}, false
+	}
+	return *record, true
+}
+
+// unfinished returns the IDs of the records not finished yet having the job
+func (t *workloadTracker) unfinished(jobID string) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var ids []string
+	for _, record := range t.runs {
+		if record.State.finished() {
+			continue
+		}
+		for _, id := range record.Jobs {
+			if id == jobID {
+				ids = append(ids, record.ID)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+// latestSucceeded returns the latest succeeded record of profiling a process of a workload
+func (t *workloadTracker) latestSucceeded(ns string, kind string, name string, process string) (workloadRecord, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var latest *workloadRecord
+	for _, record := range t.runs {
+		if record.State != JobSucceeded || record.Namespace != ns || record.Kind != kind || record.Name != name || record.Process != process {
+			continue
+		}
+		if latest == nil || record.FinishedAt.After(*latest.FinishedAt) {
+			latest = record
+		}
+	}
+	if latest == nil {
+		return workloadRecord{}, false
+	}
+	return *latest, true
+}
+
+// update modifies a record which is not finished yet, and returns the updated record and whether it is modified
+func (t *workloadTracker) update(id string, fn func(*workloadRecord)) (workloadRecord, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	record, found := t.runs[id]
+	if !found || record.State.finished() {
+		return workloadRecord{}, false
+	}
+	fn(record)
+	return *record, true
+}
+
+// resolveWorkload finds a workload by its kind (or resource) and name, and returns it with its resource
+func (p *colibriProvider) resolveWorkload(ns string, kind string, name string) (*unstructured.Unstructured, schema.GroupVersionResource, schema.GroupVersionKind, error) {
+	res, err := p.mapper.ResourceFor(schema.GroupVersionResource{Resource: strings.ToLower(kind)})
+	if err != nil {
+		return nil, res, schema.GroupVersionKind{}, apierr.NewBadRequest(fmt.Sprintf("unknown workload kind %q: %v", kind, err))
+	}
+	gvk, err := p.mapper.KindFor(res)
+	if err != nil {
+		return nil, res, gvk, err
+	}
+	workload, err := p.client.Resource(res).Namespace(ns).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, res, gvk, err
+	}
+	return workload, res, gvk, nil
+}
+
+// workloadPods returns the running pods controlled by a workload, selected by the selector of the workload
+func (p *colibriProvider) workloadPods(workload *unstructured.Unstructured, kind string) ([]*unstructured.Unstructured, error) {
+	selectorMap, found, err := unstructured.NestedMap(workload.Object, "spec", "selector")
+	if err != nil || !found {
+		return nil, apierr.NewBadRequest(fmt.Sprintf("%s %s has no pod selector", kind, workload.GetName()))
+	}
+	labelSelector := &metav1.LabelSelector{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(selectorMap, labelSelector); err != nil {
+		return nil, err
+	}
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	res := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+	list, err := p.client.Resource(res).Namespace(workload.GetNamespace()).List(context.TODO(), metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	// other workloads may select the same labels
+	want := workloadRef{APIVersion: workload.GetAPIVersion(), Kind: kind, Name: workload.GetName()}
+	var pods []*unstructured.Unstructured
+	for i := range list.Items {
+		pod := &list.Items[i]
+		phase, _, _ := unstructured.NestedString(pod.Object, "status", "phase")
+		if phase != "Running" {
+			continue
+		}
+		ref, err := p.workloadOf(pod)
+		if err != nil {
+			return nil, err
+		}
+		if ref.is(want) {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+// samplePods chooses n pods randomly, all pods if n is 0 or not less than the number of pods
+func samplePods(pods []*unstructured.Unstructured, n int) []*unstructured.Unstructured {
+	if n > 0 && n < len(pods) {
+		rand.Shuffle(len(pods), func(i, j int) { pods[i], pods[j] = pods[j], pods[i] })
+		pods = pods[:n]
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].GetName() < pods[j].GetName() })
+	return pods
+}
+
+// startWorkloadJob runs a job for each sampled pod of a workload.
+// The results are aggregated once all jobs are finished. The parameters are validated by the caller.
+func (p *colibriProvider) startWorkloadJob(ns string, kind string, name string, params *workloadParam) (workloadRecord, error) {
+	workload, res, gvk, err := p.resolveWorkload(ns, kind, name)
+	if err != nil {
+		return workloadRecord{}, err
+	}
+	pods, err := p.workloadPods(workload, gvk.Kind)
+	if err != nil {
+		return workloadRecord{}, err
+	}
+	if len(pods) == 0 {
+		return workloadRecord{}, apierr.NewConflict(res.GroupResource(), name, errors.New("no running pod of the workload"))
+	}
+	pods = samplePods(pods, params.Sample)
+
+	jobParams := &jobParam{Frequency: params.Frequency, Iteration: params.Iteration, Percentile: params.Percentile, Timeout: params.Timeout}
+	record := workloadRecord{
+		ID:          string(uuid.NewUUID()),
+		Namespace:   ns,
+		Kind:        gvk.Kind,
+		Name:        name,
+		Process:     params.Process,
+		Params:      *jobParams,
+		Aggregation: params.Aggregation,
+		State:       JobPending,
+		CreatedAt:   time.Now(),
+		resource:    res.GroupResource(),
+	}
+	p.workloads.add(record)
+
+	for _, pod := range pods {
+		// the job is recorded first, so the profiling waits for it even if it is finished at once
+		jobID := string(uuid.NewUUID())
+		p.workloads.update(record.ID, func(r *workloadRecord) {
+			r.Jobs = append(r.Jobs, jobID)
+		})
+		// a pod failed to start a job does not fail the others, its job is Failed
+		if _, err := p.startJob(pod, ns, pod.GetName(), jobTarget{Process: params.Process}, jobParams, jobID); err != nil {
+			klog.Errorf("Failed to start job for pod %s of %s %s: %v", pod.GetName(), gvk.Kind, name, err)
+		}
+	}
+
+	// all jobs may be finished already
+	p.workloads.update(record.ID, func(r *workloadRecord) {
+		r.State = JobRunning
+	})
+	p.finishWorkloadJob(record.ID)
+	record, _ = p.workloads.get(record.ID)
+	return record, nil
+}
+
+// setJobState moves a job to state. When the job is finished by it, the parameters stored for the job are removed
+// unless it has put its result, and the workload profilings waiting for it are finished.
+func (p *colibriProvider) setJobState(id string, state JobState, reason string) jobRecord {
+	record, finished := p.jobs.setState(id, state, reason)
+	if !finished {
+		return record
+	}
+	// the parameters of a cancelled job are removed even if it has put its result
+	if !record.resultPut || record.State == JobCancelled {
+		p.removeParams(record)
+	}
+	for _, runID := range p.workloads.unfinished(id) {
+		p.finishWorkloadJob(runID)
+	}
+	return record
+}
+
+// finishWorkloadJob aggregates the results of the jobs of a workload profiling when all of them are finished
+func (p *colibriProvider) finishWorkloadJob(id string) {
+	record, found := p.workloads.get(id)
+	// jobs are still being started while Pending
+	if !found || record.State != JobRunning {
+		return
+	}
+
+	samples := make(map[string][]Sample)
+	for _, jobID := range record.Jobs {
+		job, found := p.jobs.get(jobID)
+		if !found {
+			continue
+		}
+		if !job.State.finished() {
+			return
+		}
+		if job.State != JobSucceeded {
+			continue
+		}
+		// only the result put by the job itself
+		result, err := p.latestResult(types.NamespacedName{Namespace: job.Namespace, Name: job.Pod}, job.Process)
+		if err != nil || result.Timestamp.Before(job.CreatedAt) {
+			continue
+		}
+		for key, value := range map[string]string{"-cpu": result.Cpu, "-ram": result.Ram, "-ig": result.Ingress, "-eg": result.Egress} {
+			q, err := resource.ParseQuantity(value)
+			if err != nil {
+				continue
+			}
+			samples[key] = append(samples[key], Sample{Value: q, Timestamp: result.Timestamp})
+		}
+	}
+
+	now := time.Now()
+	if len(samples["-cpu"]) == 0 {
+		p.workloads.update(id, func(r *workloadRecord) {
+			r.State = JobFailed
+			r.Reason = "No job of the sampled pods succeeded"
+			r.FinishedAt = &now
+		})
+		klog.Infof("Workload profiling %s is %s", id, JobFailed)
+		return
+	}
+
+	result := &jobResultSample{Timestamp: now}
+	values := make(map[string]resource.Quantity)
+	for _, metric := range []struct {
+		key   string
+		field *string
+	}{
+		{key: "-cpu", field: &result.Cpu},
+		{key: "-ram", field: &result.Ram},
+		{key: "-ig", field: &result.Ingress},
+		{key: "-eg", field: &result.Egress},
+	} {
+		if len(samples[metric.key]) == 0 {
+			continue
+		}
+		value, _ := aggregateSamples(samples[metric.key], record.Aggregation)
+		*metric.field = value.String()
+		values[metric.key] = value
+	}
+	values["-pert"] = *resource.NewQuantity(int64(record.Params.Percentile), resource.DecimalSI)
+
+	// only the first one seeing all jobs finished stores the result
+	if _, updated := p.workloads.update(id, func(r *workloadRecord) {
+		r.State = JobSucceeded
+		r.Result = result
+		r.FinishedAt = &now
+	}); !updated {
+		return
+	}
+	klog.Infof("Workload profiling %s is %s", id, JobSucceeded)
+
+	// the aggregated result is stored like the results of pods, for the workload
+	name := types.NamespacedName{Namespace: record.Namespace, Name: record.Name}
+	for key, value := range values {
+		info := p.workloadInfo(record.resource, record.Process+key)
+		p.values.Add(info, name, Sample{Value: value, Timestamp: now})
+	}
+}
+
+// the info of a metric of a workload, the same as the one normalized by the custom metrics API
+func (p *colibriProvider) workloadInfo(res schema.GroupResource, metric string) provider.CustomMetricInfo {
+	info := provider.CustomMetricInfo{GroupResource: res, Metric: metric, Namespaced: true}
+	if normalized, _, err := info.Normalized(p.mapper); err == nil {
+		return normalized
+	}
+	return info
+}
+
+// latestWorkloadResult returns the latest aggregated result of a process of a workload
+func (p *colibriProvider) latestWorkloadResult(ns string, kind string, name string, pid string) (jobResultSample, error) {
+	res, err := p.mapper.ResourceFor(schema.GroupVersionResource{Resource: strings.ToLower(kind)})
+	if err != nil {
+		return jobResultSample{}, apierr.NewBadRequest(fmt.Sprintf("unknown workload kind %q: %v", kind, err))
+	}
+
+	namespacedName := types.NamespacedName{Namespace: ns, Name: name}
+	result := jobResultSample{}
+	for _, metric := range []struct {
+		key   string
+		field *string
+	}{
+		{key: "-cpu", field: &result.Cpu},
+		{key: "-ram", field: &result.Ram},
+		{key: "-ig", field: &result.Ingress},
+		{key: "-eg", field: &result.Egress},
+	} {
+		info := p.workloadInfo(res.GroupResource(), pid+metric.key)
+		sample, found := p.values.Get(info, namespacedName)
+		if !found {
+			return result, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name)
+		}
+		*metric.field = sample.Value.String()
+		result.Timestamp = sample.Timestamp
+	}
+	return result, nil
+}
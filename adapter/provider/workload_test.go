@@ -0,0 +1,138 @@
+/*
+Copyright 2022 Carol Hsu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// newWorkloadTestProvider returns a provider with the StatefulSet default/web of the running pods web-0, web-1 and web-2,
+// its pending pod web-3, and the pod other-0 of another StatefulSet selected by the same labels
+func newWorkloadTestProvider(t *testing.T, runner *countingRunner) *colibriProvider {
+	objects := []runtime.Object{
+		newTestObject("v1", "Namespace", "", "default", nil),
+		newTestObject("apps/v1", "StatefulSet", "default", "web", map[string]interface{}{
+			"selector": map[string]interface{}{"matchLabels": map[string]interface{}{"app": "web"}},
+		}),
+	}
+	for name, owner := range map[string]string{"web-0": "web", "web-1": "web", "web-2": "web", "web-3": "web", "other-0": "other"} {
+		pod := newTestObject("v1", "Pod", "default", name, map[string]interface{}{
+			"nodeName":   "node-1",
+			"containers": []interface{}{map[string]interface{}{"name": "server"}},
+		})
+		pod.SetLabels(map[string]string{"app": "web"})
+		pod.SetOwnerReferences([]metav1.OwnerReference{ownerOf("apps/v1", "StatefulSet", owner)})
+		phase := "Running"
+		if name == "web-3" {
+			phase = "Pending"
+		}
+		if err := unstructured.SetNestedField(pod.Object, phase, "status", "phase"); err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, pod)
+	}
+
+	opts := DefaultOptions()
+	opts.Runner = runner
+	return newTestProvider(newTestClient(objects...), opts)
+}
+
+func TestWorkloadProfiling(t *testing.T) {
+	cpu := map[string]string{"web-0": "100m", "web-1": "200m", "web-2": "600m"}
+	tests := []struct {
+		name        string
+		aggregation string
+		failed      map[string]bool
+		state       JobState
+		want        string
+	}{
+		{name: "max", aggregation: aggregationMax, state: JobSucceeded, want: "600m"},
+		{name: "sum", aggregation: aggregationSum, state: JobSucceeded, want: "900m"},
+		{name: "avg", aggregation: aggregationAvg, state: JobSucceeded, want: "300m"},
+		{name: "only the succeeded jobs", aggregation: aggregationMax, failed: map[string]bool{"web-2": true}, state: JobSucceeded, want: "200m"},
+		{name: "no job succeeded", aggregation: aggregationMax, failed: map[string]bool{"web-0": true, "web-1": true, "web-2": true}, state: JobFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &countingRunner{runs: map[string]int{}, specs: map[string]JobSpec{}}
+			p := newWorkloadTestProvider(t, runner)
+			params := &workloadParam{Process: "1", Frequency: 10, Iteration: 1000, Percentile: 99, Aggregation: tt.aggregation}
+
+			record, err := p.startWorkloadJob("default", "statefulset", "web", params)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if record.Kind != "StatefulSet" || record.State != JobRunning || len(record.Jobs) != 3 {
+				t.Fatalf("expected a job for each running pod of the StatefulSet, got %+v", record)
+			}
+
+			for i, id := range record.Jobs {
+				job, _ := p.jobs.get(id)
+				if tt.failed[job.Pod] {
+					p.setJobState(id, JobFailed, "BackoffLimitExceeded")
+				} else {
+					result := &jobResult{Cpu: cpu[job.Pod], Ram: "64Mi", Ingress: "10k", Egress: "20k"}
+					if _, err := p.storeResult("default", job.Pod, "1", runner.specs[id].Token, result); err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					p.setJobState(id, JobSucceeded, "")
+				}
+				if got, _ := p.workloads.get(record.ID); i < len(record.Jobs)-1 && got.State != JobRunning {
+					t.Errorf("expected the profiling running until all jobs are finished, got %s", got.State)
+				}
+			}
+
+			got, _ := p.workloads.get(record.ID)
+			if got.State != tt.state || got.FinishedAt == nil {
+				t.Fatalf("expected the profiling %s, got %s: %s", tt.state, got.State, got.Reason)
+			}
+			if tt.state != JobSucceeded {
+				return
+			}
+			if got.Result == nil || got.Result.Cpu != tt.want {
+				t.Errorf("expected cpu %s aggregated, got %+v", tt.want, got.Result)
+			}
+			stored, err := p.latestWorkloadResult("default", "statefulset", "web", "1")
+			if err != nil || stored.Cpu != tt.want {
+				t.Errorf("expected cpu %s stored for the StatefulSet, got %+v: %v", tt.want, stored, err)
+			}
+		})
+	}
+}
+
+func TestWorkloadProfilingSample(t *testing.T) {
+	runner := &countingRunner{runs: map[string]int{}}
+	p := newWorkloadTestProvider(t, runner)
+	params := &workloadParam{Process: "1", Frequency: 10, Iteration: 1000, Percentile: 99, Sample: 2, Aggregation: aggregationMax}
+
+	record, err := p.startWorkloadJob("default", "statefulset", "web", params)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pods := map[string]bool{}
+	for _, id := range record.Jobs {
+		job, _ := p.jobs.get(id)
+		pods[job.Pod] = true
+	}
+	if len(pods) != 2 || pods["web-3"] || pods["other-0"] {
+		t.Errorf("expected 2 running pods of the StatefulSet sampled, got %v", pods)
+	}
+}